@@ -0,0 +1,52 @@
+/*
+Mock OpenID Connect identity provider to test single sign-on (see oidc.go)
+locally, without network access nor a real IdP. It runs the mock of the
+go_project/mockidp package, also used by the tests of the login flow.
+It logs in a fixed user without asking anything.
+NEVER use it anywhere else than on localhost.
+
+Usage, with GOPATH set like for the backend:
+go run mock_idp/main.go
+Then start the backend with OIDC_ISSUER=http://127.0.0.1:9000 and OIDC_CLIENT_ID=mock.
+
+Env vars:
+- MOCK_IDP_PORT: default 9000
+- MOCK_IDP_USER: name of the logged in user, default alice
+- MOCK_IDP_GROUPS: comma separated groups of the user, default analysts
+*/
+
+package main
+
+import (
+	"go_project/mockidp"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// getEnv gets an env var, or a default value if not set
+func getEnv(name string, defaultValue string) string {
+	envContent := os.Getenv(name)
+	if envContent == "" {
+		envContent = defaultValue
+	}
+	return envContent
+}
+
+func main() {
+
+	port := getEnv("MOCK_IDP_PORT", "9000")
+	issuer := "http://127.0.0.1:" + port
+	user := getEnv("MOCK_IDP_USER", "alice")
+	groups := strings.Split(getEnv("MOCK_IDP_GROUPS", "analysts"), ",")
+
+	idp, err := mockidp.New(issuer, user, groups)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Mock IdP listening on " + issuer + " for user " + user)
+	log.Fatal(http.ListenAndServe("127.0.0.1:"+port, idp))
+
+}
@@ -5,6 +5,7 @@ Send to frontend a list of industries existing the companysocialprofile.industry
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -19,7 +20,7 @@ type CompSocProfRow struct {
 
 // getAllCompaniesIndustries queries db to retrieve a distinct list of all industries
 // in companysocialprofile table
-func getAllCompaniesIndustries(w http.ResponseWriter) ([]CompSocProfRow, error) {
+func getAllCompaniesIndustries(ctx context.Context, w http.ResponseWriter) ([]CompSocProfRow, error) {
 
 	var compSocProfRows []CompSocProfRow
 	var err error
@@ -37,7 +38,7 @@ func getAllCompaniesIndustries(w http.ResponseWriter) ([]CompSocProfRow, error)
 
 	sqlStmt := "SELECT DISTINCT(industry) FROM companysocialprofile WHERE industry <> ''"
 
-	rows, err := db.Query(sqlStmt)
+	rows, err := db.QueryContext(ctx, sqlStmt)
 	if err != nil {
 		err = CustErr(err, "SQL query failed.\nStopping here.")
 		log.Println(err)
@@ -63,7 +64,7 @@ func getAllCompaniesIndustries(w http.ResponseWriter) ([]CompSocProfRow, error)
 // ReturnCompaniesIndustriesList loads all companies industries from db and send it in JSON to frontend
 func ReturnCompaniesIndustriesList(w http.ResponseWriter, r *http.Request) {
 
-	compSocProfRows, err := getAllCompaniesIndustries(w)
+	compSocProfRows, err := getAllCompaniesIndustries(r.Context(), w)
 	if err != nil {
 		return
 	}
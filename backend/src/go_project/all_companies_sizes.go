@@ -5,6 +5,7 @@ Send to frontend a list of companies sizes existing in company.size
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -19,7 +20,7 @@ type CompanyRow struct {
 
 // getAllCompaniesSizes queries db to retrieve a distinct list of all sizes
 // in company table
-func getAllCompaniesSizes(w http.ResponseWriter) ([]CompanyRow, error) {
+func getAllCompaniesSizes(ctx context.Context, w http.ResponseWriter) ([]CompanyRow, error) {
 
 	var companyRows []CompanyRow
 	var err error
@@ -37,7 +38,7 @@ func getAllCompaniesSizes(w http.ResponseWriter) ([]CompanyRow, error) {
 
 	sqlStmt := "SELECT DISTINCT(size) FROM company WHERE size <> ''"
 
-	rows, err := db.Query(sqlStmt)
+	rows, err := db.QueryContext(ctx, sqlStmt)
 	if err != nil {
 		err = CustErr(err, "SQL query failed.\nStopping here.")
 		log.Println(err)
@@ -63,7 +64,7 @@ func getAllCompaniesSizes(w http.ResponseWriter) ([]CompanyRow, error) {
 // ReturnCompaniesSizesList loads all companies sizes from db and send it in JSON to frontend
 func ReturnCompaniesSizesList(w http.ResponseWriter, r *http.Request) {
 
-	companyRows, err := getAllCompaniesSizes(w)
+	companyRows, err := getAllCompaniesSizes(r.Context(), w)
 	if err != nil {
 		return
 	}
@@ -5,6 +5,7 @@ Send to frontend a list of companies types existing in companysocialprofile.type
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -21,7 +22,7 @@ type CompSocProfRow2 struct {
 
 // getAllCompaniesTypes queries db to retrieve a distinct list of all companies sizes
 // in companysocialprofile table
-func getAllCompaniesTypes(w http.ResponseWriter) ([]CompSocProfRow2, error) {
+func getAllCompaniesTypes(ctx context.Context, w http.ResponseWriter) ([]CompSocProfRow2, error) {
 
 	var compSocProfRows2 []CompSocProfRow2
 	var err error
@@ -39,7 +40,7 @@ func getAllCompaniesTypes(w http.ResponseWriter) ([]CompSocProfRow2, error) {
 
 	sqlStmt := "SELECT DISTINCT(type) FROM companysocialprofile WHERE type <> ''"
 
-	rows, err := db.Query(sqlStmt)
+	rows, err := db.QueryContext(ctx, sqlStmt)
 	if err != nil {
 		err = CustErr(err, "SQL query failed.\nStopping here.")
 		log.Println(err)
@@ -65,7 +66,7 @@ func getAllCompaniesTypes(w http.ResponseWriter) ([]CompSocProfRow2, error) {
 // ReturnCompaniesTypesList loads all companies types from db and send it in JSON to frontend
 func ReturnCompaniesTypesList(w http.ResponseWriter, r *http.Request) {
 
-	compSocProfRows2, err := getAllCompaniesTypes(w)
+	compSocProfRows2, err := getAllCompaniesTypes(r.Context(), w)
 	if err != nil {
 		return
 	}
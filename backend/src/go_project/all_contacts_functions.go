@@ -5,6 +5,7 @@ Send to frontend a list of functions existing in the job_function table
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -19,7 +20,7 @@ type JobFunctionRow struct {
 
 // getAllContactsFunctions queries db to retrieve a distinct list of all functions
 // in job_function table
-func getAllContactsFunctions(w http.ResponseWriter) ([]JobFunctionRow, error) {
+func getAllContactsFunctions(ctx context.Context, w http.ResponseWriter) ([]JobFunctionRow, error) {
 
 	var jobFunctionRows []JobFunctionRow
 	var err error
@@ -37,7 +38,7 @@ func getAllContactsFunctions(w http.ResponseWriter) ([]JobFunctionRow, error) {
 
 	sqlStmt := "SELECT name FROM job_function"
 
-	rows, err := db.Query(sqlStmt)
+	rows, err := db.QueryContext(ctx, sqlStmt)
 	if err != nil {
 		err = CustErr(err, "SQL query failed.\nStopping here.")
 		log.Println(err)
@@ -63,7 +64,7 @@ func getAllContactsFunctions(w http.ResponseWriter) ([]JobFunctionRow, error) {
 // ReturnContactsFunctionsList loads all contacts functions from db and send it in JSON to frontend
 func ReturnContactsFunctionsList(w http.ResponseWriter, r *http.Request) {
 
-	jobFunctionRows, err := getAllContactsFunctions(w)
+	jobFunctionRows, err := getAllContactsFunctions(r.Context(), w)
 	if err != nil {
 		return
 	}
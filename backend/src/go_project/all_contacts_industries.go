@@ -5,6 +5,7 @@ Send to frontend a list of industries existing the prospectsocialprofile.industr
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -19,7 +20,7 @@ type ContSocProfRow struct {
 
 // getAllContactsIndustries queries db to retrieve a distinct list of all industries
 // in prospectsocialprofile table
-func getAllContactsIndustries(w http.ResponseWriter) ([]ContSocProfRow, error) {
+func getAllContactsIndustries(ctx context.Context, w http.ResponseWriter) ([]ContSocProfRow, error) {
 
 	var contSocProfRows []ContSocProfRow
 	var err error
@@ -37,7 +38,7 @@ func getAllContactsIndustries(w http.ResponseWriter) ([]ContSocProfRow, error) {
 
 	sqlStmt := "SELECT DISTINCT(industry) FROM prospectsocialprofile WHERE industry <> ''"
 
-	rows, err := db.Query(sqlStmt)
+	rows, err := db.QueryContext(ctx, sqlStmt)
 	if err != nil {
 		err = CustErr(err, "SQL query failed.\nStopping here.")
 		log.Println(err)
@@ -63,7 +64,7 @@ func getAllContactsIndustries(w http.ResponseWriter) ([]ContSocProfRow, error) {
 // ReturnContactsIndustriesList loads all contacts industries from db and send it in JSON to frontend
 func ReturnContactsIndustriesList(w http.ResponseWriter, r *http.Request) {
 
-	contSocProfRows, err := getAllContactsIndustries(w)
+	contSocProfRows, err := getAllContactsIndustries(r.Context(), w)
 	if err != nil {
 		return
 	}
@@ -5,6 +5,7 @@ Send to frontend a list of job levels existing in the job_level table
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -19,7 +20,7 @@ type JobLevelRow struct {
 
 // getAllContactsLevels queries db to retrieve a distinct list of all job levels
 // in job_level table
-func getAllContactsLevels(w http.ResponseWriter) ([]JobLevelRow, error) {
+func getAllContactsLevels(ctx context.Context, w http.ResponseWriter) ([]JobLevelRow, error) {
 
 	var jobLevelRows []JobLevelRow
 	var err error
@@ -37,7 +38,7 @@ func getAllContactsLevels(w http.ResponseWriter) ([]JobLevelRow, error) {
 
 	sqlStmt := "SELECT name FROM job_level"
 
-	rows, err := db.Query(sqlStmt)
+	rows, err := db.QueryContext(ctx, sqlStmt)
 	if err != nil {
 		err = CustErr(err, "SQL query failed.\nStopping here.")
 		log.Println(err)
@@ -63,7 +64,7 @@ func getAllContactsLevels(w http.ResponseWriter) ([]JobLevelRow, error) {
 // ReturnContactsLevelsList loads all contacts job levels from db and send it in JSON to frontend
 func ReturnContactsLevelsList(w http.ResponseWriter, r *http.Request) {
 
-	jobLevelRows, err := getAllContactsLevels(w)
+	jobLevelRows, err := getAllContactsLevels(r.Context(), w)
 	if err != nil {
 		return
 	}
@@ -6,6 +6,7 @@ This is not all countries but only countries used in Local.
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -20,7 +21,7 @@ type CountryRow struct {
 
 // getAllCountries queries db to retrieve a distinct list of all countries
 // in postal_address table
-func getAllCountries(w http.ResponseWriter) ([]CountryRow, error) {
+func getAllCountries(ctx context.Context, w http.ResponseWriter) ([]CountryRow, error) {
 
 	var countriesRows []CountryRow
 	var err error
@@ -38,7 +39,7 @@ func getAllCountries(w http.ResponseWriter) ([]CountryRow, error) {
 
 	sqlStmt := "SELECT DISTINCT(country) FROM postal_address WHERE country <> ''"
 
-	rows, err := db.Query(sqlStmt)
+	rows, err := db.QueryContext(ctx, sqlStmt)
 	if err != nil {
 		err = CustErr(err, "SQL query failed.\nStopping here.")
 		log.Println(err)
@@ -64,7 +65,7 @@ func getAllCountries(w http.ResponseWriter) ([]CountryRow, error) {
 // ReturnCountryList loads all countries from db and send it in JSON to frontend
 func ReturnCountriesList(w http.ResponseWriter, r *http.Request) {
 
-	countriesRows, err := getAllCountries(w)
+	countriesRows, err := getAllCountries(r.Context(), w)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,575 @@
+/*
+auth.go authenticates every call to the API. Until now the API trusted anyone
+whose origin passed CORS, only the static frontend was protected by nginx.
+Users are stored in the local db with a bcrypt password hash. They can be
+imported at startup from the .htpasswd file used by nginx (bcrypt entries only,
+created with htpasswd -B), which stays the place where passwords are managed.
+Users can also log in with the company identity provider (see oidc.go).
+Browsers log in once and get a session cookie. Scripts use personal API tokens
+sent in the Authorization header: "Authorization: Bearer <token>".
+Only a sha256 hash of session ids and API tokens is stored, so a leak of the
+local db does not give access to the API.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the session cookie
+const sessionCookieName = "session"
+
+// Routes which can be called without being logged in
+var publicRoutes = map[string]bool{
+	"/login":         true,
+	"/oidc/login":    true,
+	"/oidc/callback": true,
+}
+
+// authContextKey is the key of the logged in user in the request context
+type authContextKey struct{}
+
+// Used to spend as much time when a user does not exist as when the password is wrong,
+// so response times do not tell which user names exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Credentials stores what users send to log in
+type Credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// CurrentUser stores the logged in user sent back to frontend, with what the user
+// is allowed to do so frontend can hide what is not allowed
+type CurrentUser struct {
+	Name        string          `json:"name"`
+	Role        string          `json:"role"`
+	Permissions RolePermissions `json:"permissions"`
+}
+
+// APIToken stores a personal API token. Token is only returned once, when created.
+type APIToken struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	CreatedOn  time.Time  `json:"createdOn"`
+	LastUsedOn *time.Time `json:"lastUsedOn"`
+}
+
+// getHtpasswdFilePath gets the path of the .htpasswd file to import users from
+// from env var set by Docker run.
+// If no env var set, no user is imported.
+func getHtpasswdFilePath() string {
+	return os.Getenv("HTPASSWD_FILE_PATH")
+}
+
+// getSessionTTL gets how long a session lasts from env var set by Docker run, in hours.
+// If no env var set, set it to 12 hours, a working day.
+func getSessionTTL() time.Duration {
+	ttl, err := strconv.Atoi(os.Getenv("SESSION_TTL"))
+	if err != nil || ttl < 1 {
+		ttl = 12
+	}
+	return time.Duration(ttl) * time.Hour
+}
+
+// getCookieSecure tells if the session cookie is only sent over https, from env var
+// set by Docker run. Set COOKIE_SECURE=false only for local development over http.
+func getCookieSecure() bool {
+	return os.Getenv("COOKIE_SECURE") != "false"
+}
+
+// newSecret generates a random secret (session id or API token) and its hash to store
+func newSecret() (string, string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(randomBytes)
+	return secret, hashSecret(secret), nil
+}
+
+// hashSecret hashes a session id or an API token before looking for it in db
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// importHtpasswd creates or updates users from a .htpasswd file.
+// Only bcrypt entries are supported ($2y$ prefix), other ones are skipped.
+func importHtpasswd(filePath string) error {
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return CustErr(err, "Cannot open .htpasswd file.\nStopping here.")
+	}
+	defer f.Close()
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO app_user (name, password_hash) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET password_hash = EXCLUDED.password_hash`
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			log.Println("Entry of .htpasswd is not bcrypt so it is skipped (use htpasswd -B): " + parts[0])
+			continue
+		}
+		_, err = db.Exec(sqlStatement, parts[0], parts[1])
+		if err != nil {
+			return CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		}
+	}
+
+	return scanner.Err()
+
+}
+
+// userFromSession returns the user of a valid session id, "" if none
+func userFromSession(ctx context.Context, db *sql.DB, sessionId string) (string, error) {
+	var user string
+	sqlStatement := `SELECT sess.user_name FROM user_session AS sess
+		INNER JOIN app_user ON app_user.name = sess.user_name
+		WHERE sess.id_hash = $1 AND sess.expires_on > now() AND app_user.active`
+	err := db.QueryRowContext(ctx, sqlStatement, hashSecret(sessionId)).Scan(&user)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return user, err
+}
+
+// userFromAPIToken returns the user of a valid API token, "" if none
+func userFromAPIToken(ctx context.Context, db *sql.DB, token string) (string, error) {
+	var user string
+	sqlStatement := `UPDATE api_token SET last_used_on = now()
+		FROM app_user
+		WHERE api_token.token_hash = $1 AND app_user.name = api_token.user_name AND app_user.active
+		RETURNING api_token.user_name`
+	err := db.QueryRowContext(ctx, sqlStatement, hashSecret(token)).Scan(&user)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return user, err
+}
+
+// authenticate returns the user who sent a request thanks to its API token or
+// its session cookie, "" if not authenticated
+func authenticate(r *http.Request) (string, error) {
+
+	authorization := r.Header.Get("Authorization")
+	cookie, cookieErr := r.Cookie(sessionCookieName)
+	if !strings.HasPrefix(authorization, "Bearer ") && cookieErr != nil {
+		return "", nil
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return "", CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return userFromAPIToken(r.Context(), db, strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return userFromSession(r.Context(), db, cookie.Value)
+
+}
+
+// requireAuth is the middleware checking that every call to the API is authenticated,
+// except public routes. The user is stored in the request context.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if publicRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := authenticate(r)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if user == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, user)))
+
+	})
+}
+
+// getRequestUser returns the logged in user who sent a request.
+// It is set by the requireAuth middleware so it is never empty in handlers.
+func getRequestUser(r *http.Request) string {
+	user, _ := r.Context().Value(authContextKey{}).(string)
+	return user
+}
+
+// checkPassword tells if a password is the one of an active user
+func checkPassword(ctx context.Context, db *sql.DB, credentials Credentials) (bool, error) {
+
+	passwordHash := string(dummyPasswordHash)
+	sqlStatement := `SELECT password_hash FROM app_user WHERE name = $1 AND active`
+	err := db.QueryRowContext(ctx, sqlStatement, credentials.Name).Scan(&passwordHash)
+	userExists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return false, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	// Always compare, even if the user does not exist
+	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(credentials.Password))
+
+	return userExists && err == nil, nil
+
+}
+
+// openSession opens a session for a user and sets the session cookie
+func openSession(ctx context.Context, db *sql.DB, user string, w http.ResponseWriter) error {
+
+	sessionId, sessionIdHash, err := newSecret()
+	if err != nil {
+		return CustErr(err, "Could not generate session id.\nStopping here.")
+	}
+	expiresOn := time.Now().Add(getSessionTTL())
+
+	// Expired sessions are cleaned at each login, there are not many of them
+	sqlStatement := `DELETE FROM user_session WHERE expires_on < now()`
+	_, err = db.ExecContext(ctx, sqlStatement)
+	if err != nil {
+		log.Println(CustErr(err, "Following query failed: "+sqlStatement+"\nNOT stopping here."))
+	}
+
+	sqlStatement = `INSERT INTO user_session (id_hash, user_name, expires_on) VALUES ($1, $2, $3)`
+	_, err = db.ExecContext(ctx, sqlStatement, sessionIdHash, user, expiresOn)
+	if err != nil {
+		return CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionId,
+		Path:     "/",
+		Expires:  expiresOn,
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+
+}
+
+// Login checks the user name and password and opens a session in a cookie
+func Login(w http.ResponseWriter, r *http.Request) {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = CustErr(err, "Cannot read request body.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var credentials Credentials
+	err = json.Unmarshal(body, &credentials)
+	if err != nil {
+		err = CustErr(err, "Cannot unmarshall json.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	isValid, err := checkPassword(r.Context(), db, credentials)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !isValid {
+		log.Println("Failed login for user: " + credentials.Name)
+		http.Error(w, "Wrong user name or password.", http.StatusUnauthorized)
+		return
+	}
+
+	err = openSession(r.Context(), db, credentials.Name, w)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeCurrentUser(credentials.Name, w)
+
+}
+
+// Logout closes the session of the user
+func Logout(w http.ResponseWriter, r *http.Request) {
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil {
+		db, err := sql.Open("postgres", getLocalDBInfo())
+		if err != nil {
+			err = CustErr(err, "DB connection failed\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+
+		sqlStatement := `DELETE FROM user_session WHERE id_hash = $1`
+		_, err = db.ExecContext(r.Context(), sqlStatement, hashSecret(cookie.Value))
+		if err != nil {
+			err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// writeCurrentUser sends the logged in user as JSON
+func writeCurrentUser(user string, w http.ResponseWriter) {
+
+	returnedJson, err := json.Marshal(CurrentUser{
+		Name:        user,
+		Role:        getUserRole(user),
+		Permissions: getUserPermissions(user),
+	})
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// ReturnCurrentUser tells frontend who is logged in
+func ReturnCurrentUser(w http.ResponseWriter, r *http.Request) {
+	writeCurrentUser(getRequestUser(r), w)
+}
+
+// CreateAPIToken creates a personal API token for scripts. The token is only
+// returned now, it cannot be retrieved later.
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = CustErr(err, "Cannot read request body.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var apiToken APIToken
+	err = json.Unmarshal(body, &apiToken)
+	if err != nil {
+		err = CustErr(err, "Cannot unmarshall json.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	apiToken.Name = strings.TrimSpace(apiToken.Name)
+	if apiToken.Name == "" || len(apiToken.Name) > 200 {
+		err = errors.New("Name of the API token should not be empty (200 max).")
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, tokenHash, err := newSecret()
+	if err != nil {
+		err = CustErr(err, "Could not generate API token.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO api_token (user_name, name, token_hash) VALUES ($1, $2, $3)
+		RETURNING id, created_on`
+	err = db.QueryRowContext(r.Context(), sqlStatement, getRequestUser(r), apiToken.Name, tokenHash).Scan(
+		&apiToken.Id,
+		&apiToken.CreatedOn,
+	)
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	apiToken.Token = token
+
+	returnedJson, err := json.Marshal(apiToken)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// ReturnAPITokensList returns the API tokens of the user, without the tokens themselves
+func ReturnAPITokensList(w http.ResponseWriter, r *http.Request) {
+
+	apiTokens := []APIToken{}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT id, name, created_on, last_used_on
+		FROM api_token WHERE user_name = $1 ORDER BY created_on DESC`
+	rows, err := db.QueryContext(r.Context(), sqlStatement, getRequestUser(r))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var apiToken APIToken
+		err = rows.Scan(
+			&apiToken.Id,
+			&apiToken.Name,
+			&apiToken.CreatedOn,
+			&apiToken.LastUsedOn,
+		)
+		if err != nil {
+			err = CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		apiTokens = append(apiTokens, apiToken)
+	}
+
+	returnedJson, err := json.Marshal(apiTokens)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// DeleteAPIToken revokes an API token of the user
+func DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+
+	apiTokenId, err := strconv.Atoi(mux.Vars(r)["apitokenid"])
+	if err != nil {
+		err = CustErr(err, "API token id is not an integer.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "API token id should be an integer.", http.StatusBadRequest)
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `DELETE FROM api_token WHERE id = $1 AND user_name = $2`
+	res, err := db.ExecContext(r.Context(), sqlStatement, apiTokenId, getRequestUser(r))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if rowsNb, err := res.RowsAffected(); err == nil && rowsNb == 0 {
+		log.Println("No API token owned by user found for this id: " + strconv.Itoa(apiTokenId) + "\nStopping here.")
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
@@ -10,32 +10,70 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	_ "github.com/lib/pq"
+	"go_project/querybuilder"
 	"gopkg.in/gomail.v2"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 const (
-	returnedArchiveName = "results.zip"
-	returnedCSVName     = "companies_and_contacts_extracted.csv"
+	returnedArchiveName      = "results.zip"
+	returnedCSVName          = "companies_and_contacts_extracted.csv"
+	returnedCompaniesCSVName = "companies_extracted.csv"
+	returnedContactsCSVName  = "contacts_extracted.csv"
+)
+
+// Possible values of UserInput.Shape.
+// shapeRows is the historical one: one row per company and contact.
+// shapeCompanies returns one object per company with its contacts nested.
+const (
+	shapeRows      = "rows"
+	shapeCompanies = "companies"
+)
+
+// Possible values of UserInput.Mode.
+// modeAll is the historical one: companies and their contacts.
+// modeCompanies only returns the distinct list of matching companies and
+// modeContacts only returns the distinct list of matching contacts.
+const (
+	modeAll       = "all"
+	modeCompanies = "companies"
+	modeContacts  = "contacts"
 )
 
 // UserInput stores user input sent through JSON.
 // CompanyHasPhone, CompanyHasEmail, and ContactHasEmail are fake
 // booleans: 0: not set, 1: false, 2: true
+// Shape is optional and defaults to shapeRows.
+// Mode is optional and defaults to modeAll.
+// ContactUpdatedWithinDays keeps contacts updated in the last days, 0 means not set.
+// Handy for recurring exports (e.g. new contacts of the past week).
+// ExcludeExportedWithinDays and ExcludedExportIds exclude contacts already exported
+// within the last days or in specific past exports (see export_history.go).
+// excludedContactIds is not sent by frontend, it is filled from the export history
+// before building the query. Same thing for the suppressed fields, filled from the
+// suppression list (see suppressions.go).
+// Pseudonymize replaces personal data of the results with hashes (see pseudonymization.go).
+// QueryId is optional, it is generated by frontend so the search can be canceled
+// through the cancel endpoint while running.
 type UserInput struct {
 	Step                          string   `json:"step"`
+	QueryId                       string   `json:"queryId"`
+	Shape                         string   `json:"shape"`
+	Mode                          string   `json:"mode"`
 	CompanyCity                   string   `json:"companyCity"`
 	CompanyPostCode               string   `json:"companyPostCode"`
 	CompanyCountries              []string `json:"companyCountries"`
@@ -54,8 +92,16 @@ type UserInput struct {
 	ContactFunctions              []string `json:"contactFunctions"`
 	ContactJobLevels              []string `json:"contactJobLevels"`
 	ContactHasEmail               int      `json:"contactHasEmail"`
+	ContactUpdatedWithinDays      int      `json:"contactUpdatedWithinDays"`
 	ContactRemoteAccounts         []string `json:"contactRemoteAccounts"`
 	ExcludedContactRemoteAccounts []string `json:"excludedContactRemoteAccounts"`
+	ExcludeExportedWithinDays     int      `json:"excludeExportedWithinDays"`
+	ExcludedExportIds             []int    `json:"excludedExportIds"`
+	Pseudonymize                  bool     `json:"pseudonymize"`
+	excludedContactIds            []int64
+	suppressedEmails              []string
+	suppressedDomains             []string
+	suppressedContactIds          []int64
 }
 
 // Created a custom type + method that implements the json.Marshaler
@@ -80,9 +126,9 @@ func (v JsonNullString) MarshalJSON() ([]byte, error) {
 	}
 }
 
-// CompAndContRow stores results sent back to frontend in JSON.
+// CompRow stores the company part of a result row.
 // Empty values are present in JSON with a "null" value.
-type CompAndContRow struct {
+type CompRow struct {
 	CompId                       string         `json:"compId"`
 	CompName                     JsonNullString `json:"compName"`
 	CompDomain                   JsonNullString `json:"compDomain"`
@@ -104,6 +150,11 @@ type CompAndContRow struct {
 	CompSocProfURL               JsonNullString `json:"compSocProfURL"`
 	CompType                     JsonNullString `json:"compType"`
 	CompIndustry                 JsonNullString `json:"compIndustry"`
+}
+
+// ContRow stores the contact part of a result row.
+// Empty values are present in JSON with a "null" value.
+type ContRow struct {
 	ContId                       JsonNullString `json:"contId"`
 	ContGender                   JsonNullString `json:"contGender"`
 	ContFirstName                JsonNullString `json:"contFirstName"`
@@ -128,94 +179,29 @@ type CompAndContRow struct {
 	ContIndustry                 JsonNullString `json:"contIndustry"`
 }
 
-// CountRes stores only a number of rows return from SQL count
-type CountRes struct {
-	rowsNb int `json:"rowsNb"`
-}
-
-// convStringToWhereClause takes a user input and builds a piece of WHERE SQL query
-// based on it. It consists of concatenating smartly one or several arguments in
-// a WHERE clause with AND keywords (always using AND, not OR as asked by John for the
-// moment but we can still change it later). We're using PostgreSQL prepared queries so
-// positional arguments are necessary: "WHERE city = $1 AND post_code = $2 ...". It
-// means me need to increment an index for every argument, and put the real argument
-// value in a separate array that will be used later in db.Query(...).
-// Arguments should not be case sensitive so we convert everything to UPPERCASE thanks
-// to the UPPER() SQL function.
-func convStringToWhereClause(
-	userInputString string,
-	attribute string,
-	posIndex int,
-	sqlArgs []interface{},
-	sqlStmtPtr *strings.Builder,
-) ([]interface{}, int) {
-
-	// If user input was empty, do nothing
-	if userInputString == "" {
-		return sqlArgs, posIndex
-	}
-
-	// If posIndex = 1 it means it is the first argument of the big WHERE clause
-	// so no need to add a "AND". Otherwise need to add a "AND" between arguments.
-	// The piece of SQL created here could be something like:
-	// AND UPPER(comp_ad.locality) = UPPER($5)
-	posIndex += 1
-	if posIndex > 1 {
-		sqlStmtPtr.WriteString("AND ")
-	}
-	sqlStmtPtr.WriteString("UPPER(")
-	sqlStmtPtr.WriteString(attribute)
-	sqlStmtPtr.WriteString(") = UPPER($")
-	sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-	sqlStmtPtr.WriteString(") ")
-
-	sqlArgs = append(sqlArgs, userInputString)
-
-	return sqlArgs, posIndex
-
+// CompAndContRow stores results sent back to frontend in JSON.
+// Both structs are embedded so the JSON is still a flat object
+// with one company and one contact per row.
+type CompAndContRow struct {
+	CompRow
+	ContRow
 }
 
-// convStringToWhereLikeClause does basically the same as convStringToWhereClause plus
-// adds % before and after the user input because we want it to be an approximate search
-func convStringToWhereLikeClause(
-	userInputString string,
-	attribute string,
-	posIndex int,
-	sqlArgs []interface{},
-	sqlStmtPtr *strings.Builder,
-) ([]interface{}, int) {
-
-	if userInputString == "" {
-		return sqlArgs, posIndex
-	}
-
-	var newUserInput strings.Builder
-	newUserInput.WriteString("%")
-	newUserInput.WriteString(userInputString)
-	newUserInput.WriteString("%")
-	newUserInputString := newUserInput.String()
-
-	// The piece of SQL created here could be something like:
-	// AND UPPER(cont.job_title) = LIKE UPPER($5)
-	posIndex += 1
-	if posIndex > 1 {
-		sqlStmtPtr.WriteString("AND ")
-	}
-	sqlStmtPtr.WriteString("UPPER(")
-	sqlStmtPtr.WriteString(attribute)
-	sqlStmtPtr.WriteString(") LIKE UPPER($")
-	sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-	sqlStmtPtr.WriteString(") ")
-
-	sqlArgs = append(sqlArgs, newUserInputString)
-
-	return sqlArgs, posIndex
-
+// CountRes stores the numbers returned by the count step so users can
+// judge a segment before getting the full results.
+// RowsNb is the number of rows the full step would return.
+type CountRes struct {
+	RowsNb               int `json:"rowsNb"`
+	CompaniesNb          int `json:"companiesNb"`
+	ContactsNb           int `json:"contactsNb"`
+	ContactsWithEmailNb  int `json:"contactsWithEmailNb"`
+	ContactsWithPhoneNb  int `json:"contactsWithPhoneNb"`
+	CompaniesWithEmailNb int `json:"companiesWithEmailNb"`
 }
 
-// convBoolToWhereClause does basically the same as convStringToWhereClause
-// but converts a fake boolean (integer) to a corresponding SQL where clause.
-// userInputInt = 0 --> not set so quit
+// convFakeBoolToPredicate converts a fake boolean (integer) to a corresponding
+// WHERE clause predicate.
+// userInputInt = 0 --> not set so no predicate
 // userInputInt = 1 --> false
 // userInputInt = 2 --> true
 // Also work for contHasEmail because prospect and prospectemail
@@ -224,364 +210,268 @@ func convStringToWhereLikeClause(
 // one-to-many relationship but in DB we never have cases where a same company id has
 // rows with an email and rows without an email. We either have one row only for a company
 // id with a null email, or 1 or multiple rows for a company id with 1 or multiple emails.
-func convBoolToWhereClause(
-	userInputInt int,
-	attribute string,
-	posIndex int,
-	sqlArgs []interface{},
-	sqlStmtPtr *strings.Builder,
-) ([]interface{}, int) {
-
-	if userInputInt == 0 {
-		return sqlArgs, posIndex
-	}
-
-	// The piece of SQL created here could be something like:
-	// AND (comp.telephone IS NOT NULL AND comp.telephone <> '')
-	// or:
-	// AND (comp.telephone IS NULL OR comp.telephone = '')
-	if posIndex > 0 {
-		sqlStmtPtr.WriteString("AND ")
-	}
-	sqlStmtPtr.WriteString("(")
-	sqlStmtPtr.WriteString(attribute)
-	if userInputInt == 2 {
-		sqlStmtPtr.WriteString(" IS NOT NULL AND ")
-		sqlStmtPtr.WriteString(attribute)
-		sqlStmtPtr.WriteString(" <> '') ")
-	} else {
-		sqlStmtPtr.WriteString(" IS NULL OR ")
-		sqlStmtPtr.WriteString(attribute)
-		sqlStmtPtr.WriteString(" = '') ")
-	}
-
-	return sqlArgs, posIndex
-
-}
-
-// convStringArrayToWhereClause does basically the same as convStringToWhereClause
-// but creates several WHERE clauses if user input contains several strings (in an array)
-func convStringArrayToWhereClause(
-	userInputStringArray []string,
-	attribute string,
-	posIndex int,
-	sqlArgs []interface{},
-	sqlStmtPtr *strings.Builder,
-) ([]interface{}, int) {
-
-	if len(userInputStringArray) == 0 {
-		return sqlArgs, posIndex
-	}
-
-	// The piece of SQL created here could be something like:
-	// AND (UPPER(comp.domain) = UPPER($8) OR UPPER(comp.domain) = UPPER($9))
-	posIndex += 1
-	if posIndex > 1 {
-		sqlStmtPtr.WriteString("AND ")
-	}
-	if len(userInputStringArray) == 1 {
-		sqlStmtPtr.WriteString("UPPER(")
-		sqlStmtPtr.WriteString(attribute)
-		sqlStmtPtr.WriteString(") = UPPER($")
-		sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-		sqlStmtPtr.WriteString(") ")
-		sqlArgs = append(sqlArgs, userInputStringArray[0])
-	} else {
-		sqlStmtPtr.WriteString("(")
-		for i, element := range userInputStringArray {
-			if i > 0 {
-				posIndex += 1
-			}
-			sqlStmtPtr.WriteString("UPPER(")
-			sqlStmtPtr.WriteString(attribute)
-			sqlStmtPtr.WriteString(") = UPPER($")
-			sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-			sqlStmtPtr.WriteString(") ")
-			if i == len(userInputStringArray)-1 {
-				sqlStmtPtr.WriteString(") ")
-			} else {
-				sqlStmtPtr.WriteString("OR ")
-			}
-			sqlArgs = append(sqlArgs, element)
-		}
-	}
-
-	return sqlArgs, posIndex
-}
-
-// convStringArrayToWhereNotClause does basically the same as convArrayToWhereClause
-// but the WHERE clauses should exclude user inputs
-func convStringArrayToWhereNotClause(
-	userInputStringArray []string,
-	attribute string,
-	posIndex int,
-	sqlArgs []interface{},
-	sqlStmtPtr *strings.Builder,
-) ([]interface{}, int) {
-
-	if len(userInputStringArray) == 0 {
-		return sqlArgs, posIndex
-	}
-
-	// The piece of SQL created here could be something like:
-	// AND (UPPER(comp.domain) <> UPPER($8) OR UPPER(comp.domain) <> UPPER($9))
-	posIndex += 1
-	if posIndex > 1 {
-		sqlStmtPtr.WriteString("AND ")
-	}
-	if len(userInputStringArray) == 1 {
-		sqlStmtPtr.WriteString("UPPER(")
-		sqlStmtPtr.WriteString(attribute)
-		sqlStmtPtr.WriteString(") <> UPPER($")
-		sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-		sqlStmtPtr.WriteString(") ")
-		sqlArgs = append(sqlArgs, userInputStringArray[0])
-	} else {
-		sqlStmtPtr.WriteString("(")
-		for i, element := range userInputStringArray {
-			if i > 0 {
-				posIndex += 1
-			}
-			sqlStmtPtr.WriteString("UPPER(")
-			sqlStmtPtr.WriteString(attribute)
-			sqlStmtPtr.WriteString(") <> UPPER($")
-			sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-			sqlStmtPtr.WriteString(") ")
-			if i == len(userInputStringArray)-1 {
-				sqlStmtPtr.WriteString(") ")
-			} else {
-				sqlStmtPtr.WriteString("AND ")
-			}
-			sqlArgs = append(sqlArgs, element)
-		}
-	}
-
-	return sqlArgs, posIndex
-}
-
-// convIntArrayToWhereClause does basically the same as convStringArrayToWhereClause
-// but does not apply UPPER because we have integers here
-func convIntArrayToWhereClause(
-	userInputIntArray []string,
-	attribute string,
-	posIndex int,
-	sqlArgs []interface{},
-	sqlStmtPtr *strings.Builder,
-) ([]interface{}, int) {
-
-	if len(userInputIntArray) == 0 {
-		return sqlArgs, posIndex
-	}
-
-	// The piece of SQL created here could be something like:
-	// AND (cont_group.group_id = $8 OR cont_group.group_id = $9)
-	posIndex += 1
-	if posIndex > 1 {
-		sqlStmtPtr.WriteString("AND ")
-	}
-	if len(userInputIntArray) == 1 {
-		sqlStmtPtr.WriteString(attribute)
-		sqlStmtPtr.WriteString(" = $")
-		sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-		sqlStmtPtr.WriteString(" ")
-		sqlArgs = append(sqlArgs, userInputIntArray[0])
-	} else {
-		sqlStmtPtr.WriteString("(")
-		for i, element := range userInputIntArray {
-			if i > 0 {
-				posIndex += 1
-			}
-			sqlStmtPtr.WriteString(attribute)
-			sqlStmtPtr.WriteString(" = $")
-			sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-			sqlStmtPtr.WriteString(" ")
-			if i == len(userInputIntArray)-1 {
-				sqlStmtPtr.WriteString(") ")
-			} else {
-				sqlStmtPtr.WriteString("OR ")
-			}
-			sqlArgs = append(sqlArgs, element)
-		}
-	}
-
-	return sqlArgs, posIndex
+func convFakeBoolToPredicate(userInputInt int, attribute string) querybuilder.Predicate {
+	switch userInputInt {
+	case 1:
+		return querybuilder.Empty(attribute)
+	case 2:
+		return querybuilder.NotEmpty(attribute)
+	}
+	return nil
 }
 
-// convIntArrayToWhereNotClause does basically the same as convIntArrayToWhereNotClause
-// but does not apply UPPER because we have integers here
-func convIntArrayToWhereNotClause(
-	userInputIntArray []string,
-	attribute string,
-	posIndex int,
-	sqlArgs []interface{},
-	sqlStmtPtr *strings.Builder,
-) ([]interface{}, int) {
-
-	if len(userInputIntArray) == 0 {
-		return sqlArgs, posIndex
-	}
-
-	// The piece of SQL created here could be something like:
-	// AND (cont_group.group_id <> $8 OR comp.domain <> $9)
-	posIndex += 1
-	if posIndex > 1 {
-		sqlStmtPtr.WriteString("AND ")
-	}
-	if len(userInputIntArray) == 1 {
-		sqlStmtPtr.WriteString(attribute)
-		sqlStmtPtr.WriteString(" <> $")
-		sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-		sqlStmtPtr.WriteString(" ")
-		sqlArgs = append(sqlArgs, userInputIntArray[0])
-	} else {
-		sqlStmtPtr.WriteString("(")
-		for i, element := range userInputIntArray {
-			if i > 0 {
-				posIndex += 1
-			}
-			sqlStmtPtr.WriteString(attribute)
-			sqlStmtPtr.WriteString(" <> $")
-			sqlStmtPtr.WriteString(strconv.Itoa(posIndex))
-			sqlStmtPtr.WriteString(" ")
-			if i == len(userInputIntArray)-1 {
-				sqlStmtPtr.WriteString(") ")
-			} else {
-				sqlStmtPtr.WriteString("AND ")
-			}
-			sqlArgs = append(sqlArgs, element)
-		}
+// scanDests returns the struct fields the columns of one row should be scanned into.
+// Order must match the SELECT clause built by buildSQLReq for this mode.
+func scanDests(row *CompAndContRow, mode string) []interface{} {
+
+	compDests := []interface{}{
+		&row.CompId,
+		&row.CompName,
+		&row.CompDomain,
+		&row.CompWebsite,
+		&row.CompTelephone,
+		&row.CompFaxNumber,
+		&row.CompSize,
+		&row.CompFounded,
+		&row.CompCreatedOn,
+		&row.CompUpdatedOn,
+		&row.CompStreetNumber,
+		&row.CompRoute,
+		&row.CompPostalCode,
+		&row.CompLocality,
+		&row.CompAdministrativeAreaLevel2,
+		&row.CompAdministrativeAreaLevel1,
+		&row.CompCountry,
+		&row.CompEmail,
+		&row.CompSocProfURL,
+		&row.CompType,
+		&row.CompIndustry,
+	}
+	contDests := []interface{}{
+		&row.ContId,
+		&row.ContGender,
+		&row.ContFirstName,
+		&row.ContLastName,
+		&row.ContJobTitle,
+		&row.ContTelephone,
+		&row.ContCreatedOn,
+		&row.ContUpdatedOn,
+		&row.ContStreetNumber,
+		&row.ContRoute,
+		&row.ContPostalCode,
+		&row.ContLocality,
+		&row.ContAdministrativeAreaLevel2,
+		&row.ContAdministrativeAreaLevel1,
+		&row.ContCountry,
+		&row.ContJobFunction,
+		&row.ContJobLevel,
+		&row.ContEmail,
+		&row.ContEmailStatus,
+		&row.ContEmailCreatedOn,
+		&row.ContSocProfURL,
+		&row.ContIndustry,
+	}
+
+	switch mode {
+	case modeCompanies:
+		return compDests
+	case modeContacts:
+		return append([]interface{}{&row.CompId, &row.CompName, &row.CompDomain}, contDests...)
+	default:
+		return append(compDests, contDests...)
 	}
 
-	return sqlArgs, posIndex
 }
 
-// runFullSQLReq executes an SQL query with an variable number of arguments and returns
+// queryFullSQLReq executes an SQL query with an variable number of arguments and returns
 // results in an array.
 // Arguments are contained in the sqlArgs array. sqlArgs must be of type []interface{} because
 // this is what db.Query() is expecting.
-func runFullSQLReq(sqlStmtStr string, sqlArgs []interface{}, w http.ResponseWriter) ([]CompAndContRow, error) {
+// It does not write anything to the http response so it can also be used by background jobs.
+func queryFullSQLReq(ctx context.Context, sqlStmtStr string, sqlArgs []interface{}, mode string, statementTimeout int) ([]CompAndContRow, error) {
 
 	var compAndContRows []CompAndContRow
 	var err error
 
 	// Connect to db:
-	dbinfo := fmt.Sprintf(`host=%s port=%d user=%s password=%s dbname=%s
-        sslmode=disable`, remoteHost, remotePort, remoteUser, remotePassword, remoteDbname)
-	db, err := sql.Open("postgres", dbinfo)
+	db, err := sql.Open("postgres", getRemoteDBInfo(statementTimeout))
 	if err != nil {
-		err = CustErr(err, "DB connection failed\nStopping here.")
-		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return compAndContRows, err
+		return compAndContRows, CustErr(err, "DB connection failed\nStopping here.")
 	}
 	defer db.Close()
 
 	// Executes SQL query using a variable number of arguments contained in the sqlArgs array
-	// thanks to the fact that db.Query is a variadic function
-	rows, err := db.Query(sqlStmtStr, sqlArgs...)
+	// thanks to the fact that db.QueryContext is a variadic function.
+	// If ctx is canceled (client gone or query canceled by user), PostgreSQL stops the query.
+	rows, err := db.QueryContext(ctx, sqlStmtStr, sqlArgs...)
 	if err != nil {
-		err = CustErr(err, "SQL query failed.\nStopping here.")
-		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return compAndContRows, err
+		return compAndContRows, CustErr(err, "SQL query failed.\nStopping here.")
 	}
 	defer rows.Close()
 
 	// For each row, put the results into the compAndContRows array
 	for rows.Next() {
 		var compAndContRow CompAndContRow
-		if err := rows.Scan(
-			&compAndContRow.CompId,
-			&compAndContRow.CompName,
-			&compAndContRow.CompDomain,
-			&compAndContRow.CompWebsite,
-			&compAndContRow.CompTelephone,
-			&compAndContRow.CompFaxNumber,
-			&compAndContRow.CompSize,
-			&compAndContRow.CompFounded,
-			&compAndContRow.CompCreatedOn,
-			&compAndContRow.CompUpdatedOn,
-			&compAndContRow.CompStreetNumber,
-			&compAndContRow.CompRoute,
-			&compAndContRow.CompPostalCode,
-			&compAndContRow.CompLocality,
-			&compAndContRow.CompAdministrativeAreaLevel2,
-			&compAndContRow.CompAdministrativeAreaLevel1,
-			&compAndContRow.CompCountry,
-			&compAndContRow.CompEmail,
-			&compAndContRow.CompSocProfURL,
-			&compAndContRow.CompType,
-			&compAndContRow.CompIndustry,
-			&compAndContRow.ContId,
-			&compAndContRow.ContGender,
-			&compAndContRow.ContFirstName,
-			&compAndContRow.ContLastName,
-			&compAndContRow.ContJobTitle,
-			&compAndContRow.ContTelephone,
-			&compAndContRow.ContCreatedOn,
-			&compAndContRow.ContUpdatedOn,
-			&compAndContRow.ContStreetNumber,
-			&compAndContRow.ContRoute,
-			&compAndContRow.ContPostalCode,
-			&compAndContRow.ContLocality,
-			&compAndContRow.ContAdministrativeAreaLevel2,
-			&compAndContRow.ContAdministrativeAreaLevel1,
-			&compAndContRow.ContCountry,
-			&compAndContRow.ContJobFunction,
-			&compAndContRow.ContJobLevel,
-			&compAndContRow.ContEmail,
-			&compAndContRow.ContEmailStatus,
-			&compAndContRow.ContEmailCreatedOn,
-			&compAndContRow.ContSocProfURL,
-			&compAndContRow.ContIndustry,
-		); err != nil {
-			err = CustErr(err, "A row could not be read from SQL query results.\nNOT stopping here.")
-			log.Println(err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return compAndContRows, err
+		if err := rows.Scan(scanDests(&compAndContRow, mode)...); err != nil {
+			return compAndContRows, CustErr(err, "A row could not be read from SQL query results.\nNOT stopping here.")
 		}
 		compAndContRows = append(compAndContRows, compAndContRow)
 	}
 
+	// An error during iteration (e.g. statement timeout) only shows up here
+	if err = rows.Err(); err != nil {
+		return compAndContRows, CustErr(err, "SQL query failed while reading results.\nStopping here.")
+	}
+
+	return compAndContRows, err
+
+}
+
+// runFullSQLReq executes the full SQL query for a step and answers the http request
+// itself if anything goes wrong
+func runFullSQLReq(ctx context.Context, sqlStmtStr string, sqlArgs []interface{}, mode string, step string, w http.ResponseWriter) ([]CompAndContRow, error) {
+
+	compAndContRows, err := queryFullSQLReq(ctx, sqlStmtStr, sqlArgs, mode, getStatementTimeout(step))
+	if err != nil {
+		log.Println(err)
+		httpErrorFromSQLErr(ctx, err, w)
+		return compAndContRows, err
+	}
+
 	return compAndContRows, err
 
 }
 
-// runCountSQLReq executes the same query as runFullSQLReq but only for Count
-func runCountSQLReq(sqlStmtStr string, sqlArgs []interface{}, w http.ResponseWriter) (int, error) {
+// runCountSQLReq executes the count query built by buildCountSQLReq and
+// returns all the numbers in one go
+func runCountSQLReq(ctx context.Context, sqlStmtStr string, sqlArgs []interface{}, w http.ResponseWriter) (CountRes, error) {
 
-	var rowsNb int
+	var countRes CountRes
 	var err error
 
 	// Connect to db:
-	dbinfo := fmt.Sprintf(`host=%s port=%d user=%s password=%s dbname=%s
-        sslmode=disable`, remoteHost, remotePort, remoteUser, remotePassword, remoteDbname)
-	db, err := sql.Open("postgres", dbinfo)
+	db, err := sql.Open("postgres", getRemoteDBInfo(getStatementTimeout("count")))
 	if err != nil {
 		err = CustErr(err, "DB connection failed\nStopping here.")
 		log.Println(err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return rowsNb, err
+		return countRes, err
 	}
 	defer db.Close()
 
 	// Executes SQL query using a variable number of arguments contained in the sqlArgs array
-	// thanks to the fact that db.QueryRow is a variadic function
-	row := db.QueryRow(sqlStmtStr, sqlArgs...)
-	err = row.Scan(&rowsNb)
+	// thanks to the fact that db.QueryRowContext is a variadic function
+	row := db.QueryRowContext(ctx, sqlStmtStr, sqlArgs...)
+	err = row.Scan(
+		&countRes.RowsNb,
+		&countRes.CompaniesNb,
+		&countRes.ContactsNb,
+		&countRes.ContactsWithEmailNb,
+		&countRes.ContactsWithPhoneNb,
+		&countRes.CompaniesWithEmailNb,
+	)
 	if err != nil {
 		err = CustErr(err, "SQL query failed.\nStopping here.")
 		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return rowsNb, err
+		httpErrorFromSQLErr(ctx, err, w)
+		return countRes, err
 	}
 
-	return rowsNb, err
+	return countRes, err
+
+}
+
+// buildCountSQLReq builds the count query.
+// The query built by buildSQLReq in count mode returns as many rows as the full
+// query (same joins, same WHERE, equivalent GROUP BY) but only with the few
+// columns needed for counting. We count these rows in an outer query so
+// all the numbers are computed by PostgreSQL in a single query.
+// It used to be the full query with a COUNT(comp.id) OVER() read on the first
+// row only, which forced PostgreSQL to compute every group and every string_agg().
+// COUNT(DISTINCT ...) ignores NULL values so the contacts numbers are 0 in
+// modeCompanies (no contact column), same for companies with email in
+// modeContacts when companyemail is not joined.
+func buildCountSQLReq(userInput UserInput) (string, []interface{}) {
+
+	sqlStmtStr, sqlArgs := buildSQLReq(true, userInput)
+
+	var sqlStmt strings.Builder
+	sqlStmt.WriteString("SELECT COUNT(*) AS rows_nb, COUNT(DISTINCT res.comp_id) AS companies_nb, COUNT(DISTINCT res.cont_id) AS contacts_nb, ")
+	sqlStmt.WriteString("COUNT(DISTINCT res.cont_id) FILTER (WHERE res.cont_has_email) AS contacts_with_email_nb, ")
+	sqlStmt.WriteString("COUNT(DISTINCT res.cont_id) FILTER (WHERE res.cont_has_phone) AS contacts_with_phone_nb, ")
+	sqlStmt.WriteString("COUNT(DISTINCT res.comp_id) FILTER (WHERE res.comp_has_email) AS companies_with_email_nb ")
+	sqlStmt.WriteString("FROM (")
+	sqlStmt.WriteString(sqlStmtStr)
+	sqlStmt.WriteString(") AS res")
+
+	return sqlStmt.String(), sqlArgs
+
+}
+
+// Pieces of the SELECT and GROUP BY clauses for the company side and the contact side
+// of the big query. Columns order must match the order of scanDests().
+const (
+	compSelectCols = "comp.id, comp.name, comp.domain, comp.website, comp.telephone, comp.faxnumber, comp.size, comp.founded, comp.created_on, comp.updated_on, " +
+		"comp_ad.street_number, comp_ad.route, comp_ad.postal_code, comp_ad.locality, comp_ad.administrative_area_level_2, comp_ad.administrative_area_level_1, comp_ad.country, " +
+		"string_agg(DISTINCT companyemail.email,'¤'), " +
+		"string_agg(DISTINCT comp_soc_prof.url,'¤'), comp_soc_prof.type, comp_soc_prof.industry"
+	contSelectCols = "cont.id, cont.gender, cont.first_name, cont.last_name, cont.job_title, cont.telephone, cont.created_on, cont.updated_on, " +
+		"cont_ad.street_number, cont_ad.route, cont_ad.postal_code, cont_ad.locality, cont_ad.administrative_area_level_2, cont_ad.administrative_area_level_1, cont_ad.country, " +
+		"string_agg(DISTINCT job_function.name,'¤'), " +
+		"job_level.name, " +
+		"cont_email.email, cont_email.status, cont_email.created_on, " +
+		"string_agg(DISTINCT cont_soc_prof.url,'¤'), cont_soc_prof.industry"
+	compGroupByCols = "comp.id, comp.name, comp.domain, comp.website, comp.telephone, comp.faxnumber, comp.size, comp.founded, comp.created_on, comp.updated_on, " +
+		"comp_ad.street_number, comp_ad.route, comp_ad.postal_code, comp_ad.locality, comp_ad.administrative_area_level_2, comp_ad.administrative_area_level_1, comp_ad.country, " +
+		"comp_soc_prof.type, comp_soc_prof.industry"
+	contGroupByCols = "cont.id, cont.gender, cont.first_name, cont.last_name, cont.job_title, cont.telephone, cont.created_on, cont.updated_on, " +
+		"cont_ad.street_number, cont_ad.route, cont_ad.postal_code, cont_ad.locality, cont_ad.administrative_area_level_2, cont_ad.administrative_area_level_1, cont_ad.country, " +
+		"job_level.name, " +
+		"cont_email.email, cont_email.status, cont_email.created_on, " +
+		"cont_soc_prof.industry"
+)
+
+// Narrow GROUP BY used by the count query. All the columns of compGroupByCols
+// depend on comp.id (company primary key, and comp_ad is joined on its own primary key)
+// except the company social profile ones since a company can have several profiles.
+// Same thing for contGroupByCols which all depend on cont.id. So grouping on these few
+// columns gives exactly the same number of groups as the full GROUP BY, but PostgreSQL
+// only has to sort/hash a few narrow columns instead of forty text columns.
+const (
+	compCountGroupByCols = "comp.id, comp_soc_prof.type, comp_soc_prof.industry"
+	contCountGroupByCols = "cont.id"
+)
 
+// hasCompanyCriteria tells if at least one criterion needs the company side tables
+// (comp_ad, companyemail, comp_soc_prof). Criteria on the company table itself do not count.
+func hasCompanyCriteria(userInput UserInput) bool {
+	return userInput.CompanyCity != "" ||
+		userInput.CompanyPostCode != "" ||
+		len(userInput.CompanyCountries) > 0 ||
+		len(userInput.CompanyIndustries) > 0 ||
+		len(userInput.CompanyTypes) > 0 ||
+		userInput.CompanyHasEmail != 0
 }
 
-// buildSQLReq builds incrementally the big SQL query
-func buildSQLReq(sqlStmtPtr *strings.Builder, isCount bool, userInput UserInput) []interface{} {
+// buildSQLReq builds incrementally the big SQL query and returns it with its
+// positional arguments.
+// Joins are declared once but querybuilder only writes those referenced by a
+// selected column or a criterion, plus the ones they depend on. Depending on
+// userInput.Mode, only the columns needed are selected so in modeCompanies
+// the contact side tables are only joined if a contact criterion is set, and in
+// modeContacts the company side tables are only joined if a company criterion is set.
+func buildSQLReq(isCount bool, userInput UserInput) (string, []interface{}) {
+
+	mode := userInput.Mode
+	if mode == "" {
+		mode = modeAll
+	}
+
+	// In modeContacts companies without contacts are useless
+	contJoin := querybuilder.LeftJoin("prospect", "cont", "cont.company_id = comp.id")
+	if mode == modeContacts {
+		contJoin = querybuilder.InnerJoin("prospect", "cont", "cont.company_id = comp.id")
+	}
 
 	// This is the hardcoded base of the query.
 	// We have lots of rows in the query because of cartesian product:
@@ -593,83 +483,126 @@ func buildSQLReq(sqlStmtPtr *strings.Builder, isCount bool, userInput UserInput)
 	// in the SELECT clause for concatenation.
 	// The string_agg function concatenates results from multiple rows but we can still have duplicates (I'm not sure
 	// why) so we remove them with DISTINCT
-	// A simple COUNT used together with group by would give multiple rows with different counts on every
-	// row, but the number of rows is correct. So we use the OVER() function in order to count the number of
-	// rows returned by the group by. It still give multiple lines with all the same number so we will read
-	// the first one only with queryRow.
-	sqlStmtPtr.WriteString("SELECT ")
-	if isCount {
-		sqlStmtPtr.WriteString("COUNT(comp.id) OVER() ")
-	} else {
-		sqlStmtPtr.WriteString("comp.id, comp.name, comp.domain, comp.website, comp.telephone, comp.faxnumber, comp.size, comp.founded, comp.created_on, comp.updated_on, ")
-		sqlStmtPtr.WriteString("comp_ad.street_number, comp_ad.route, comp_ad.postal_code, comp_ad.locality, comp_ad.administrative_area_level_2, comp_ad.administrative_area_level_1, comp_ad.country, ")
-		sqlStmtPtr.WriteString("string_agg(DISTINCT companyemail.email,'¤'), ")
-		sqlStmtPtr.WriteString("string_agg(DISTINCT comp_soc_prof.url,'¤'), comp_soc_prof.type, comp_soc_prof.industry, ")
-		sqlStmtPtr.WriteString("cont.id, cont.gender, cont.first_name, cont.last_name, cont.job_title, cont.telephone, cont.created_on, cont.updated_on, ")
-		sqlStmtPtr.WriteString("cont_ad.street_number, cont_ad.route, cont_ad.postal_code, cont_ad.locality, cont_ad.administrative_area_level_2, cont_ad.administrative_area_level_1, cont_ad.country, ")
-		sqlStmtPtr.WriteString("string_agg(DISTINCT job_function.name,'¤'), ")
-		sqlStmtPtr.WriteString("job_level.name, ")
-		sqlStmtPtr.WriteString("cont_email.email, cont_email.status, cont_email.created_on, ")
-		sqlStmtPtr.WriteString("string_agg(DISTINCT cont_soc_prof.url,'¤'), cont_soc_prof.industry ")
-	}
-	sqlStmtPtr.WriteString("FROM company AS comp ")
-	sqlStmtPtr.WriteString("LEFT JOIN postal_address AS comp_ad ON comp_ad.id = comp.postal_address_id ")
-	sqlStmtPtr.WriteString("LEFT JOIN companyemail ON companyemail.company_id = comp.id ")
-	sqlStmtPtr.WriteString("LEFT JOIN companysocialprofile AS comp_soc_prof ON comp_soc_prof.company_id = comp.id ")
-	sqlStmtPtr.WriteString("LEFT JOIN prospect AS cont ON cont.company_id = comp.id ")
-	sqlStmtPtr.WriteString("LEFT JOIN postal_address AS cont_ad ON cont_ad.id = cont.postal_address_id ")
-	sqlStmtPtr.WriteString("LEFT JOIN prospect_job_function_mapping ON prospect_job_function_mapping.prospect_id = cont.id ")
-	sqlStmtPtr.WriteString("LEFT JOIN job_function ON job_function.id = prospect_job_function_mapping.job_function_id ")
-	sqlStmtPtr.WriteString("LEFT JOIN job_level ON job_level.id = cont.job_level_id ")
-	sqlStmtPtr.WriteString("LEFT JOIN prospectemail AS cont_email ON cont_email.id = cont.email_id ")
-	sqlStmtPtr.WriteString("LEFT JOIN prospectsocialprofile AS cont_soc_prof ON cont_soc_prof.id = cont.social_profile_id ")
-	sqlStmtPtr.WriteString("LEFT JOIN savelistprospectcustomersgroup AS cont_group ON cont_group.prospect_id = cont.id ")
-	sqlStmtPtr.WriteString("WHERE ")
-
-	// In order to build query incrementally based on a variable number
-	// of parameters, tried first to use NamedArg (https://golang.org/pkg/database/sql/#NamedArg)
-	// but not working (while officially Postgresql is supposed to support it) and docs
-	// does not help.
-	// So I'm building the query with positional arguments ($1, $2, ...) by incrementing
-	// dynamically the value. The index values are stored in posIndex.
-	// The corresponding value for each index is stored in sqlArgs. Type of sqlArgs is []interface{}
-	// because the is what the db.Query() variadic function expects.
-	var sqlArgs []interface{}
-	var posIndex int
-
-	// Incrementally add WHERE clauses to the SQL query
-	sqlArgs, posIndex = convStringToWhereClause(userInput.CompanyCity, "comp_ad.locality", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringToWhereClause(userInput.CompanyPostCode, "comp_ad.postal_code", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.CompanyCountries, "comp_ad.country", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.CompanyIndustries, "comp_soc_prof.industry", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.CompanySizes, "comp.size", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.CompanyTypes, "comp_soc_prof.type", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convBoolToWhereClause(userInput.CompanyHasEmail, "companyemail.email", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convBoolToWhereClause(userInput.CompanyHasPhone, "comp.telephone", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.CompanyDomains, "comp.domain", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereNotClause(userInput.ExcludedCompanyDomains, "comp.domain", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringToWhereClause(userInput.ContactCity, "cont_ad.locality", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringToWhereClause(userInput.ContactPostCode, "cont_ad.postal_code", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.ContactCountries, "cont_ad.country", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.ContactIndustries, "cont_soc_prof.industry", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringToWhereLikeClause(userInput.ContactJobTitle, "cont.job_title", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.ContactFunctions, "job_function.name", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convStringArrayToWhereClause(userInput.ContactJobLevels, "job_level.name", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convBoolToWhereClause(userInput.ContactHasEmail, "cont_email.email", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convIntArrayToWhereClause(userInput.ContactRemoteAccounts, "cont_group.group_id", posIndex, sqlArgs, sqlStmtPtr)
-	sqlArgs, posIndex = convIntArrayToWhereNotClause(userInput.ExcludedContactRemoteAccounts, "cont_group.group_id", posIndex, sqlArgs, sqlStmtPtr)
+	query := querybuilder.New("company", "comp").Join(
+		querybuilder.LeftJoin("postal_address", "comp_ad", "comp_ad.id = comp.postal_address_id"),
+		// Suppressed emails are never joined, so they are neither returned nor
+		// counted, and a company with suppressed emails only has no email
+		querybuilder.LeftJoin("companyemail", "companyemail", "companyemail.company_id = comp.id").And(
+			querybuilder.UpperNotInArray("companyemail.email", userInput.suppressedEmails),
+			querybuilder.DomainNotInArray("split_part(companyemail.email, '@', 2)", userInput.suppressedDomains),
+		),
+		querybuilder.LeftJoin("companysocialprofile", "comp_soc_prof", "comp_soc_prof.company_id = comp.id"),
+		contJoin,
+		querybuilder.LeftJoin("postal_address", "cont_ad", "cont_ad.id = cont.postal_address_id"),
+		querybuilder.LeftJoin("prospect_job_function_mapping", "prospect_job_function_mapping", "prospect_job_function_mapping.prospect_id = cont.id"),
+		querybuilder.LeftJoin("job_function", "job_function", "job_function.id = prospect_job_function_mapping.job_function_id"),
+		querybuilder.LeftJoin("job_level", "job_level", "job_level.id = cont.job_level_id"),
+		querybuilder.LeftJoin("prospectemail", "cont_email", "cont_email.id = cont.email_id"),
+		querybuilder.LeftJoin("prospectsocialprofile", "cont_soc_prof", "cont_soc_prof.id = cont.social_profile_id"),
+	)
+
+	// In count mode we only select what buildCountSQLReq needs for counting and
+	// use a narrow GROUP BY giving the same number of rows as in the full query.
+	switch {
+	case isCount:
+		query.Select("comp.id AS comp_id")
+		if mode != modeContacts || hasCompanyCriteria(userInput) {
+			query.Select("bool_or(companyemail.email <> '') AS comp_has_email")
+		} else {
+			query.Select("NULL::boolean AS comp_has_email")
+		}
+		if mode != modeCompanies {
+			query.Select("cont.id AS cont_id", "bool_or(cont_email.email <> '') AS cont_has_email", "bool_or(cont.telephone <> '') AS cont_has_phone")
+		} else {
+			query.Select("NULL::integer AS cont_id", "NULL::boolean AS cont_has_email", "NULL::boolean AS cont_has_phone")
+		}
+	case mode == modeCompanies:
+		query.Select(compSelectCols)
+	case mode == modeContacts:
+		query.Select("comp.id, comp.name, comp.domain", contSelectCols)
+	default:
+		query.Select(compSelectCols, contSelectCols)
+	}
+
+	// Every criterion is combined with AND (not OR as asked by John for the moment but
+	// we can still change it later). Empty user inputs give nil predicates which are ignored.
+	// Arguments should not be case sensitive so we convert everything to UPPERCASE thanks
+	// to the UPPER() SQL function.
+	query.Where(
+		querybuilder.UpperEq("comp_ad.locality", userInput.CompanyCity),
+		querybuilder.UpperEq("comp_ad.postal_code", userInput.CompanyPostCode),
+		querybuilder.UpperIn("comp_ad.country", userInput.CompanyCountries),
+		querybuilder.UpperIn("comp_soc_prof.industry", userInput.CompanyIndustries),
+		querybuilder.UpperIn("comp.size", userInput.CompanySizes),
+		querybuilder.UpperIn("comp_soc_prof.type", userInput.CompanyTypes),
+		convFakeBoolToPredicate(userInput.CompanyHasEmail, "companyemail.email"),
+		convFakeBoolToPredicate(userInput.CompanyHasPhone, "comp.telephone"),
+		querybuilder.UpperIn("comp.domain", userInput.CompanyDomains),
+		querybuilder.UpperNotIn("comp.domain", userInput.ExcludedCompanyDomains),
+		querybuilder.UpperEq("cont_ad.locality", userInput.ContactCity),
+		querybuilder.UpperEq("cont_ad.postal_code", userInput.ContactPostCode),
+		querybuilder.UpperIn("cont_ad.country", userInput.ContactCountries),
+		querybuilder.UpperIn("cont_soc_prof.industry", userInput.ContactIndustries),
+		querybuilder.UpperLike("cont.job_title", userInput.ContactJobTitle),
+		querybuilder.WithinDays("cont.updated_on", userInput.ContactUpdatedWithinDays),
+		querybuilder.UpperIn("job_function.name", userInput.ContactFunctions),
+		querybuilder.UpperIn("job_level.name", userInput.ContactJobLevels),
+		convFakeBoolToPredicate(userInput.ContactHasEmail, "cont_email.email"),
+	)
+
+	// Contacts already exported. Companies mode returns no contact so nothing to exclude.
+	if userInput.Mode != modeCompanies {
+		query.Where(querybuilder.NotInArray("cont.id", userInput.excludedContactIds))
+	}
+
+	// Suppression list (do-not-contact), applied to every search.
+	// Companies of a suppressed domain or of one of its subdomains (like www.)
+	// are never returned. Company emails are filtered when joining companyemail above.
+	query.Where(querybuilder.DomainNotInArray("comp.domain", userInput.suppressedDomains))
+	if userInput.Mode != modeCompanies {
+		query.Where(
+			querybuilder.NotInArray("cont.id", userInput.suppressedContactIds),
+			querybuilder.UpperNotInArray("cont_email.email", userInput.suppressedEmails),
+			querybuilder.DomainNotInArray("split_part(cont_email.email, '@', 2)", userInput.suppressedDomains),
+		)
+	}
+
+	// A contact belongs to many remote accounts (groups) so savelistprospectcustomersgroup
+	// is not joined anymore, it multiplied rows for nothing since no group column is selected.
+	// Group criteria are checked in an EXISTS subquery instead. Both criteria apply to the
+	// same group row, exactly like they did on the joined rows, so results are identical:
+	// an excluded remote account only excludes contacts which have no other group.
+	if len(userInput.ContactRemoteAccounts) > 0 || len(userInput.ExcludedContactRemoteAccounts) > 0 {
+		query.Where(querybuilder.Exists(
+			querybuilder.New("savelistprospectcustomersgroup", "cont_group").
+				Select("1").
+				Where(
+					querybuilder.Raw("cont_group.prospect_id = cont.id"),
+					querybuilder.In("cont_group.group_id", userInput.ContactRemoteAccounts),
+					querybuilder.NotIn("cont_group.group_id", userInput.ExcludedContactRemoteAccounts),
+				),
+		))
+	}
 
 	// GROUP BY part necessary in order to remove duplicates (used together with string_add() )
-	sqlStmtPtr.WriteString("GROUP BY comp.id, comp.name, comp.domain, comp.website, comp.telephone, comp.faxnumber, comp.size, comp.founded, comp.created_on, comp.updated_on, ")
-	sqlStmtPtr.WriteString("comp_ad.street_number, comp_ad.route, comp_ad.postal_code, comp_ad.locality, comp_ad.administrative_area_level_2, comp_ad.administrative_area_level_1, comp_ad.country, ")
-	sqlStmtPtr.WriteString("comp_soc_prof.type, comp_soc_prof.industry, ")
-	sqlStmtPtr.WriteString("cont.id, cont.gender, cont.first_name, cont.last_name, cont.job_title, cont.telephone, cont.created_on, cont.updated_on, ")
-	sqlStmtPtr.WriteString("cont_ad.street_number, cont_ad.route, cont_ad.postal_code, cont_ad.locality, cont_ad.administrative_area_level_2, cont_ad.administrative_area_level_1, cont_ad.country, ")
-	sqlStmtPtr.WriteString("job_level.name, ")
-	sqlStmtPtr.WriteString("cont_email.email, cont_email.status, cont_email.created_on, ")
-	sqlStmtPtr.WriteString("cont_soc_prof.industry")
+	compGroupBy, contGroupBy := compGroupByCols, contGroupByCols
+	if isCount {
+		compGroupBy, contGroupBy = compCountGroupByCols, contCountGroupByCols
+	}
+	switch mode {
+	case modeCompanies:
+		query.GroupBy(compGroupBy)
+	case modeContacts:
+		if isCount {
+			query.GroupBy("comp.id", contGroupBy)
+		} else {
+			query.GroupBy("comp.id, comp.name, comp.domain", contGroupBy)
+		}
+	default:
+		query.GroupBy(compGroupBy, contGroupBy)
+	}
 
-	return sqlArgs
+	return query.Build()
 
 }
 
@@ -698,6 +631,7 @@ func validateUserInput(userInputPtr *UserInput) error {
 		len(userInputPtr.ContactFunctions) == 0 &&
 		len(userInputPtr.ContactJobLevels) == 0 &&
 		userInputPtr.ContactHasEmail == 0 &&
+		userInputPtr.ContactUpdatedWithinDays == 0 &&
 		len(userInputPtr.ContactRemoteAccounts) == 0 &&
 		len(userInputPtr.ExcludedContactRemoteAccounts) == 0 {
 
@@ -782,6 +716,36 @@ func validateUserInput(userInputPtr *UserInput) error {
 	if userInputPtr.ContactHasEmail < 0 || userInputPtr.ContactHasEmail > 2 {
 		return errors.New("Contact Has Email should be integer: 1, 2, or 0.")
 	}
+	if userInputPtr.ContactUpdatedWithinDays < 0 || userInputPtr.ContactUpdatedWithinDays > 3650 {
+		return errors.New("Contact Updated Within Days should be an integer between 0 and 3650.")
+	}
+	if userInputPtr.ExcludeExportedWithinDays < 0 || userInputPtr.ExcludeExportedWithinDays > 3650 {
+		return errors.New("Exclude Exported Within Days should be an integer between 0 and 3650.")
+	}
+	for _, exportId := range userInputPtr.ExcludedExportIds {
+		if exportId < 1 {
+			return errors.New("Excluded Export Ids should be positive integers.")
+		}
+	}
+
+	if userInputPtr.Step != "estimate" && userInputPtr.Step != "dry-run" && userInputPtr.Step != "count" && userInputPtr.Step != "full" && userInputPtr.Step != "export" {
+		return errors.New("Step should be either estimate, dry-run, count, full or export.")
+	}
+	if userInputPtr.Shape != "" && userInputPtr.Shape != shapeRows && userInputPtr.Shape != shapeCompanies {
+		return errors.New("Shape should be either rows or companies.")
+	}
+	if userInputPtr.Mode != "" && userInputPtr.Mode != modeAll && userInputPtr.Mode != modeCompanies && userInputPtr.Mode != modeContacts {
+		return errors.New("Mode should be either all, companies or contacts.")
+	}
+	if userInputPtr.Shape == shapeCompanies && userInputPtr.Mode != "" && userInputPtr.Mode != modeAll {
+		return errors.New("Companies shape can only be used with the all mode.")
+	}
+	if userInputPtr.QueryId != "" && !isValidQueryId(userInputPtr.QueryId) {
+		return errors.New("Query Id should only contain letters, digits and dashes (64 max).")
+	}
+	if userInputPtr.Pseudonymize && getPseudonymizationSalt() == "" {
+		return errors.New("Pseudonymized exports are disabled since no salt is set on the server.")
+	}
 
 	return err
 
@@ -834,10 +798,10 @@ func cleanUserInput(userInputPtr *UserInput) {
 
 }
 
-// compressCSV turns the CSV file into a .zip archive
-func compressCSV() error {
+// compressCSV turns one or several CSV files into a single .zip archive
+func compressCSV(archivePath string, csvPaths []string) error {
 
-	newfile, err := os.Create(returnedArchiveName)
+	newfile, err := os.Create(archivePath)
 	if err != nil {
 		return err
 	}
@@ -846,7 +810,21 @@ func compressCSV() error {
 	zipWriter := zip.NewWriter(newfile)
 	defer zipWriter.Close()
 
-	zipfile, err := os.Open(returnedCSVName)
+	for _, csvPath := range csvPaths {
+		err = addFileToZip(zipWriter, csvPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return err
+
+}
+
+// addFileToZip copies one file from disk into the archive
+func addFileToZip(zipWriter *zip.Writer, fileName string) error {
+
+	zipfile, err := os.Open(fileName)
 	if err != nil {
 		return err
 	}
@@ -869,19 +847,123 @@ func compressCSV() error {
 		return err
 	}
 	_, err = io.Copy(writer, zipfile)
-	if err != nil {
-		return err
-	}
 
 	return err
 
 }
 
-// createCSV puts results returned from DB into a CSV file.
-// Write CSV file to disk in order to avoid RAM problems.
-func createCSV(compAndContRows []CompAndContRow) error {
+// companyCSVHeader is the first row of the company part of CSV files
+var companyCSVHeader = []string{
+	"Company Id",
+	"Company Name",
+	"Company Domain",
+	"Company Website",
+	"Company Telephone",
+	"Company Fax Number",
+	"Company Size",
+	"Company Founded",
+	"Company Street Number",
+	"Company Route",
+	"Company Postal Code",
+	"Company Locality",
+	"Company Admin Area Level 1",
+	"Company Admin Area Level 2",
+	"Company Country",
+	"Company Email",
+	"Company Social Profile URL",
+	"Company Type",
+	"Company Industry",
+	"Company Creation Date",
+	"Company Update Date",
+}
+
+// contactCSVHeader is the first row of the contact part of CSV files
+var contactCSVHeader = []string{
+	"Contact Id",
+	"Contact Gender",
+	"Contact First Name",
+	"Contact Last Name",
+	"Contact Job Title",
+	"Contact Job Function",
+	"Contact Job Level",
+	"Contact Telephone",
+	"Contact Street Number",
+	"Contact Route",
+	"Contact Postal Code",
+	"Contact Locality",
+	"Contact Admin Area Level 1",
+	"Contact Admin Area Level 2",
+	"Contact Country",
+	"Contact Email",
+	"Contact Email Status",
+	"Contact Email Creation Date",
+	"Contact Social Profile URL",
+	"Contact Industry",
+	"Contact Creation Date",
+	"Contact Update Date",
+}
 
-	csvFile, err := os.Create(returnedCSVName)
+// csvRecord returns company values in the same order as companyCSVHeader
+func (row CompRow) csvRecord() []string {
+	return []string{
+		row.CompId,
+		row.CompName.String,
+		row.CompDomain.String,
+		row.CompWebsite.String,
+		row.CompTelephone.String,
+		row.CompFaxNumber.String,
+		row.CompSize.String,
+		row.CompFounded.String,
+		row.CompStreetNumber.String,
+		row.CompRoute.String,
+		row.CompPostalCode.String,
+		row.CompLocality.String,
+		row.CompAdministrativeAreaLevel2.String,
+		row.CompAdministrativeAreaLevel1.String,
+		row.CompCountry.String,
+		row.CompEmail.String,
+		row.CompSocProfURL.String,
+		row.CompType.String,
+		row.CompIndustry.String,
+		row.CompCreatedOn.String,
+		row.CompUpdatedOn.String,
+	}
+}
+
+// csvRecord returns contact values in the same order as contactCSVHeader
+func (row ContRow) csvRecord() []string {
+	return []string{
+		row.ContId.String,
+		row.ContGender.String,
+		row.ContFirstName.String,
+		row.ContLastName.String,
+		row.ContJobTitle.String,
+		row.ContJobFunction.String,
+		row.ContJobLevel.String,
+		row.ContTelephone.String,
+		row.ContStreetNumber.String,
+		row.ContRoute.String,
+		row.ContPostalCode.String,
+		row.ContLocality.String,
+		row.ContAdministrativeAreaLevel2.String,
+		row.ContAdministrativeAreaLevel1.String,
+		row.ContCountry.String,
+		row.ContEmail.String,
+		row.ContEmailStatus.String,
+		row.ContEmailCreatedOn.String,
+		row.ContSocProfURL.String,
+		row.ContIndustry.String,
+		row.ContCreatedOn.String,
+		row.ContUpdatedOn.String,
+	}
+}
+
+// writeCSV writes a header and rowsNb records to a CSV file on disk.
+// Records are built one by one by csvRecord so we never hold the whole
+// CSV content in memory.
+func writeCSV(csvPath string, csvFirstRow []string, rowsNb int, csvRecord func(i int) []string) error {
+
+	csvFile, err := os.Create(csvPath)
 	if err != nil {
 		return err
 	}
@@ -889,120 +971,65 @@ func createCSV(compAndContRows []CompAndContRow) error {
 
 	csvWriter := csv.NewWriter(csvFile)
 	csvWriter.Comma = ';'
-	defer csvWriter.Flush()
-
-	csvFirstRow := []string{
-		"Company Id",
-		"Company Name",
-		"Company Domain",
-		"Company Website",
-		"Company Telephone",
-		"Company Fax Number",
-		"Company Size",
-		"Company Founded",
-		"Company Street Number",
-		"Company Route",
-		"Company Postal Code",
-		"Company Locality",
-		"Company Admin Area Level 1",
-		"Company Admin Area Level 2",
-		"Company Country",
-		"Company Email",
-		"Company Social Profile URL",
-		"Company Type",
-		"Company Industry",
-		"Company Creation Date",
-		"Company Update Date",
-		"Contact Id",
-		"Contact Gender",
-		"Contact First Name",
-		"Contact Last Name",
-		"Contact Job Title",
-		"Contact Job Function",
-		"Contact Job Level",
-		"Contact Telephone",
-		"Contact Street Number",
-		"Contact Route",
-		"Contact Postal Code",
-		"Contact Locality",
-		"Contact Admin Area Level 1",
-		"Contact Admin Area Level 2",
-		"Contact Country",
-		"Contact Email",
-		"Contact Email Status",
-		"Contact Email Creation Date",
-		"Contact Social Profile URL",
-		"Contact Industry",
-		"Contact Creation Date",
-		"Contact Update Date",
-	}
+
 	csvWriter.Write(csvFirstRow)
+	for i := 0; i < rowsNb; i++ {
+		csvWriter.Write(csvRecord(i))
+	}
+	csvWriter.Flush()
 
-	for _, row := range compAndContRows {
-		csvRow := []string{
-			row.CompId,
-			row.CompName.String,
-			row.CompDomain.String,
-			row.CompWebsite.String,
-			row.CompTelephone.String,
-			row.CompFaxNumber.String,
-			row.CompSize.String,
-			row.CompFounded.String,
-			row.CompStreetNumber.String,
-			row.CompRoute.String,
-			row.CompPostalCode.String,
-			row.CompLocality.String,
-			row.CompAdministrativeAreaLevel2.String,
-			row.CompAdministrativeAreaLevel1.String,
-			row.CompCountry.String,
-			row.CompEmail.String,
-			row.CompSocProfURL.String,
-			row.CompType.String,
-			row.CompIndustry.String,
-			row.CompCreatedOn.String,
-			row.CompUpdatedOn.String,
-			row.ContId.String,
-			row.ContGender.String,
-			row.ContFirstName.String,
-			row.ContLastName.String,
-			row.ContJobTitle.String,
-			row.ContJobFunction.String,
-			row.ContJobLevel.String,
-			row.ContTelephone.String,
-			row.ContStreetNumber.String,
-			row.ContRoute.String,
-			row.ContPostalCode.String,
-			row.ContLocality.String,
-			row.ContAdministrativeAreaLevel2.String,
-			row.ContAdministrativeAreaLevel1.String,
-			row.ContCountry.String,
-			row.ContEmail.String,
-			row.ContEmailStatus.String,
-			row.ContEmailCreatedOn.String,
-			row.ContSocProfURL.String,
-			row.ContIndustry.String,
-			row.ContCreatedOn.String,
-			row.ContUpdatedOn.String,
-		}
-		csvWriter.Write(csvRow)
+	return csvWriter.Error()
+
+}
+
+// createCSV puts results returned from DB into a CSV file.
+// Write CSV file to disk in order to avoid RAM problems.
+func createCSV(csvPath string, compAndContRows []CompAndContRow) error {
+
+	csvFirstRow := append(append([]string{}, companyCSVHeader...), contactCSVHeader...)
+
+	return writeCSV(csvPath, csvFirstRow, len(compAndContRows), func(i int) []string {
+		return append(compAndContRows[i].CompRow.csvRecord(), compAndContRows[i].ContRow.csvRecord()...)
+	})
+
+}
+
+// createCSVs creates in a directory the CSV files matching the mode and shape
+// requested by user and returns their paths
+func createCSVs(dir string, compAndContRows []CompAndContRow, userInput UserInput) ([]string, error) {
+
+	csvPath := filepath.Join(dir, returnedCSVName)
+	companiesCSVPath := filepath.Join(dir, returnedCompaniesCSVName)
+	contactsCSVPath := filepath.Join(dir, returnedContactsCSVName)
+
+	switch {
+	case userInput.Mode == modeCompanies:
+		err := createCompaniesOnlyCSV(companiesCSVPath, compAndContRows)
+		return []string{companiesCSVPath}, err
+	case userInput.Mode == modeContacts:
+		err := createContactsOnlyCSV(contactsCSVPath, compAndContRows)
+		return []string{contactsCSVPath}, err
+	case userInput.Shape == shapeCompanies:
+		err := createCompaniesCSVs(companiesCSVPath, contactsCSVPath, groupRowsByCompany(compAndContRows))
+		return []string{companiesCSVPath, contactsCSVPath}, err
 	}
 
-	return err
+	err := createCSV(csvPath, compAndContRows)
+	return []string{csvPath}, err
 
 }
 
-// sendResultsByEmail sends the .zip archive by email to a person defined
-// in env variable.
+// sendResultsByEmail sends the .zip archive by email.
 // Here we're using a nice little library for attachments.
-func sendResultsByEmail() error {
+func sendResultsByEmail(to string, archivePath string) error {
 
 	m := gomail.NewMessage()
 
 	m.SetHeader("From", "admin@example.com")
-	m.SetHeader("To", getUserEmail())
+	m.SetHeader("To", to)
 	m.SetHeader("Subject", "Database extraction done !")
 	m.SetBody("text/html", "Please find enclosed the extracted results.")
-	m.Attach(returnedArchiveName)
+	m.Attach(archivePath)
 
 	d := gomail.NewPlainDialer("smtp.example.com", 587, "admin@example.com", "password")
 	err := d.DialAndSend(m)
@@ -1011,48 +1038,62 @@ func sendResultsByEmail() error {
 
 }
 
-// returnCSVByEmail put results into a CSV, zip it, and send it by email
-func returnCSVByEmail(compAndContRows []CompAndContRow, w http.ResponseWriter) {
+// returnCSVByEmail put results into one or several CSV, zip it, and send it by email
+// to the person defined in env variable.
+// It is always run in the background once the http response is sent, so errors are
+// only logged.
+func returnCSVByEmail(compAndContRows []CompAndContRow, userInput UserInput) error {
+	return exportCSV(compAndContRows, userInput, func(archivePath string) error {
+		return sendResultsByEmail(getUserEmail(), archivePath)
+	})
+}
 
-	// Put results in a CSV file
-	err := createCSV(compAndContRows)
-	if err != nil {
-		err = CustErr(err, "Could not create CSV.\nStopping here.")
-		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	// Compress the CSV file to .zip
-	err = compressCSV()
+// exportCSV put results into one or several CSV, zip it, and delivers the archive
+// (by email, copy to disk...). Errors are logged.
+// Several exports can run at the same time (full step, background and scheduled
+// exports...), so each one writes its files in its own temporary directory.
+func exportCSV(compAndContRows []CompAndContRow, userInput UserInput, deliverArchive func(archivePath string) error) error {
+
+	dir, err := os.MkdirTemp("", "export-")
 	if err != nil {
-		err = CustErr(err, "Could not compress CSV.\nStopping here.")
+		err = CustErr(err, "Could not create temporary directory.\nStopping here.")
 		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	// Send .zip archive by email
-	err = sendResultsByEmail()
+	// Remove CSV files and .zip archive, whatever happens
+	defer func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			err = CustErr(err, "Could not delete CSV and archive.\nNOT stopping here.")
+			log.Println(err)
+		}
+	}()
+
+	// Put results in CSV files
+	csvPaths, err := createCSVs(dir, compAndContRows, userInput)
 	if err != nil {
-		err = CustErr(err, "Could not send results by email.\nStopping here.")
+		err = CustErr(err, "Could not create CSV.\nStopping here.")
 		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	// Remove CSV
-	err = os.Remove(returnedCSVName)
+	// Compress the CSV files to .zip
+	archivePath := filepath.Join(dir, returnedArchiveName)
+	err = compressCSV(archivePath, csvPaths)
 	if err != nil {
-		err = CustErr(err, "Could not delete CSV.\nNOT stopping here.")
+		err = CustErr(err, "Could not compress CSV.\nStopping here.")
 		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return err
 	}
-	// Remove .zip archive
-	err = os.Remove(returnedArchiveName)
+	// Deliver .zip archive
+	err = deliverArchive(archivePath)
 	if err != nil {
-		err = CustErr(err, "Could not remove archive.\nNOT stopping here.")
+		err = CustErr(err, "Could not deliver results.\nStopping here.")
 		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return err
 	}
 
+	return nil
+
 }
 
 // ReturnCompaniesAndContacts loads companies and associated contacts from db
@@ -1096,35 +1137,133 @@ func ReturnCompaniesAndContacts(w http.ResponseWriter, r *http.Request) {
 	}
 	cleanUserInput(&userInput)
 
+	runSearch(userInput, w, r)
+
+}
+
+// runSearch runs the step asked on a validated and cleaned user input and
+// writes the response. Shared by the search endpoint and saved searches.
+func runSearch(userInput UserInput, w http.ResponseWriter, r *http.Request) {
+
+	var err error
+
+	// Every query below is run with this context so it is canceled on PostgreSQL side when
+	// the client disconnects (tab closed...) or when the user cancels it explicitly
+	// through the cancel endpoint thanks to the query id.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// User is needed to isolate cached results and limit the number of
+	// queries a single user can run at the same time
+	user := getRequestUser(r)
+
+	// Audit the search once the response is sent, whatever the outcome
+	audit := startSearchAudit(user, userInput, w)
+	defer audit.record()
+	w = audit
+
+	if userInput.QueryId != "" {
+		queryToken, ok := registerQuery(user, userInput.QueryId, cancel)
+		if !ok {
+			log.Println("User " + user + " already runs a query with this query id: " + userInput.QueryId + "\nStopping here.")
+			http.Error(w, "A search with this query id is already running.", http.StatusConflict)
+			return
+		}
+		defer unregisterQuery(user, userInput.QueryId, queryToken)
+	}
+
+	permissions := getUserPermissions(user)
+	if !permissions.allowsStep(userInput.Step) {
+		log.Println("User " + user + " is not allowed to run step " + userInput.Step + "\nStopping here.")
+		forbid("Your role does not allow this step: "+userInput.Step+".", w)
+		return
+	}
+
+	// Quotas are checked before anything is run, and again for the full step once
+	// the number of rows is known
+	var quotaStatuses []QuotaStatus
+	if userInput.Step == "full" || userInput.Step == "export" {
+		quotaStatuses, err = getQuotaStatuses(ctx, user)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if reason := checkQuotas(quotaStatuses, 0); reason != "" {
+			log.Println("User " + user + " is over quota\nStopping here.")
+			refuseOverQuota(reason, w)
+			return
+		}
+	}
+
+	// Contacts already exported are read from the export history first since
+	// it is stored in the local db
+	err = resolveExportExclusions(ctx, user, &userInput)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	err = resolveSuppressions(ctx, &userInput)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	var returnedJson []byte
 
 	// If user only ask a count we launch a special count sql request and only return the nb of rows.
+	// If user only ask an estimate we ask the planner how many rows the full query should return,
+	// which is much faster than a count but approximate.
+	// If user ask a dry-run we return the full query, its arguments and its plan without running it.
 	// If user ask for the full results we return everything either in json or by compressed csv by email
 	// depending on the size.
+	// If user ask an export, results are always sent by email in the background whatever the size.
 	switch userInput.Step {
 
-	case "count":
+	case "estimate":
 
-		// Initialize the count SQL statement that will be created incrementally
-		var sqlStmtCnt strings.Builder
+		sqlStmtEstStr, sqlArgs := buildSQLReq(false, userInput)
 
-		// Build the SQL request
-		// sqlStmt is not passed by value but by pointer because compulsory for a strings.Builder
-		sqlArgs := buildSQLReq(&sqlStmtCnt, true, userInput)
-		// Convert SQL statement to string
-		sqlStmtCntStr := sqlStmtCnt.String()
+		queryPlan, err := runExplainSQLReq(ctx, sqlStmtEstStr, sqlArgs, w)
+		if err != nil {
+			return
+		}
 
-		log.Println(sqlStmtCntStr)
+		audit.delivery = deliveryJson
+		estimateRes := EstimateRes{
+			EstimatedRowsNb: int64(queryPlan.PlanRows),
+			Approximate:     true,
+		}
 
-		// Run the SQL query
-		var countRes CountRes
-		countRes.rowsNb, err = runCountSQLReq(sqlStmtCntStr, sqlArgs, w)
+		returnedJson, err = json.Marshal(estimateRes)
 		if err != nil {
+			err = CustErr(err, "Could not not marshall to JSON.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		// Turn struct into a proper JSON response:
-		returnedJson, err = json.Marshal(countRes.rowsNb)
+	case "dry-run":
+
+		// Contacts already exported and suppressed values are not disclosed, even
+		// through the filters of the plan
+		sqlStmtDryStr, sqlArgs := buildSQLReq(false, hideExcludedValues(userInput))
+
+		queryPlan, err := runExplainSQLReq(ctx, sqlStmtDryStr, sqlArgs, w)
+		if err != nil {
+			return
+		}
+
+		audit.delivery = deliveryJson
+		dryRunRes := DryRunRes{
+			SQL:       sqlStmtDryStr,
+			Args:      describeDryRunArgs(sqlArgs),
+			QueryPlan: queryPlan,
+		}
+
+		returnedJson, err = json.Marshal(dryRunRes)
 		if err != nil {
 			err = CustErr(err, "Could not not marshall to JSON.\nStopping here.")
 			log.Println(err)
@@ -1132,44 +1271,211 @@ func ReturnCompaniesAndContacts(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-	case "full":
+	case "count":
 
-		// Initialize the full SQL statement that will be created incrementally
-		var sqlStmtFull strings.Builder
+		// Reuse the count of the same search if done recently by the same user
+		cacheKey := buildCacheKey(userInput, cacheKindCount, user)
+		countRes, isCached := getCachedCount(cacheKey)
 
-		sqlArgs := buildSQLReq(&sqlStmtFull, false, userInput)
-		sqlStmtFullStr := sqlStmtFull.String()
+		if isCached {
+			w.Header().Set("X-Cache", cacheHit)
+		} else {
+			w.Header().Set("X-Cache", cacheMiss)
 
-		log.Println(sqlStmtFullStr)
+			// Build the SQL request
+			sqlStmtCntStr, sqlArgs := buildCountSQLReq(userInput)
 
-		compAndContRows, err := runFullSQLReq(sqlStmtFullStr, sqlArgs, w)
+			log.Println(sqlStmtCntStr)
+
+			// Check with the planner that the query is not too heavy for the remote DB
+			queryPlan, err := runExplainSQLReq(ctx, sqlStmtCntStr, sqlArgs, w)
+			if err != nil {
+				return
+			}
+			if isQueryTooExpensive(queryPlan, "count") {
+				refuseTooExpensive(queryPlan, "count", w)
+				return
+			}
+
+			// Wait for the remote DB to be available
+			ticket, err := acquireQuerySlot(ctx, limitCount, user, userInput.QueryId, w)
+			if err != nil {
+				return
+			}
+
+			// Run the SQL query
+			countRes, err = runCountSQLReq(ctx, sqlStmtCntStr, sqlArgs, w)
+			ticket.release()
+			if err != nil {
+				return
+			}
+			setCachedCount(cacheKey, countRes)
+		}
+		audit.setResult(countRes.RowsNb, deliveryJson)
+
+		// Turn struct into a proper JSON response:
+		returnedJson, err = json.Marshal(countRes)
 		if err != nil {
+			err = CustErr(err, "Could not not marshall to JSON.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
+	case "export":
+
+		sqlStmtExpStr, sqlArgs := buildSQLReq(false, userInput)
+
+		log.Println(sqlStmtExpStr)
+
+		// Exports run in the background but the user should know right away if
+		// the query is too heavy even for them
+		queryPlan, err := runExplainSQLReq(ctx, sqlStmtExpStr, sqlArgs, w)
+		if err != nil {
+			return
+		}
+		if isQueryTooExpensive(queryPlan, "export") {
+			refuseTooExpensive(queryPlan, "export", w)
+			return
+		}
+
+		audit.delivery = deliveryBackground
+		startBackgroundExport(sqlStmtExpStr, sqlArgs, userInput, buildCacheKey(userInput, cacheKindRows, user), user, w)
+		return
+
+	case "full":
+
+		// Reuse the results of the same search if done recently by the same user,
+		// whatever the shape asked since rows are shaped afterwards
+		cacheKey := buildCacheKey(userInput, cacheKindRows, user)
+		compAndContRows, isCached := getCachedRows(cacheKey)
+
+		if isCached {
+			w.Header().Set("X-Cache", cacheHit)
+		} else {
+			w.Header().Set("X-Cache", cacheMiss)
+
+			sqlStmtFullStr, sqlArgs := buildSQLReq(false, userInput)
+
+			log.Println(sqlStmtFullStr)
+
+			// Check with the planner that the query is not too heavy for the remote DB before
+			// running it. Depending on policy, a heavy query is either rejected or run in the background.
+			queryPlan, err := runExplainSQLReq(ctx, sqlStmtFullStr, sqlArgs, w)
+			if err != nil {
+				return
+			}
+			if isQueryTooExpensive(queryPlan, "full") {
+				if getQueryCostPolicy() == costPolicyAsync && permissions.CanExport {
+					audit.delivery = deliveryBackground
+				}
+				rejectOrRunInBackground(sqlStmtFullStr, sqlArgs, userInput, queryPlan, cacheKey, user, permissions.CanExport, w)
+				return
+			}
+
+			// Wait for the remote DB to be available
+			ticket, err := acquireQuerySlot(ctx, limitFull, user, userInput.QueryId, w)
+			if err != nil {
+				return
+			}
+
+			compAndContRows, err = runFullSQLReq(ctx, sqlStmtFullStr, sqlArgs, userInput.Mode, "full", w)
+			ticket.release()
+			if err != nil {
+				return
+			}
+			setCachedRows(cacheKey, compAndContRows)
+		}
+
 		// Get nb of rows returned by query
 		rowsNb := len(compAndContRows)
 
 		// If no result found, stop here
 		if rowsNb == 0 {
+			audit.setResult(rowsNb, deliveryNone)
 			log.Println("No result found\nStopping here.")
 			http.Error(w, "No result found", http.StatusNotFound)
 			return
 		}
 
-		if rowsNb > 5000 { // Send results in a compressed csv by email because too big
+		// Send results in a compressed csv by email because too big, if the role can export.
+		// Otherwise results are sent in json, capped depending on the role.
+		sendByEmail := rowsNb > 5000 && permissions.CanExport
+		if !sendByEmail && permissions.MaxRows > 0 && rowsNb > permissions.MaxRows {
+			// Rows come from cache so must not be modified, only resliced
+			compAndContRows = compAndContRows[:permissions.MaxRows]
+			rowsNb = permissions.MaxRows
+			w.Header().Set("X-Results-Capped", "true")
+		}
 
-			// Send results by email asynchronously
-			go returnCSVByEmail(compAndContRows, w)
+		if reason := checkQuotas(quotaStatuses, rowsNb); reason != "" {
+			audit.setResult(rowsNb, deliveryNone)
+			log.Println("User " + user + " would go over quota\nStopping here.")
+			refuseOverQuota(reason, w)
+			return
+		}
+
+		// Very large results wait for the approval of a manager and are then sent by email.
+		// Roles which cannot export would never get them so no approval is requested.
+		if needsApproval(rowsNb) {
+			if !permissions.CanExport {
+				audit.setResult(rowsNb, deliveryNone)
+				log.Println("User " + user + " cannot export the " + strconv.Itoa(rowsNb) + " rows needing approval\nStopping here.")
+				forbid(approvalNotAllowedMessage(rowsNb), w)
+				return
+			}
+			exportApprovalId, err := requestExportApproval(ctx, user, userInput, rowsNb)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			audit.setResult(rowsNb, deliveryApproval)
+			http.Error(w, approvalRequestedMessage(exportApprovalId, rowsNb), http.StatusAccepted)
+			return
+		}
+
+		// Remember who got these contacts, whatever the way they are sent. Quotas are
+		// checked again while recording since other searches may have used them meanwhile.
+		exportId, reason, err := reserveExport(ctx, user, "full", userInput, compAndContRows)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if reason != "" {
+			audit.setResult(rowsNb, deliveryNone)
+			log.Println("User " + user + " would go over quota\nStopping here.")
+			refuseOverQuota(reason, w)
+			return
+		}
+
+		// Hide contact data the role should not see, or all personal data if
+		// pseudonymization was asked, in JSON and CSV alike
+		compAndContRows = protectRows(compAndContRows, userInput, permissions.MaskedFields)
+
+		if sendByEmail {
+
+			audit.setResult(rowsNb, deliveryEmail)
+
+			// Send results by email asynchronously, the export is not counted if it fails
+			go func() {
+				if returnCSVByEmail(compAndContRows, userInput) != nil {
+					cancelExport(exportId)
+				}
+			}()
 
 			// Tell frontend that not returning a json but sent by email.
 			http.Error(w, "The request returned too many lines so results have been sent by email.", http.StatusNoContent)
 
 		} else { // Send results in json
 
-			// Turn struct into a proper JSON response:
-			returnedJson, err = json.Marshal(compAndContRows)
+			audit.setResult(rowsNb, deliveryJson)
+
+			// Turn struct into a proper JSON response, depending on mode and shape:
+			returnedJson, err = json.Marshal(shapeResults(compAndContRows, userInput))
 			if err != nil {
+				cancelExport(exportId)
 				err = CustErr(err, "Could not not marshall to JSON.\nStopping here.")
 				log.Println(err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// go test -run SQLReq -update rewrites the golden files of testdata/ with the SQL built now.
+// Check the diff of the golden files before committing them.
+var updateGolden = flag.Bool("update", false, "update the golden files of testdata/")
+
+// nullString returns a valid JsonNullString
+func nullString(value string) JsonNullString {
+	return JsonNullString{sql.NullString{String: value, Valid: true}}
+}
+
+// readArchive returns the content of the files of a .zip archive by name
+func readArchive(archivePath string) (map[string]string, error) {
+
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	files := map[string]string{}
+	for _, file := range archive.File {
+		content, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := ioutil.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[file.Name] = string(bytes)
+	}
+	return files, nil
+
+}
+
+func TestExportCSVRunsConcurrently(t *testing.T) {
+
+	const exportsNb = 8
+	var wg sync.WaitGroup
+	archives := make([]map[string]string, exportsNb)
+	archivePaths := make([]string, exportsNb)
+	errs := make([]error, exportsNb)
+
+	for i := 0; i < exportsNb; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var rows []CompAndContRow
+			for j := 0; j < 500; j++ {
+				var row CompAndContRow
+				row.CompId = fmt.Sprintf("export-%d-company-%d", i, j)
+				row.CompName = nullString(fmt.Sprintf("Company of export %d", i))
+				rows = append(rows, row)
+			}
+			errs[i] = exportCSV(rows, UserInput{}, func(archivePath string) error {
+				archivePaths[i] = archivePath
+				var err error
+				archives[i], err = readArchive(archivePath)
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < exportsNb; i++ {
+		if errs[i] != nil {
+			t.Fatalf("export %d failed: %v", i, errs[i])
+		}
+		content, ok := archives[i][returnedCSVName]
+		if !ok || len(archives[i]) != 1 {
+			t.Fatalf("export %d: got files %v, want only %s", i, archives[i], returnedCSVName)
+		}
+		if strings.Count(content, fmt.Sprintf("export-%d-company-", i)) != 500 || strings.Count(content, "export-") != 500 {
+			t.Errorf("export %d got rows of other exports", i)
+		}
+		if _, err := os.Stat(archivePaths[i]); !os.IsNotExist(err) {
+			t.Errorf("archive of export %d was not removed", i)
+		}
+	}
+
+}
+
+func TestExportCSVFilesOfModesAndShapes(t *testing.T) {
+
+	var row CompAndContRow
+	row.CompId = "1"
+	row.ContId = nullString("2")
+	rows := []CompAndContRow{row}
+
+	tests := []struct {
+		userInput UserInput
+		files     []string
+	}{
+		{UserInput{}, []string{returnedCSVName}},
+		{UserInput{Mode: modeCompanies}, []string{returnedCompaniesCSVName}},
+		{UserInput{Mode: modeContacts}, []string{returnedContactsCSVName}},
+		{UserInput{Shape: shapeCompanies}, []string{returnedCompaniesCSVName, returnedContactsCSVName}},
+	}
+	for _, test := range tests {
+		err := exportCSV(rows, test.userInput, func(archivePath string) error {
+			files, err := readArchive(archivePath)
+			if err != nil {
+				return err
+			}
+			if len(files) != len(test.files) {
+				t.Errorf("mode %q shape %q: got %d files, want %v", test.userInput.Mode, test.userInput.Shape, len(files), test.files)
+			}
+			for _, name := range test.files {
+				if _, ok := files[name]; !ok {
+					t.Errorf("mode %q shape %q: %s missing", test.userInput.Mode, test.userInput.Shape, name)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+}
+
+// sqlReqCase is a search whose SQL is checked against the golden files
+type sqlReqCase struct {
+	name      string
+	userInput UserInput
+}
+
+// sqlReqCases returns one search per UserInput field changing the SQL, plus a few combinations
+func sqlReqCases() []sqlReqCase {
+	return []sqlReqCase{
+		{"noCriteria", UserInput{}},
+		{"companyCity", UserInput{CompanyCity: "Paris"}},
+		{"companyPostCode", UserInput{CompanyPostCode: "75001"}},
+		{"companyCountries", UserInput{CompanyCountries: []string{"France", "Belgium"}}},
+		{"companyIndustries", UserInput{CompanyIndustries: []string{"Banking"}}},
+		{"companySizes", UserInput{CompanySizes: []string{"1-10", "11-50"}}},
+		{"companyTypes", UserInput{CompanyTypes: []string{"Privately Held"}}},
+		{"companyHasPhone", UserInput{CompanyHasPhone: 1}},
+		{"companyHasNoPhone", UserInput{CompanyHasPhone: 2}},
+		{"companyHasEmail", UserInput{CompanyHasEmail: 1}},
+		{"companyHasNoEmail", UserInput{CompanyHasEmail: 2}},
+		{"companyDomains", UserInput{CompanyDomains: []string{"example.com", "example.org"}}},
+		{"excludedCompanyDomains", UserInput{ExcludedCompanyDomains: []string{"example.net"}}},
+		{"contactCity", UserInput{ContactCity: "Lyon"}},
+		{"contactPostCode", UserInput{ContactPostCode: "69001"}},
+		{"contactCountries", UserInput{ContactCountries: []string{"France"}}},
+		{"contactIndustries", UserInput{ContactIndustries: []string{"Insurance"}}},
+		{"contactJobTitle", UserInput{ContactJobTitle: "engineer"}},
+		{"contactFunctions", UserInput{ContactFunctions: []string{"Marketing", "Sales"}}},
+		{"contactJobLevels", UserInput{ContactJobLevels: []string{"Director"}}},
+		{"contactHasEmail", UserInput{ContactHasEmail: 1}},
+		{"contactHasNoEmail", UserInput{ContactHasEmail: 2}},
+		{"contactUpdatedWithinDays", UserInput{ContactUpdatedWithinDays: 30}},
+		{"contactRemoteAccounts", UserInput{ContactRemoteAccounts: []string{"12", "13"}}},
+		{"excludedContactRemoteAccounts", UserInput{ExcludedContactRemoteAccounts: []string{"14"}}},
+		{"bothContactRemoteAccounts", UserInput{ContactRemoteAccounts: []string{"12"}, ExcludedContactRemoteAccounts: []string{"14"}}},
+		{"excludedContactIds", UserInput{excludedContactIds: []int64{1, 2, 3}}},
+		{"suppressedEmails", UserInput{suppressedEmails: []string{"john@example.com"}}},
+		{"suppressedDomains", UserInput{suppressedDomains: []string{"example.com"}}},
+		{"suppressedContactIds", UserInput{suppressedContactIds: []int64{4, 5}}},
+		{"exclusionsAndSuppressions", UserInput{
+			CompanyCountries:     []string{"France"},
+			ContactFunctions:     []string{"Sales"},
+			excludedContactIds:   []int64{1},
+			suppressedEmails:     []string{"john@example.com"},
+			suppressedDomains:    []string{"example.com"},
+			suppressedContactIds: []int64{4},
+		}},
+	}
+}
+
+// UserInput fields which do not change the SQL on their own: ExcludeExportedWithinDays and
+// ExcludedExportIds are turned into excludedContactIds by resolveExportExclusions().
+var fieldsNotInSQL = map[string]bool{
+	"Step":                      true,
+	"QueryId":                   true,
+	"Shape":                     true,
+	"Mode":                      true,
+	"Pseudonymize":              true,
+	"ExcludeExportedWithinDays": true,
+	"ExcludedExportIds":         true,
+}
+
+// formatSQLArgs formats query arguments, arrays like PostgreSQL receives them
+func formatSQLArgs(args []interface{}) string {
+	var formatted []string
+	for _, arg := range args {
+		if valuer, ok := arg.(driver.Valuer); ok {
+			value, err := valuer.Value()
+			if err != nil {
+				panic(err)
+			}
+			arg = value
+		}
+		formatted = append(formatted, fmt.Sprintf("%q", fmt.Sprint(arg)))
+	}
+	return "[" + strings.Join(formatted, ", ") + "]"
+}
+
+// checkGolden compares content with a golden file of testdata/, or rewrites it with -update
+func checkGolden(t *testing.T, name string, content string) {
+
+	t.Helper()
+	goldenPath := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(goldenPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	golden, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(golden) != content {
+		goldenCases := strings.Split(string(golden), "\n\n")
+		cases := strings.Split(content, "\n\n")
+		for i := range cases {
+			if i >= len(goldenCases) || cases[i] != goldenCases[i] {
+				want := ""
+				if i < len(goldenCases) {
+					want = goldenCases[i]
+				}
+				t.Fatalf("%s differs, run go test -update if the change is expected. Got:\n%s\nwant:\n%s", goldenPath, cases[i], want)
+			}
+		}
+		t.Fatalf("%s has cases which are not tested anymore, run go test -update", goldenPath)
+	}
+
+}
+
+func TestSQLReqCasesCoverEveryField(t *testing.T) {
+
+	covered := map[string]bool{}
+	for _, test := range sqlReqCases() {
+		value := reflect.ValueOf(test.userInput)
+		for i := 0; i < value.NumField(); i++ {
+			if !value.Field(i).IsZero() {
+				covered[value.Type().Field(i).Name] = true
+			}
+		}
+	}
+	userInputType := reflect.TypeOf(UserInput{})
+	for i := 0; i < userInputType.NumField(); i++ {
+		name := userInputType.Field(i).Name
+		if !covered[name] && !fieldsNotInSQL[name] {
+			t.Errorf("no SQL golden case sets UserInput.%s", name)
+		}
+	}
+
+}
+
+func TestBuildSQLReq(t *testing.T) {
+
+	for _, mode := range []string{modeAll, modeCompanies, modeContacts} {
+		for _, isCount := range []bool{false, true} {
+
+			buildReq := func(userInput UserInput) (string, []interface{}) {
+				userInput.Mode = mode
+				if isCount {
+					return buildCountSQLReq(userInput)
+				}
+				return buildSQLReq(false, userInput)
+			}
+
+			goldenName := "sql_req_" + mode
+			if isCount {
+				goldenName = "count_sql_req_" + mode
+			}
+
+			baseSQL, _ := buildReq(UserInput{})
+			var content strings.Builder
+			for _, test := range sqlReqCases() {
+				sqlText, args := buildReq(test.userInput)
+				// Contacts exclusions and suppressions are not applied in modeCompanies
+				// which returns no contact
+				notInCompanies := test.name == "excludedContactIds" || test.name == "suppressedContactIds"
+				if test.name != "noCriteria" && sqlText == baseSQL && !(mode == modeCompanies && notInCompanies) {
+					t.Errorf("%s: %s does not change the SQL", goldenName, test.name)
+				}
+				if strings.Count(sqlText, "$") != len(args) {
+					t.Errorf("%s: %s has %d placeholders for %d args", goldenName, test.name, strings.Count(sqlText, "$"), len(args))
+				}
+				fmt.Fprintf(&content, "-- %s\n%s\n-- args: %s\n\n", test.name, sqlText, formatSQLArgs(args))
+			}
+			checkGolden(t, goldenName, content.String())
+
+		}
+	}
+
+}
+
+// countFullRows computes the numbers of the count step from the rows of the full step
+func countFullRows(rows []CompAndContRow) CountRes {
+
+	var countRes CountRes
+	companies, contacts := map[string]bool{}, map[string]bool{}
+	companiesWithEmail, contactsWithEmail, contactsWithPhone := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, row := range rows {
+		companies[row.CompId] = true
+		if row.CompEmail.String != "" {
+			companiesWithEmail[row.CompId] = true
+		}
+		if !row.ContId.Valid {
+			continue
+		}
+		contacts[row.ContId.String] = true
+		if row.ContEmail.String != "" {
+			contactsWithEmail[row.ContId.String] = true
+		}
+		if row.ContTelephone.String != "" {
+			contactsWithPhone[row.ContId.String] = true
+		}
+	}
+	countRes.RowsNb = len(rows)
+	countRes.CompaniesNb = len(companies)
+	countRes.ContactsNb = len(contacts)
+	countRes.ContactsWithEmailNb = len(contactsWithEmail)
+	countRes.ContactsWithPhoneNb = len(contactsWithPhone)
+	countRes.CompaniesWithEmailNb = len(companiesWithEmail)
+	return countRes
+
+}
+
+// queryCountAndFull runs the count query and the full query of a search on the search test db
+func queryCountAndFull(db *sql.DB, userInput UserInput) (CountRes, []CompAndContRow, error) {
+
+	var countRes CountRes
+	sqlStmtStr, sqlArgs := buildCountSQLReq(userInput)
+	err := db.QueryRow(sqlStmtStr, sqlArgs...).Scan(
+		&countRes.RowsNb,
+		&countRes.CompaniesNb,
+		&countRes.ContactsNb,
+		&countRes.ContactsWithEmailNb,
+		&countRes.ContactsWithPhoneNb,
+		&countRes.CompaniesWithEmailNb,
+	)
+	if err != nil {
+		return countRes, nil, err
+	}
+
+	sqlStmtStr, sqlArgs = buildSQLReq(false, userInput)
+	rows, err := db.Query(sqlStmtStr, sqlArgs...)
+	if err != nil {
+		return countRes, nil, err
+	}
+	defer rows.Close()
+	var compAndContRows []CompAndContRow
+	for rows.Next() {
+		var compAndContRow CompAndContRow
+		if err := rows.Scan(scanDests(&compAndContRow, userInput.Mode)...); err != nil {
+			return countRes, nil, err
+		}
+		compAndContRows = append(compAndContRows, compAndContRow)
+	}
+
+	return countRes, compAndContRows, rows.Err()
+
+}
+
+// Searches run on the search test db, matching its seeded values
+func seededSearchCases() []sqlReqCase {
+	return []sqlReqCase{
+		{"companyCountriesAndContactHasEmail", UserInput{CompanyCountries: []string{"France"}, ContactHasEmail: 2}},
+		{"companyCity", UserInput{CompanyCity: "city 4"}},
+		{"companySizesAndTypes", UserInput{CompanySizes: []string{"1-10"}, CompanyTypes: []string{"Public Company"}}},
+		{"companyHasEmail", UserInput{CompanyHasEmail: 2, CompanyIndustries: []string{"Banking"}}},
+		{"companyHasNoPhone", UserInput{CompanyHasPhone: 1, ExcludedCompanyDomains: []string{"company3.com"}}},
+		{"contactCountriesAndJobTitle", UserInput{ContactCountries: []string{"Spain"}, ContactJobTitle: "engineer"}},
+		{"contactFunctionsAndLevels", UserInput{ContactFunctions: []string{"Sales", "IT"}, ContactJobLevels: []string{"Director"}}},
+		{"contactHasNoEmail", UserInput{ContactHasEmail: 1, ContactIndustries: []string{"Insurance"}}},
+		{"contactUpdatedWithinDays", UserInput{ContactUpdatedWithinDays: 10, CompanyDomains: []string{"company1.com", "company2.com", "company5.com"}}},
+		{"contactRemoteAccounts", UserInput{ContactRemoteAccounts: []string{"12", "13"}, ExcludedContactRemoteAccounts: []string{"14"}}},
+		{"exclusionsAndSuppressions", UserInput{
+			CompanyCountries:     []string{"Italy"},
+			excludedContactIds:   []int64{13, 14, 23},
+			suppressedEmails:     []string{"PERSON57@example0.com", "Contact1@company6.com"},
+			suppressedDomains:    []string{"example2.com", "company10.com"},
+			suppressedContactIds: []int64{16, 58},
+		}},
+	}
+}
+
+func TestCountSQLReqMatchesFullSQLReq(t *testing.T) {
+
+	db := requireSearchDB(t)
+
+	for _, mode := range []string{modeAll, modeCompanies, modeContacts} {
+		for _, test := range seededSearchCases() {
+			userInput := test.userInput
+			userInput.Mode = mode
+			countRes, rows, err := queryCountAndFull(db, userInput)
+			if err != nil {
+				t.Fatalf("mode %s, %s: %v", mode, test.name, err)
+			}
+			if len(rows) == 0 {
+				t.Errorf("mode %s, %s: no results, the search does not match the seeded data", mode, test.name)
+			}
+			for _, row := range rows {
+				for _, email := range strings.Split(row.CompEmail.String, multiValuesSeparator) {
+					email = strings.ToUpper(email)
+					for _, suppressed := range userInput.suppressedEmails {
+						if email == strings.ToUpper(suppressed) {
+							t.Errorf("mode %s, %s: suppressed company email %s returned", mode, test.name, email)
+						}
+					}
+					for _, domain := range userInput.suppressedDomains {
+						upperDomain := strings.ToUpper(domain)
+						if strings.HasSuffix(email, "@"+upperDomain) || strings.HasSuffix(email, "."+upperDomain) {
+							t.Errorf("mode %s, %s: company email %s of a suppressed domain returned", mode, test.name, email)
+						}
+					}
+				}
+			}
+			want := countFullRows(rows)
+			// Company emails are not selected in modeContacts, and only counted
+			// when a company criterion joins companyemail anyway
+			if mode == modeContacts {
+				want.CompaniesWithEmailNb = countRes.CompaniesWithEmailNb
+			}
+			if countRes != want {
+				t.Errorf("mode %s, %s: count step gives %+v, full step %+v", mode, test.name, countRes, want)
+			}
+		}
+	}
+
+}
+
+// BenchmarkSearchSteps compares the count step with the full step on the search test db:
+// TEST_SEARCH_DB=... go test go_project -run none -bench SearchSteps
+func BenchmarkSearchSteps(b *testing.B) {
+
+	db := requireSearchDB(b)
+	userInput := UserInput{CompanyCountries: []string{"France"}, ContactHasEmail: 2}
+
+	for _, mode := range []string{modeAll, modeCompanies, modeContacts} {
+		userInput.Mode = mode
+		countSQL, countArgs := buildCountSQLReq(userInput)
+		fullSQL, fullArgs := buildSQLReq(false, userInput)
+
+		b.Run("count/"+mode, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var rowsNb, companiesNb, contactsNb, contactsWithEmailNb, contactsWithPhoneNb, companiesWithEmailNb int
+				err := db.QueryRow(countSQL, countArgs...).Scan(&rowsNb, &companiesNb, &contactsNb, &contactsWithEmailNb, &contactsWithPhoneNb, &companiesWithEmailNb)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("full/"+mode, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rows, err := db.Query(fullSQL, fullArgs...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for rows.Next() {
+				}
+				err = rows.Err()
+				rows.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+}
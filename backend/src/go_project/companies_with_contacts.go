@@ -0,0 +1,97 @@
+/*
+companies_with_contacts.go turns the rows returned by the big companies and
+contacts query into one object per company with its contacts nested inside.
+This is what account-based marketing users need since they work company by
+company. Same thing for exports: one CSV for companies and one CSV for
+contacts, both in the same .zip archive.
+*/
+
+package main
+
+import (
+	"strconv"
+)
+
+// CompanyWithContacts stores one company and all its matching contacts
+type CompanyWithContacts struct {
+	CompRow
+	ContactsNb          int       `json:"contactsNb"`
+	ContactsWithEmailNb int       `json:"contactsWithEmailNb"`
+	Contacts            []ContRow `json:"contacts"`
+}
+
+// groupRowsByCompany merges rows belonging to the same company.
+// Companies are kept in the order they appear in the SQL results.
+// A company without any matching contact is kept with an empty list
+// because of the LEFT JOIN on prospect.
+// The same contact can appear twice for a company (e.g. company has
+// several social profile types) so contacts are deduplicated on their id.
+func groupRowsByCompany(compAndContRows []CompAndContRow) []CompanyWithContacts {
+
+	companies := []CompanyWithContacts{}
+	companyIndexes := make(map[string]int)
+	seenContacts := make(map[string]bool)
+
+	for _, row := range compAndContRows {
+
+		i, ok := companyIndexes[row.CompId]
+		if !ok {
+			i = len(companies)
+			companyIndexes[row.CompId] = i
+			companies = append(companies, CompanyWithContacts{
+				CompRow:  row.CompRow,
+				Contacts: []ContRow{},
+			})
+		}
+
+		if !row.ContId.Valid || seenContacts[row.CompId+"|"+row.ContId.String] {
+			continue
+		}
+		seenContacts[row.CompId+"|"+row.ContId.String] = true
+
+		companies[i].Contacts = append(companies[i].Contacts, row.ContRow)
+		companies[i].ContactsNb++
+		if row.ContEmail.String != "" {
+			companies[i].ContactsWithEmailNb++
+		}
+
+	}
+
+	return companies
+
+}
+
+// createCompaniesCSVs writes companies in a first CSV and their contacts in
+// a second CSV. Contacts CSV starts with the company id so both files can
+// be joined back in a spreadsheet.
+func createCompaniesCSVs(companiesCSVPath string, contactsCSVPath string, companies []CompanyWithContacts) error {
+
+	companiesFirstRow := append(append([]string{}, companyCSVHeader...), "Contacts Nb", "Contacts With Email Nb")
+	err := writeCSV(companiesCSVPath, companiesFirstRow, len(companies), func(i int) []string {
+		return append(companies[i].csvRecord(),
+			strconv.Itoa(companies[i].ContactsNb),
+			strconv.Itoa(companies[i].ContactsWithEmailNb),
+		)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Flatten contacts so writeCSV can access them by index
+	type companyContact struct {
+		compId  string
+		contact ContRow
+	}
+	var contacts []companyContact
+	for _, company := range companies {
+		for _, contact := range company.Contacts {
+			contacts = append(contacts, companyContact{company.CompId, contact})
+		}
+	}
+
+	contactsFirstRow := append([]string{"Company Id"}, contactCSVHeader...)
+	return writeCSV(contactsCSVPath, contactsFirstRow, len(contacts), func(i int) []string {
+		return append([]string{contacts[i].compId}, contacts[i].contact.csvRecord()...)
+	})
+
+}
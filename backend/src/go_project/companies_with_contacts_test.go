@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// companyContactRow returns a row of the big query for a company and one of its contacts.
+// An empty contId is a company without any matching contact.
+func companyContactRow(compId string, contId string, contEmail string) CompAndContRow {
+	var row CompAndContRow
+	row.CompId = compId
+	row.CompName = JsonNullString{sql.NullString{String: "Company " + compId, Valid: true}}
+	row.ContId = JsonNullString{sql.NullString{String: contId, Valid: contId != ""}}
+	row.ContEmail = JsonNullString{sql.NullString{String: contEmail, Valid: contId != ""}}
+	return row
+}
+
+// groupedRows are returned by the db in no particular order, with a contact twice
+// because its company has 2 social profiles and a company without any contact
+func groupedRows() []CompAndContRow {
+	return []CompAndContRow{
+		companyContactRow("1", "10", "ann@example.com"),
+		companyContactRow("1", "11", ""),
+		companyContactRow("1", "10", "ann@example.com"),
+		companyContactRow("2", "", ""),
+		companyContactRow("1", "12", "bob@example.com"),
+		companyContactRow("3", "10", "ann@example.com"),
+	}
+}
+
+// readCSVFile returns the records of a CSV file written by writeCSV
+func readCSVFile(t *testing.T, csvPath string) [][]string {
+	t.Helper()
+	csvFile, err := os.Open(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer csvFile.Close()
+	csvReader := csv.NewReader(csvFile)
+	csvReader.Comma = ';'
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestGroupRowsByCompany(t *testing.T) {
+
+	companies := groupRowsByCompany(groupedRows())
+
+	tests := []struct {
+		compId              string
+		contIds             []string
+		contactsWithEmailNb int
+	}{
+		{"1", []string{"10", "11", "12"}, 2},
+		{"2", []string{}, 0},
+		{"3", []string{"10"}, 1},
+	}
+	if len(companies) != len(tests) {
+		t.Fatalf("got %d companies, want %d", len(companies), len(tests))
+	}
+	for i, test := range tests {
+		company := companies[i]
+		if company.CompId != test.compId {
+			t.Errorf("company %d: got id %s, want %s", i, company.CompId, test.compId)
+			continue
+		}
+		if company.CompName.String != "Company "+test.compId {
+			t.Errorf("company %s: got name %q", test.compId, company.CompName.String)
+		}
+		contIds := []string{}
+		for _, contact := range company.Contacts {
+			contIds = append(contIds, contact.ContId.String)
+		}
+		if !reflect.DeepEqual(contIds, test.contIds) {
+			t.Errorf("company %s: got contacts %v, want %v", test.compId, contIds, test.contIds)
+		}
+		if company.ContactsNb != len(test.contIds) || company.ContactsWithEmailNb != test.contactsWithEmailNb {
+			t.Errorf("company %s: got %d contacts and %d with email, want %d and %d", test.compId,
+				company.ContactsNb, company.ContactsWithEmailNb, len(test.contIds), test.contactsWithEmailNb)
+		}
+	}
+
+}
+
+func TestCreateCompaniesCSVs(t *testing.T) {
+
+	companiesCSVPath := filepath.Join(t.TempDir(), returnedCompaniesCSVName)
+	contactsCSVPath := filepath.Join(t.TempDir(), returnedContactsCSVName)
+	err := createCompaniesCSVs(companiesCSVPath, contactsCSVPath, groupRowsByCompany(groupedRows()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One line per company, with the number of its contacts
+	companyRecords := readCSVFile(t, companiesCSVPath)
+	var companies [][]string
+	for _, record := range companyRecords[1:] {
+		companies = append(companies, []string{record[0], record[len(record)-2], record[len(record)-1]})
+	}
+	wantCompanies := [][]string{{"1", "3", "2"}, {"2", "0", "0"}, {"3", "1", "1"}}
+	if !reflect.DeepEqual(companies, wantCompanies) {
+		t.Errorf("got companies %v, want %v", companies, wantCompanies)
+	}
+
+	// One line per contact of each company, starting with the company id
+	contactRecords := readCSVFile(t, contactsCSVPath)
+	if contactRecords[0][0] != "Company Id" || contactRecords[0][1] != "Contact Id" {
+		t.Errorf("got contacts header %v", contactRecords[0][:2])
+	}
+	var contacts [][]string
+	for _, record := range contactRecords[1:] {
+		contacts = append(contacts, []string{record[0], record[1]})
+	}
+	wantContacts := [][]string{{"1", "10"}, {"1", "11"}, {"1", "12"}, {"3", "10"}}
+	if !reflect.DeepEqual(contacts, wantContacts) {
+		t.Errorf("got company and contact ids %v, want %v", contacts, wantContacts)
+	}
+
+}
@@ -0,0 +1,162 @@
+/*
+cron.go parses standard cron expressions with 5 fields:
+minute hour day-of-month month day-of-week
+Each field accepts *, single values, ranges (1-5), lists (1,3,5) and steps
+(0-30/10, or a star followed by /15 for every 15 minutes). Day of week goes from 0 (Sunday) to 6, 7 is also Sunday.
+Like in cron, if both day of month and day of week are restricted, a day
+matching either of them is fine.
+Example: "0 8 * * 1" is every Monday at 8:00.
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule stores for each field which values match
+type cronSchedule struct {
+	minutes     [60]bool
+	hours       [24]bool
+	daysOfMonth [32]bool
+	months      [13]bool
+	daysOfWeek  [7]bool
+	domIsStar   bool
+	dowIsStar   bool
+}
+
+// parseCronField parses one field of a cron expression into the values matching,
+// between min and max included
+func parseCronField(field string, min int, max int, values []bool) error {
+
+	for _, part := range strings.Split(field, ",") {
+
+		// Step, e.g. */15 or 0-30/10
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return errors.New("Invalid step in cron field: " + field)
+			}
+			part = part[:i]
+		}
+
+		// Range, e.g. * or 1-5 or 3
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return errors.New("Invalid value in cron field: " + field)
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return errors.New("Invalid range in cron field: " + field)
+				}
+			} else if step > 1 {
+				// 5/10 means from 5 to max every 10
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return errors.New("Value out of range in cron field: " + field)
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+
+	return nil
+
+}
+
+// parseCron parses a cron expression with 5 fields
+func parseCron(expression string) (cronSchedule, error) {
+
+	var schedule cronSchedule
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return schedule, errors.New("Cron expression should have 5 fields: minute hour day-of-month month day-of-week.")
+	}
+
+	if err := parseCronField(fields[0], 0, 59, schedule.minutes[:]); err != nil {
+		return schedule, err
+	}
+	if err := parseCronField(fields[1], 0, 23, schedule.hours[:]); err != nil {
+		return schedule, err
+	}
+	if err := parseCronField(fields[2], 1, 31, schedule.daysOfMonth[:]); err != nil {
+		return schedule, err
+	}
+	if err := parseCronField(fields[3], 1, 12, schedule.months[:]); err != nil {
+		return schedule, err
+	}
+	// 7 is also Sunday so parse up to 7 and fold it on 0
+	var daysOfWeek [8]bool
+	if err := parseCronField(fields[4], 0, 7, daysOfWeek[:]); err != nil {
+		return schedule, err
+	}
+	copy(schedule.daysOfWeek[:], daysOfWeek[:7])
+	if daysOfWeek[7] {
+		schedule.daysOfWeek[0] = true
+	}
+
+	schedule.domIsStar = strings.HasPrefix(fields[2], "*")
+	schedule.dowIsStar = strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+
+}
+
+// matchesDay tells if a day matches the day of month and day of week fields
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	domMatches := s.daysOfMonth[t.Day()]
+	dowMatches := s.daysOfWeek[t.Weekday()]
+	switch {
+	case s.domIsStar && s.dowIsStar:
+		return true
+	case s.domIsStar:
+		return dowMatches
+	case s.dowIsStar:
+		return domMatches
+	}
+	return domMatches || dowMatches
+}
+
+// next returns the first time strictly after t matching the schedule, in the
+// timezone loc. Returns zero time if nothing matches within 5 years
+// (e.g. 30th of February).
+func (s cronSchedule) next(t time.Time, loc *time.Location) time.Time {
+
+	t = t.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	// Jump to the next month, day or hour as soon as one does not match
+	// instead of trying every minute
+	for t.Before(limit) {
+		switch {
+		case !s.months[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !s.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+
+}
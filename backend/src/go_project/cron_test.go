@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronRejectsInvalidExpressions(t *testing.T) {
+
+	for _, expression := range []string{
+		"",
+		"0 8 * *",
+		"0 8 * * 1 2018",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := parseCron(expression); err == nil {
+			t.Errorf("%q: should be rejected", expression)
+		}
+	}
+
+}
+
+func TestNextRunOn(t *testing.T) {
+
+	// A Wednesday
+	now := time.Date(2024, time.January, 10, 9, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		cron     string
+		timezone string
+		next     time.Time
+	}{
+		// Every Monday at 8:00
+		{"0 8 * * 1", "UTC", time.Date(2024, time.January, 15, 8, 0, 0, 0, time.UTC)},
+		// Sunday as 7 like as 0
+		{"0 8 * * 7", "UTC", time.Date(2024, time.January, 14, 8, 0, 0, 0, time.UTC)},
+		{"0 8 * * 0", "UTC", time.Date(2024, time.January, 14, 8, 0, 0, 0, time.UTC)},
+		// Strictly after now, seconds dropped
+		{"* * * * *", "UTC", time.Date(2024, time.January, 10, 9, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", "UTC", time.Date(2024, time.January, 10, 9, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", "UTC", time.Date(2024, time.January, 10, 9, 45, 0, 0, time.UTC)},
+		{"0,30 9-17 * * 1-5", "UTC", time.Date(2024, time.January, 10, 10, 0, 0, 0, time.UTC)},
+		// First day of next month
+		{"0 0 1 * *", "UTC", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day of month or day of week when both are restricted
+		{"0 0 20 * 5", "UTC", time.Date(2024, time.January, 12, 0, 0, 0, 0, time.UTC)},
+		// Leap day
+		{"0 0 29 2 *", "UTC", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// 8:00 in Paris is 7:00 UTC in winter
+		{"0 8 * * *", "Europe/Paris", time.Date(2024, time.January, 11, 7, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		next, err := nextRunOn(test.cron, test.timezone, now)
+		if err != nil {
+			t.Errorf("%q: %s", test.cron, err)
+			continue
+		}
+		if next == nil || !next.Equal(test.next) {
+			t.Errorf("%q in %s: got %v, want %v", test.cron, test.timezone, next, test.next)
+		}
+	}
+
+}
+
+func TestNextRunOnNeverMatching(t *testing.T) {
+
+	next, err := nextRunOn("0 0 30 2 *", "UTC", time.Date(2024, time.January, 10, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != nil {
+		t.Errorf("30th of February should never match, got %v", next)
+	}
+
+	if _, err := nextRunOn("0 8 * * 1", "Mars/Olympus_Mons", time.Now()); err == nil {
+		t.Error("unknown timezone should be rejected")
+	}
+
+}
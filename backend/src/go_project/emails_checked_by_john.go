@@ -5,6 +5,7 @@ Return emails from the email_checked_by_john table.
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -55,7 +56,7 @@ type EmailCheckedByPA struct {
 }
 
 // getResFromDB queries DB and stores results in []EmailCheckedByJohn
-func getResFromDB(missionNumber string, w http.ResponseWriter) ([]EmailCheckedByjJhn, error) {
+func getResFromDB(ctx context.Context, missionNumber string, w http.ResponseWriter) ([]EmailCheckedByjJhn, error) {
 
 	var emails []EmailCheckedByJohn
 	var err error
@@ -75,7 +76,7 @@ func getResFromDB(missionNumber string, w http.ResponseWriter) ([]EmailCheckedBy
 	// Make the sql query:
 	sqlStatement := `SELECT * FROM email_checked_by_john 
     	WHERE mission_number = $1`
-	rows, err := db.Query(sqlStatement, missionNumber)
+	rows, err := db.QueryContext(ctx, sqlStatement, missionNumber)
 	if err != nil {
 		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
 		log.Println(err)
@@ -127,6 +128,11 @@ func ReturnEmailsCheckedByJohn(w http.ResponseWriter, r *http.Request) {
 
 	var err error
 
+	if !getUserPermissions(getRequestUser(r)).CanSeeMissions {
+		forbid("Your role does not allow to see missions.", w)
+		return
+	}
+
 	// Get the parameter passed to url and query the database based on this
 	// parameter:
 	params := mux.Vars(r)
@@ -142,7 +148,7 @@ func ReturnEmailsCheckedByJohn(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get results from DB
-	emails, err := getResFromDB(missionNumber, w)
+	emails, err := getResFromDB(r.Context(), missionNumber, w)
 	if err != nil {
 		return
 	}
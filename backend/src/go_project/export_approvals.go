@@ -0,0 +1,439 @@
+/*
+export_approvals.go makes very large exports wait for the approval of a manager
+before the backend generates them.
+When a full search, an export or a scheduled export returns more rows than the
+threshold, results are not delivered. An approval request is stored instead with
+the search and the number of rows found.
+Roles allowed to (see canApproveExports in policy.go) list pending requests and
+approve or reject them with a comment. Nobody can approve their own requests.
+Once approved, the search is run again in the background like an export and
+results are sent by email, if the requester can still export, the search is not
+too heavy for an export and results did not grow more than approvedRowsMargin
+percent past the approved rows. Otherwise the approved export fails, and a new
+approval request is stored if results grew. Roles which cannot export never get
+to request an approval.
+The requester is notified at the email address of the policy when a request is
+approved, rejected or when the approved export fails.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	"gopkg.in/gomail.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Possible statuses of an export approval request.
+// Approved requests are done or failed once the export is over.
+const (
+	approvalStatusPending  = "pending"
+	approvalStatusApproved = "approved"
+	approvalStatusRejected = "rejected"
+	approvalStatusDone     = "done"
+	approvalStatusFailed   = "failed"
+)
+
+// Approved exports can return up to this percentage of rows more than approved,
+// since the remote db keeps growing between the request and the approval
+const approvedRowsMargin = 10
+
+// Reasons of approved exports failing, told to the requester
+var (
+	errApprovedExportNotAllowed = errors.New("the role of the requester does not allow exports anymore.")
+	errApprovedRowsOutgrown     = errors.New("results grew well past the approved number of rows, a new approval request was sent.")
+	errApprovedExportTooHeavy   = errors.New("the search became too heavy for the database, please narrow it down and ask again.")
+)
+
+// ExportApproval stores a request to export more rows than the threshold.
+// Approver, comment and decision date are null until a decision is made.
+type ExportApproval struct {
+	Id        int             `json:"id"`
+	Requester string          `json:"requester"`
+	UserInput json.RawMessage `json:"userInput"`
+	RowsNb    int             `json:"rowsNb"`
+	Status    string          `json:"status"`
+	Approver  *string         `json:"approver"`
+	Comment   *string         `json:"comment"`
+	Error     *string         `json:"error"`
+	CreatedOn time.Time       `json:"createdOn"`
+	DecidedOn *time.Time      `json:"decidedOn"`
+}
+
+// ApprovalDecision stores the comment of an approver
+type ApprovalDecision struct {
+	Comment string `json:"comment"`
+}
+
+// getExportApprovalThreshold gets the number of rows above which an export needs
+// approval from env var set by Docker run.
+// If no env var set, set it to 50000. 0 means exports never need approval.
+func getExportApprovalThreshold() int {
+	threshold, err := strconv.Atoi(os.Getenv("EXPORT_APPROVAL_THRESHOLD"))
+	if err != nil || threshold < 0 {
+		threshold = 50000
+	}
+	return threshold
+}
+
+// needsApproval tells if delivering some rows needs approval
+func needsApproval(rowsNb int) bool {
+	threshold := getExportApprovalThreshold()
+	return threshold > 0 && rowsNb > threshold
+}
+
+// approvalCovers tells if rowsNb rows can be delivered under an approval of
+// approvedRowsNb rows. 0 approved rows means no approval.
+func approvalCovers(approvedRowsNb int, rowsNb int) bool {
+	return approvedRowsNb > 0 && rowsNb <= approvedRowsNb+approvedRowsNb*approvedRowsMargin/100
+}
+
+// getExportApprovalId gets the export approval id from url
+func getExportApprovalId(r *http.Request, w http.ResponseWriter) (int, error) {
+	exportApprovalId, err := strconv.Atoi(mux.Vars(r)["exportapprovalid"])
+	if err != nil {
+		err = CustErr(err, "Export approval id is not an integer.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Export approval id should be an integer.", http.StatusBadRequest)
+	}
+	return exportApprovalId, err
+}
+
+// sendNotificationEmail sends an email without attachment
+func sendNotificationEmail(to string, subject string, body string) error {
+
+	m := gomail.NewMessage()
+
+	m.SetHeader("From", "admin@example.com")
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
+
+	d := gomail.NewPlainDialer("smtp.example.com", 587, "admin@example.com", "password")
+	err := d.DialAndSend(m)
+
+	return err
+
+}
+
+// notifyRequester tells the requester what happened to an export approval request,
+// at its email address of the policy. Errors are only logged.
+func notifyRequester(exportApproval ExportApproval, subject string, body string) {
+	to := getUserEmailAddress(exportApproval.Requester)
+	if _, ok := policy.Emails[exportApproval.Requester]; !ok {
+		log.Println("No email address of " + exportApproval.Requester + " in the policy, notification sent to USER_EMAIL.")
+	}
+	body = fmt.Sprintf("Export approval request %d of %s (%d rows): %s", exportApproval.Id, exportApproval.Requester, exportApproval.RowsNb, body)
+	err := sendNotificationEmail(to, subject, body)
+	if err != nil {
+		log.Println(CustErr(err, "Could not send notification email.\nNOT stopping here."))
+	}
+}
+
+// requestExportApproval stores a request to export a search and returns its id
+func requestExportApproval(ctx context.Context, requester string, userInput UserInput, rowsNb int) (int, error) {
+
+	rawUserInput, err := json.Marshal(userInput)
+	if err != nil {
+		return 0, CustErr(err, "Could not marshall to JSON.\nStopping here.")
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return 0, CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	var exportApprovalId int
+	sqlStatement := `INSERT INTO export_approval (requester, user_input, rows_nb) VALUES ($1, $2, $3) RETURNING id`
+	err = db.QueryRowContext(ctx, sqlStatement, requester, string(rawUserInput), rowsNb).Scan(&exportApprovalId)
+	if err != nil {
+		return 0, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	log.Println(fmt.Sprintf("Export of %d rows by %s needs approval, request %d created.", rowsNb, requester, exportApprovalId))
+	return exportApprovalId, nil
+
+}
+
+// approvalRequestedMessage tells the requester that results wait for approval
+func approvalRequestedMessage(exportApprovalId int, rowsNb int) string {
+	return fmt.Sprintf("This search returns %d rows, above the %d rows which need the approval of a manager. "+
+		"Approval request %d was sent, results will be sent by email once approved.", rowsNb, getExportApprovalThreshold(), exportApprovalId)
+}
+
+// approvalNotAllowedMessage tells users who cannot export why results needing
+// approval are refused
+func approvalNotAllowedMessage(rowsNb int) string {
+	return fmt.Sprintf("This search returns %d rows, above the %d rows which need the approval of a manager, "+
+		"and your role does not allow exports. Please narrow it down.", rowsNb, getExportApprovalThreshold())
+}
+
+// runApprovedExport runs an approved export in the background and stores how it went
+func runApprovedExport(exportApproval ExportApproval) {
+
+	err := exportApprovedSearch(exportApproval)
+
+	status := approvalStatusDone
+	var errMsg *string
+	if err != nil {
+		log.Println(err)
+		status = approvalStatusFailed
+		msg := err.Error()
+		errMsg = &msg
+		notice := "the export failed, please try again or contact an admin."
+		if err == errApprovedExportNotAllowed || err == errApprovedRowsOutgrown || err == errApprovedExportTooHeavy {
+			notice = err.Error()
+		}
+		notifyRequester(exportApproval, "Approved export failed", notice)
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		log.Println(CustErr(err, "DB connection failed\nStopping here."))
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `UPDATE export_approval SET status = $1, error = $2 WHERE id = $3`
+	_, err = db.Exec(sqlStatement, status, errMsg, exportApproval.Id)
+	if err != nil {
+		log.Println(CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here."))
+	}
+
+}
+
+// exportApprovedSearch runs the search of an approved request through the same
+// path as background exports, with the permissions the requester has now
+func exportApprovedSearch(exportApproval ExportApproval) error {
+
+	// The role of the requester may have changed since the request
+	if !getUserPermissions(exportApproval.Requester).allowsStep("export") {
+		log.Println("Role of " + exportApproval.Requester + " does not allow exports anymore, approved export " + strconv.Itoa(exportApproval.Id) + " not run.\nStopping here.")
+		return errApprovedExportNotAllowed
+	}
+
+	var userInput UserInput
+	err := json.Unmarshal(exportApproval.UserInput, &userInput)
+	if err != nil {
+		return CustErr(err, "Cannot unmarshall json.\nStopping here.")
+	}
+	userInput.Step = "export"
+	err = validateUserInput(&userInput)
+	if err != nil {
+		return err
+	}
+	cleanUserInput(&userInput)
+	err = resolveExportExclusions(context.Background(), exportApproval.Requester, &userInput)
+	if err != nil {
+		return err
+	}
+	err = resolveSuppressions(context.Background(), &userInput)
+	if err != nil {
+		return err
+	}
+
+	// The search may have become too heavy since it was approved
+	sqlStmtStr, sqlArgs := buildSQLReq(false, userInput)
+	queryPlan, err := queryExplainSQLReq(context.Background(), sqlStmtStr, sqlArgs)
+	if err != nil {
+		return err
+	}
+	if isQueryTooExpensive(queryPlan, "export") {
+		log.Println(fmt.Sprintf("Query cost %.0f of approved export %d is above max cost %.0f.\nStopping here.",
+			queryPlan.TotalCost, exportApproval.Id, getMaxQueryCost("export")))
+		return errApprovedExportTooHeavy
+	}
+
+	ticket, err := queryLimiters[limitExport].enqueue(exportApproval.Requester, "")
+	if err != nil {
+		return err
+	}
+	return runExportInBackground(sqlStmtStr, sqlArgs, userInput, buildCacheKey(userInput, cacheKindRows, exportApproval.Requester), ticket, exportApproval.RowsNb)
+
+}
+
+// ReturnExportApprovalsList returns the last export approval requests, most recent
+// first. Approvers see all of them, other users only their own.
+// Optional filter in the query string: status.
+func ReturnExportApprovalsList(w http.ResponseWriter, r *http.Request) {
+
+	exportApprovals := []ExportApproval{}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	user := getRequestUser(r)
+	sqlStatement := `SELECT id, requester, user_input, rows_nb, status, approver, comment, error, created_on, decided_on
+		FROM export_approval
+		WHERE ($1 OR requester = $2) AND ($3 = '' OR status = $3)
+		ORDER BY created_on DESC LIMIT 200`
+	rows, err := db.QueryContext(r.Context(), sqlStatement, getUserPermissions(user).CanApproveExports, user, r.URL.Query().Get("status"))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var exportApproval ExportApproval
+		var rawUserInput []byte
+		err = rows.Scan(
+			&exportApproval.Id,
+			&exportApproval.Requester,
+			&rawUserInput,
+			&exportApproval.RowsNb,
+			&exportApproval.Status,
+			&exportApproval.Approver,
+			&exportApproval.Comment,
+			&exportApproval.Error,
+			&exportApproval.CreatedOn,
+			&exportApproval.DecidedOn,
+		)
+		if err != nil {
+			err = CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		exportApproval.UserInput = json.RawMessage(rawUserInput)
+		exportApprovals = append(exportApprovals, exportApproval)
+	}
+
+	returnedJson, err := json.Marshal(exportApprovals)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// decideExportApproval approves or rejects a pending export approval request.
+// Only approvers can do it, and not on their own requests.
+func decideExportApproval(status string, w http.ResponseWriter, r *http.Request) {
+
+	approver := getRequestUser(r)
+	if !getUserPermissions(approver).CanApproveExports {
+		forbid("Your role does not allow to approve exports.", w)
+		return
+	}
+
+	exportApprovalId, err := getExportApprovalId(r, w)
+	if err != nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = CustErr(err, "Cannot read request body.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var decision ApprovalDecision
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &decision)
+		if err != nil {
+			err = CustErr(err, "Cannot unmarshall json.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if status == approvalStatusRejected && decision.Comment == "" {
+		http.Error(w, "Please tell the requester why the export is rejected.", http.StatusBadRequest)
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Only one approver can decide, even if two of them click at the same time
+	var exportApproval ExportApproval
+	var rawUserInput []byte
+	sqlStatement := `UPDATE export_approval SET status = $1, approver = $2, comment = $3, decided_on = now()
+		WHERE id = $4 AND status = $5 AND requester <> $2
+		RETURNING id, requester, user_input, rows_nb, status, approver, comment, created_on, decided_on`
+	err = db.QueryRowContext(r.Context(), sqlStatement, status, approver, decision.Comment, exportApprovalId, approvalStatusPending).Scan(
+		&exportApproval.Id,
+		&exportApproval.Requester,
+		&rawUserInput,
+		&exportApproval.RowsNb,
+		&exportApproval.Status,
+		&exportApproval.Approver,
+		&exportApproval.Comment,
+		&exportApproval.CreatedOn,
+		&exportApproval.DecidedOn,
+	)
+	if err == sql.ErrNoRows {
+		log.Println("No pending export approval of another user found for this id: " + strconv.Itoa(exportApprovalId) + "\nStopping here.")
+		http.Error(w, "No pending export approval request of another user found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	exportApproval.UserInput = json.RawMessage(rawUserInput)
+
+	if status == approvalStatusApproved {
+		go notifyRequester(exportApproval, "Export approved", "approved by "+approver+", results will be sent by email once the export is over. "+decision.Comment)
+		go runApprovedExport(exportApproval)
+	} else {
+		go notifyRequester(exportApproval, "Export rejected", "rejected by "+approver+": "+decision.Comment)
+	}
+
+	returnedJson, err := json.Marshal(exportApproval)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// ApproveExport approves a pending export, which is then run in the background
+func ApproveExport(w http.ResponseWriter, r *http.Request) {
+	decideExportApproval(approvalStatusApproved, w, r)
+}
+
+// RejectExport rejects a pending export. A comment is needed.
+func RejectExport(w http.ResponseWriter, r *http.Request) {
+	decideExportApproval(approvalStatusRejected, w, r)
+}
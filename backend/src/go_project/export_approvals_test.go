@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestApprovalCovers(t *testing.T) {
+
+	tests := []struct {
+		approvedRowsNb int
+		rowsNb         int
+		want           bool
+	}{
+		{0, 60000, false},
+		{60000, 50000, true},
+		{60000, 60000, true},
+		{60000, 66000, true},
+		{60000, 66001, false},
+		{60000, 120000, false},
+	}
+	for _, test := range tests {
+		if got := approvalCovers(test.approvedRowsNb, test.rowsNb); got != test.want {
+			t.Errorf("approvalCovers(%d, %d) = %v, want %v", test.approvedRowsNb, test.rowsNb, got, test.want)
+		}
+	}
+
+}
+
+func TestExportApprovedSearchNeedsExportPermission(t *testing.T) {
+
+	savedPolicy := policy
+	t.Cleanup(func() { policy = savedPolicy })
+	policy = defaultPolicy
+	policy.Users = map[string]string{"bob": roleAnalyst}
+
+	rawUserInput, err := json.Marshal(UserInput{CompanyCountries: []string{"France"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportApproval := ExportApproval{Id: 1, Requester: "bob", UserInput: rawUserInput, RowsNb: 60000}
+	if err := exportApprovedSearch(exportApproval); err != errApprovedExportNotAllowed {
+		t.Errorf("got %v for a requester who cannot export anymore, want %v", err, errApprovedExportNotAllowed)
+	}
+
+}
@@ -0,0 +1,203 @@
+/*
+export_history.go records which contacts and companies were sent to whom, so
+sales people stop getting the same prospects in consecutive exports.
+Every full search and every export (background or scheduled) with results is
+recorded in the local db with the ids of its rows.
+A search can then exclude the contacts already exported within the last days,
+or in specific past exports. History is shared by the members of the teams of
+the policy, so a contact exported by a teammate is excluded too, but exports of
+other teams are neither excluded nor listed.
+The local db and the remote db are different databases, so ids to exclude are
+read from the local db first and passed to the remote query as an array.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Export stores a past export without its rows
+type Export struct {
+	Id        int       `json:"id"`
+	Owner     string    `json:"owner"`
+	Step      string    `json:"step"`
+	RowsNb    int       `json:"rowsNb"`
+	CreatedOn time.Time `json:"createdOn"`
+}
+
+// hasExportExclusions tells if the user asked to exclude previously exported contacts
+func hasExportExclusions(userInput UserInput) bool {
+	return userInput.ExcludeExportedWithinDays > 0 || len(userInput.ExcludedExportIds) > 0
+}
+
+// resolveExportExclusions reads from the export history of the team of the user the
+// ids of the contacts to exclude and stores them in the user input, so buildSQLReq
+// can exclude them.
+func resolveExportExclusions(ctx context.Context, user string, userInputPtr *UserInput) error {
+
+	userInputPtr.excludedContactIds = nil
+	if !hasExportExclusions(*userInputPtr) {
+		return nil
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT DISTINCT item.contact_id
+		FROM export_item AS item
+		INNER JOIN export ON export.id = item.export_id
+		WHERE item.contact_id IS NOT NULL AND export.owner = ANY($3)
+		AND (($1 > 0 AND export.created_on >= now() - make_interval(days => $1)) OR export.id = ANY($2))`
+	rows, err := db.QueryContext(ctx, sqlStatement, userInputPtr.ExcludeExportedWithinDays, pq.Array(userInputPtr.ExcludedExportIds), pq.Array(getTeamMembers(user)))
+	if err != nil {
+		return CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var contactId int64
+		err = rows.Scan(&contactId)
+		if err != nil {
+			return CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+		}
+		userInputPtr.excludedContactIds = append(userInputPtr.excludedContactIds, contactId)
+	}
+
+	return rows.Err()
+
+}
+
+// insertExport stores an export and the ids of its rows in the export history.
+// step tells how results were delivered: full, export or scheduled.
+func insertExport(ctx context.Context, tx *sql.Tx, owner string, step string, userInput UserInput, compAndContRows []CompAndContRow) (int, error) {
+
+	// Ids are read as text from the remote db. Unknown ids are stored as NULL (0 here).
+	companyIds := make([]int64, len(compAndContRows))
+	contactIds := make([]int64, len(compAndContRows))
+	for i, row := range compAndContRows {
+		companyIds[i], _ = strconv.ParseInt(row.CompId, 10, 64)
+		if row.ContId.Valid {
+			contactIds[i], _ = strconv.ParseInt(row.ContId.String, 10, 64)
+		}
+	}
+
+	userInput.Step = step
+	userInput.QueryId = ""
+	rawUserInput, err := json.Marshal(userInput)
+	if err != nil {
+		return 0, CustErr(err, "Could not marshall to JSON.\nStopping here.")
+	}
+
+	var exportId int
+	sqlStatement := `INSERT INTO export (owner, step, user_input, rows_nb)
+		VALUES ($1, $2, $3, $4) RETURNING id`
+	err = tx.QueryRowContext(ctx, sqlStatement, owner, step, string(rawUserInput), len(compAndContRows)).Scan(&exportId)
+	if err != nil {
+		return 0, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	// One statement for all the rows, however many there are
+	sqlStatement = `INSERT INTO export_item (export_id, company_id, contact_id)
+		SELECT $1, NULLIF(comp_id, 0), NULLIF(cont_id, 0)
+		FROM unnest($2::bigint[], $3::bigint[]) AS item (comp_id, cont_id)`
+	_, err = tx.ExecContext(ctx, sqlStatement, exportId, pq.Array(companyIds), pq.Array(contactIds))
+	if err != nil {
+		return 0, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	return exportId, nil
+
+}
+
+// cancelExport deletes an export reserved by reserveExport whose results could not
+// be delivered, so it does not count in quotas nor exclusions.
+// Errors are only logged.
+func cancelExport(exportId int) {
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		log.Println(CustErr(err, "DB connection failed\nStopping here."))
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `DELETE FROM export WHERE id = $1`
+	_, err = db.Exec(sqlStatement, exportId)
+	if err != nil {
+		log.Println(CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here."))
+	}
+
+}
+
+// ReturnExportsList returns the last exports of the team of the user so users can
+// pick the ones whose contacts should be excluded. Roles which can see the audit
+// trail see the exports of everyone.
+func ReturnExportsList(w http.ResponseWriter, r *http.Request) {
+
+	exports := []Export{}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	user := getRequestUser(r)
+	sqlStatement := `SELECT id, owner, step, rows_nb, created_on
+		FROM export
+		WHERE $1 OR owner = ANY($2)
+		ORDER BY created_on DESC LIMIT 200`
+	rows, err := db.QueryContext(r.Context(), sqlStatement, getUserPermissions(user).CanSeeAudit, pq.Array(getTeamMembers(user)))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var export Export
+		err = rows.Scan(
+			&export.Id,
+			&export.Owner,
+			&export.Step,
+			&export.RowsNb,
+			&export.CreatedOn,
+		)
+		if err != nil {
+			err = CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		exports = append(exports, export)
+	}
+
+	returnedJson, err := json.Marshal(exports)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
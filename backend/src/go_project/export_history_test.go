@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestGetTeamMembers(t *testing.T) {
+
+	savedPolicy := policy
+	t.Cleanup(func() { policy = savedPolicy })
+	policy = defaultPolicy
+	policy.Teams = map[string][]string{
+		"sales":     {"bob", "carol"},
+		"marketing": {"carol", "dave"},
+		"support":   {"erin"},
+	}
+
+	tests := map[string][]string{
+		"bob":   {"bob", "carol"},
+		"carol": {"bob", "carol", "dave"},
+		"erin":  {"erin"},
+		"frank": {"frank"},
+	}
+	for user, want := range tests {
+		if got := getTeamMembers(user); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v for %s, want %v", got, user, want)
+		}
+	}
+
+}
+
+// recordTestExport records an export of one contact and deletes it once the test is over
+func recordTestExport(t *testing.T, owner string, contactId int64) {
+	t.Helper()
+	db := requireLocalDB(t)
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM export WHERE owner = $1`, owner)
+	})
+	var row CompAndContRow
+	row.CompId = "1"
+	row.ContId = nullString(strconv.FormatInt(contactId, 10))
+	_, reason, err := reserveExport(context.Background(), owner, "export", UserInput{}, []CompAndContRow{row})
+	if err != nil || reason != "" {
+		t.Fatalf("export not recorded: %v %s", err, reason)
+	}
+}
+
+func TestExportHistoryIsScopedToTeams(t *testing.T) {
+
+	requireLocalDB(t)
+	alice, bob, carol := randomName(t, "alice-"), randomName(t, "bob-"), randomName(t, "carol-")
+	savedPolicy := policy
+	t.Cleanup(func() { policy = savedPolicy })
+	policy = defaultPolicy
+	policy.Teams = map[string][]string{"sales": {alice, bob}}
+	policy.Users = map[string]string{carol: roleAdmin}
+
+	recordTestExport(t, alice, 900000001)
+	recordTestExport(t, bob, 900000002)
+	recordTestExport(t, carol, 900000003)
+
+	userInput := UserInput{ExcludeExportedWithinDays: 1}
+	err := resolveExportExclusions(context.Background(), alice, &userInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluded := map[int64]bool{}
+	for _, contactId := range userInput.excludedContactIds {
+		excluded[contactId] = true
+	}
+	if !excluded[900000001] || !excluded[900000002] || excluded[900000003] {
+		t.Errorf("got excluded contacts %v, want the ones exported by the team only", userInput.excludedContactIds)
+	}
+
+	// Only admins see the exports of other teams
+	for user, want := range map[string][]string{alice: {alice, bob}, carol: {alice, bob, carol}} {
+		r := httptest.NewRequest("GET", "/get-exports-list", nil)
+		r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, user))
+		w := httptest.NewRecorder()
+		ReturnExportsList(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d", w.Code)
+		}
+		var exports []Export
+		if err := json.Unmarshal(w.Body.Bytes(), &exports); err != nil {
+			t.Fatal(err)
+		}
+		var owners []string
+		for _, export := range exports {
+			if export.Owner == alice || export.Owner == bob || export.Owner == carol {
+				owners = append(owners, export.Owner)
+			}
+		}
+		sort.Strings(owners)
+		sort.Strings(want)
+		if !reflect.DeepEqual(owners, want) {
+			t.Errorf("%s got exports of %v, want %v", user, owners, want)
+		}
+		if user == alice && len(owners) != len(exports) {
+			t.Errorf("%s got exports of other users: %v", user, exports)
+		}
+	}
+
+}
+
+func TestExportHistoryStoresBigintIds(t *testing.T) {
+
+	requireLocalDB(t)
+	alice := randomName(t, "alice-")
+
+	// Ids of the remote db go beyond the integer range
+	const contactId = int64(5000000001)
+	recordTestExport(t, alice, contactId)
+
+	userInput := UserInput{ExcludeExportedWithinDays: 1}
+	err := resolveExportExclusions(context.Background(), alice, &userInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(userInput.excludedContactIds, []int64{contactId}) {
+		t.Errorf("got excluded contacts %v, want %d", userInput.excludedContactIds, contactId)
+	}
+
+}
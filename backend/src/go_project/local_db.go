@@ -0,0 +1,159 @@
+/*
+local_db.go creates the tables the app needs in the local db to store its own
+data (users, saved searches, scheduled exports, export history, audit...).
+The remote db is read only for us so nothing is ever written there.
+Tables are created at startup if they do not exist yet, so deploying a new
+version is enough to get new tables.
+*/
+
+package main
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+)
+
+// Error code of PostgreSQL when a unique constraint is violated
+const pqUniqueViolation = "23505"
+
+// localSchema lists the statements creating the tables of the local db.
+// Every statement must be idempotent since it runs at each startup.
+var localSchema = []string{
+	`CREATE TABLE IF NOT EXISTS saved_search (
+		id serial PRIMARY KEY,
+		name text NOT NULL,
+		owner text NOT NULL,
+		shared boolean NOT NULL DEFAULT false,
+		user_input jsonb NOT NULL,
+		created_on timestamptz NOT NULL DEFAULT now(),
+		updated_on timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS saved_search_owner_idx ON saved_search (owner)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_export (
+		id serial PRIMARY KEY,
+		saved_search_id integer NOT NULL REFERENCES saved_search (id) ON DELETE CASCADE,
+		owner text NOT NULL,
+		cron text NOT NULL,
+		timezone text NOT NULL,
+		delivery text NOT NULL,
+		email text,
+		active boolean NOT NULL DEFAULT true,
+		next_run_on timestamptz,
+		created_on timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_export_run (
+		id serial PRIMARY KEY,
+		scheduled_export_id integer NOT NULL REFERENCES scheduled_export (id) ON DELETE CASCADE,
+		started_on timestamptz NOT NULL DEFAULT now(),
+		ended_on timestamptz,
+		status text NOT NULL,
+		rows_nb integer,
+		file_path text,
+		error text
+	)`,
+	`CREATE INDEX IF NOT EXISTS scheduled_export_run_export_idx ON scheduled_export_run (scheduled_export_id)`,
+	`CREATE TABLE IF NOT EXISTS export (
+		id serial PRIMARY KEY,
+		owner text NOT NULL,
+		step text NOT NULL,
+		user_input jsonb NOT NULL,
+		rows_nb integer NOT NULL,
+		created_on timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS export_created_on_idx ON export (created_on)`,
+	`CREATE TABLE IF NOT EXISTS export_item (
+		export_id integer NOT NULL REFERENCES export (id) ON DELETE CASCADE,
+		company_id bigint,
+		contact_id bigint
+	)`,
+	`CREATE INDEX IF NOT EXISTS export_item_export_idx ON export_item (export_id)`,
+	`CREATE TABLE IF NOT EXISTS search_audit (
+		id serial PRIMARY KEY,
+		user_name text NOT NULL,
+		step text NOT NULL,
+		query_id text NOT NULL DEFAULT '',
+		user_input jsonb NOT NULL,
+		rows_nb integer,
+		delivery text NOT NULL,
+		status_code integer NOT NULL,
+		duration_ms bigint NOT NULL,
+		created_on timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS search_audit_user_created_on_idx ON search_audit (user_name, created_on)`,
+	`CREATE INDEX IF NOT EXISTS search_audit_created_on_idx ON search_audit (created_on)`,
+	`CREATE TABLE IF NOT EXISTS app_user (
+		name text PRIMARY KEY,
+		password_hash text NOT NULL,
+		active boolean NOT NULL DEFAULT true,
+		created_on timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_session (
+		id_hash text PRIMARY KEY,
+		user_name text NOT NULL REFERENCES app_user (name) ON DELETE CASCADE,
+		created_on timestamptz NOT NULL DEFAULT now(),
+		expires_on timestamptz NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_token (
+		id serial PRIMARY KEY,
+		user_name text NOT NULL REFERENCES app_user (name) ON DELETE CASCADE,
+		name text NOT NULL,
+		token_hash text NOT NULL UNIQUE,
+		created_on timestamptz NOT NULL DEFAULT now(),
+		last_used_on timestamptz
+	)`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS idp_role text`,
+	`CREATE TABLE IF NOT EXISTS oidc_state (
+		state_hash text PRIMARY KEY,
+		nonce text NOT NULL,
+		code_verifier text NOT NULL,
+		created_on timestamptz NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS idp_issuer text`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS idp_subject text`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS app_user_idp_idx ON app_user (idp_issuer, idp_subject)`,
+	`ALTER TABLE oidc_state ADD COLUMN IF NOT EXISTS link_user text`,
+	`CREATE TABLE IF NOT EXISTS export_approval (
+		id serial PRIMARY KEY,
+		requester text NOT NULL,
+		user_input jsonb NOT NULL,
+		rows_nb integer NOT NULL,
+		status text NOT NULL DEFAULT 'pending',
+		approver text,
+		comment text,
+		error text,
+		created_on timestamptz NOT NULL DEFAULT now(),
+		decided_on timestamptz
+	)`,
+	`CREATE INDEX IF NOT EXISTS export_approval_status_idx ON export_approval (status)`,
+	`CREATE TABLE IF NOT EXISTS suppression (
+		id serial PRIMARY KEY,
+		kind text NOT NULL,
+		value text NOT NULL,
+		reason text NOT NULL DEFAULT '',
+		created_by text NOT NULL,
+		created_on timestamptz NOT NULL DEFAULT now(),
+		UNIQUE (kind, value)
+	)`,
+	// Ids of the remote db are bigint
+	`ALTER TABLE export_item ALTER COLUMN company_id TYPE bigint, ALTER COLUMN contact_id TYPE bigint`,
+}
+
+// initLocalDB runs the statements of localSchema on the local db
+func initLocalDB() error {
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return CustErr(err, "DB connection failed\nLocal tables not created.")
+	}
+	defer db.Close()
+
+	for _, sqlStatement := range localSchema {
+		_, err = db.Exec(sqlStatement)
+		if err != nil {
+			return CustErr(err, "Following query failed: "+sqlStatement+"\nLocal tables not created.")
+		}
+	}
+
+	return err
+
+}
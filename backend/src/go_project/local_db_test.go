@@ -0,0 +1,31 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// requireLocalDB returns the local db with its tables created, for tests which
+// need PostgreSQL. They are skipped unless TEST_DB=1, and use the local db of
+// LOCAL_DB_HOST like the app.
+func requireLocalDB(t *testing.T) *sql.DB {
+
+	t.Helper()
+	if os.Getenv("TEST_DB") != "1" {
+		t.Skip("Set TEST_DB=1 to run tests needing the local db.")
+	}
+
+	err := initLocalDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+
+}
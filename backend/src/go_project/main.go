@@ -9,6 +9,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/rs/cors"
@@ -37,6 +38,20 @@ const (
 	remoteDbname   = "my_remote_db"
 )
 
+// getRemoteDBInfo builds the connection string of the remote db.
+// statementTimeout (in milliseconds) is sent to PostgreSQL as a run-time parameter
+// so the server itself cancels queries taking too long. 0 means no timeout.
+func getRemoteDBInfo(statementTimeout int) string {
+	return fmt.Sprintf(`host=%s port=%d user=%s password=%s dbname=%s
+        sslmode=disable statement_timeout=%d`, remoteHost, remotePort, remoteUser, remotePassword, remoteDbname, statementTimeout)
+}
+
+// getLocalDBInfo builds the connection string of the local db
+func getLocalDBInfo() string {
+	return fmt.Sprintf(`host=%s port=%d user=%s password=%s dbname=%s
+        sslmode=disable`, localHost, localPort, localUser, localPassword, localDbname)
+}
+
 // getLogFilePath gets log file path from env var set by Docker run
 func getLogFilePath() string {
 	envContent := os.Getenv("LOG_FILE_PATH")
@@ -112,6 +127,33 @@ func main() {
 		log.SetOutput(f)
 	}
 
+	// A broken policy file must not silently give users more permissions than expected,
+	// so do not start at all
+	if err := loadPolicy(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the tables of the local db used by the app itself if needed.
+	// Searches on the remote db still work if it fails so do not stop here.
+	if err := initLocalDB(); err != nil {
+		log.Println(err)
+	}
+
+	// Import users from the .htpasswd file of nginx if set
+	if htpasswdFilePath := getHtpasswdFilePath(); htpasswdFilePath != "" {
+		if err := importHtpasswd(htpasswdFilePath); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Roles given by IdP groups at the last single sign-on of users
+	if err := loadIdpRoles(); err != nil {
+		log.Println(err)
+	}
+
+	// Run scheduled exports in the background
+	go runScheduler()
+
 	// Using gorilla/mux for passing parameters in url like {missionnumber}
 	router := mux.NewRouter()
 
@@ -121,12 +163,29 @@ func main() {
 	// https://stackoverflow.com/questions/40985920/making-golang-gorilla-cors-handler-work
 	// Here is a nice explaination about CORS:
 	// https://husobee.github.io/golang/cors/2015/09/26/cors.html
+	// Custom response headers must be exposed explicitly to be readable by frontend.
+	// Credentials are allowed so the browser sends the session cookie.
 	c := cors.New(cors.Options{
-		AllowedOrigins: []string{getCorsAllowedOrigin()},
+		AllowedOrigins:   []string{getCorsAllowedOrigin()},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		ExposedHeaders:   []string{"X-Cache", "X-Queue-Position", "Retry-After", "X-Results-Capped"},
+		AllowCredentials: true,
 	})
 	handler := c.Handler(router)
 
+	// Every route needs a logged in user, except the public ones (see auth.go)
+	router.Use(requireAuth)
+
 	// Set routes
+	router.HandleFunc("/login", Login).Methods("POST")
+	router.HandleFunc("/logout", Logout).Methods("POST")
+	router.HandleFunc("/oidc/login", OIDCLogin).Methods("GET")
+	router.HandleFunc("/oidc/callback", OIDCCallback).Methods("GET")
+	router.HandleFunc("/get-current-user", ReturnCurrentUser).Methods("GET")
+	router.HandleFunc("/create-api-token", CreateAPIToken).Methods("POST")
+	router.HandleFunc("/get-api-tokens-list", ReturnAPITokensList).Methods("GET")
+	router.HandleFunc("/delete-api-token/api-token-id/{apitokenid}", DeleteAPIToken).Methods("DELETE")
 	router.HandleFunc("/get-contacts-levels-list", ReturnContactsLevelsList).Methods("GET")
 	router.HandleFunc("/get-contacts-functions-list", ReturnContactsFunctionsList).Methods("GET")
 	router.HandleFunc("/get-companies-types-list", ReturnCompaniesTypesList).Methods("GET")
@@ -136,6 +195,30 @@ func main() {
 	router.HandleFunc("/get-countries-list", ReturnCountriesList).Methods("GET")
 	router.HandleFunc("/get-companies-and-contacts", ReturnCompaniesAndContacts).Methods("POST")
 	router.HandleFunc("/get-emails-checked-by-john/mission-number/{missionnumber}", ReturnEmailsCheckedByPA).Methods("GET")
+	router.HandleFunc("/cancel-query/query-id/{queryid}", CancelQuery).Methods("POST")
+	router.HandleFunc("/get-queue-position/query-id/{queryid}", ReturnQueuePosition).Methods("GET")
+	router.HandleFunc("/create-saved-search", CreateSavedSearch).Methods("POST")
+	router.HandleFunc("/get-saved-searches-list", ReturnSavedSearchesList).Methods("GET")
+	router.HandleFunc("/get-saved-search/saved-search-id/{savedsearchid}", ReturnSavedSearch).Methods("GET")
+	router.HandleFunc("/update-saved-search/saved-search-id/{savedsearchid}", UpdateSavedSearch).Methods("PUT")
+	router.HandleFunc("/delete-saved-search/saved-search-id/{savedsearchid}", DeleteSavedSearch).Methods("DELETE")
+	router.HandleFunc("/run-saved-search/saved-search-id/{savedsearchid}", RunSavedSearch).Methods("POST")
+	router.HandleFunc("/create-scheduled-export", CreateScheduledExport).Methods("POST")
+	router.HandleFunc("/get-scheduled-exports-list", ReturnScheduledExportsList).Methods("GET")
+	router.HandleFunc("/delete-scheduled-export/scheduled-export-id/{scheduledexportid}", DeleteScheduledExport).Methods("DELETE")
+	router.HandleFunc("/get-scheduled-export-runs/scheduled-export-id/{scheduledexportid}", ReturnScheduledExportRuns).Methods("GET")
+	router.HandleFunc("/get-exports-list", ReturnExportsList).Methods("GET")
+	router.HandleFunc("/get-quota-status", ReturnQuotaStatus).Methods("GET")
+	router.HandleFunc("/get-export-approvals-list", ReturnExportApprovalsList).Methods("GET")
+	router.HandleFunc("/approve-export/export-approval-id/{exportapprovalid}", ApproveExport).Methods("POST")
+	router.HandleFunc("/reject-export/export-approval-id/{exportapprovalid}", RejectExport).Methods("POST")
+	router.HandleFunc("/get-suppressions-list", ReturnSuppressionsList).Methods("GET")
+	router.HandleFunc("/create-suppression", CreateSuppression).Methods("POST")
+	router.HandleFunc("/update-suppression/suppression-id/{suppressionid}", UpdateSuppression).Methods("PUT")
+	router.HandleFunc("/delete-suppression/suppression-id/{suppressionid}", DeleteSuppression).Methods("DELETE")
+	router.HandleFunc("/import-suppressions", ImportSuppressions).Methods("POST")
+	router.HandleFunc("/create-subject-access-report", CreateSubjectAccessReport).Methods("POST")
+	router.HandleFunc("/get-search-audit", ReturnSearchAudit).Methods("GET")
 
 	// Launch server
 	err := http.ListenAndServe(":8000", handler)
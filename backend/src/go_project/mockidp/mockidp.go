@@ -0,0 +1,207 @@
+/*
+Package mockidp is a mock OpenID Connect identity provider to test single sign-on
+(see oidc.go) locally, in CI or in tests, without network access nor a real IdP.
+
+It logs in a fixed user without asking anything: /authorize redirects straight
+back to the app with a code, /token checks the PKCE code verifier and returns an
+ID token with the user name and groups, signed with RS256 by a key generated when
+the IdP is created and published on /jwks.
+NEVER use it anywhere else than on localhost.
+
+Example with httptest:
+
+	srv := httptest.NewUnstartedServer(nil)
+	idp, err := mockidp.New("http://"+srv.Listener.Addr().String(), "alice", []string{"analysts"})
+	srv.Config.Handler = idp
+	srv.Start()
+*/
+
+package mockidp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Key id of the signing key
+const keyId = "mock"
+
+// authRequest stores what the app sent to /authorize, until the code is exchanged
+type authRequest struct {
+	clientId      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+}
+
+// IdP is a mock identity provider logging in a single user.
+// Subject is the sub claim of the user, its name by default.
+type IdP struct {
+	Issuer     string
+	User       string
+	Subject    string
+	Groups     []string
+	signingKey *rsa.PrivateKey
+	mux        *http.ServeMux
+	mu         sync.Mutex
+	codes      map[string]authRequest
+}
+
+// New creates a mock IdP reachable at the issuer URL, logging in a user
+func New(issuer string, user string, groups []string) (*IdP, error) {
+
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	idp := &IdP{
+		Issuer:     issuer,
+		User:       user,
+		Subject:    user,
+		Groups:     groups,
+		signingKey: signingKey,
+		mux:        http.NewServeMux(),
+		codes:      map[string]authRequest{},
+	}
+	idp.mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	idp.mux.HandleFunc("/jwks", idp.jwks)
+	idp.mux.HandleFunc("/authorize", idp.authorize)
+	idp.mux.HandleFunc("/token", idp.token)
+
+	return idp, nil
+
+}
+
+// ServeHTTP serves the endpoints of the IdP
+func (idp *IdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	idp.mux.ServeHTTP(w, r)
+}
+
+// discovery returns the discovery document
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.Issuer,
+		"authorization_endpoint": idp.Issuer + "/authorize",
+		"token_endpoint":         idp.Issuer + "/token",
+		"jwks_uri":               idp.Issuer + "/jwks",
+	})
+}
+
+// jwks returns the public signing key
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyId,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.signingKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.signingKey.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize logs everyone in as the same user, without any login form
+func (idp *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+
+	params := r.URL.Query()
+	if params.Get("response_type") != "code" || params.Get("code_challenge_method") != "S256" || params.Get("code_challenge") == "" {
+		http.Error(w, "Only the authorization code flow with S256 PKCE is supported.", http.StatusBadRequest)
+		return
+	}
+
+	randomBytes := make([]byte, 16)
+	rand.Read(randomBytes)
+	code := base64.RawURLEncoding.EncodeToString(randomBytes)
+	idp.mu.Lock()
+	idp.codes[code] = authRequest{
+		clientId:      params.Get("client_id"),
+		redirectURI:   params.Get("redirect_uri"),
+		nonce:         params.Get("nonce"),
+		codeChallenge: params.Get("code_challenge"),
+	}
+	idp.mu.Unlock()
+
+	redirectParams := url.Values{}
+	redirectParams.Set("code", code)
+	redirectParams.Set("state", params.Get("state"))
+	http.Redirect(w, r, params.Get("redirect_uri")+"?"+redirectParams.Encode(), http.StatusFound)
+
+}
+
+// token exchanges a code for a signed ID token, once
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	idp.mu.Lock()
+	request, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	hash := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	codeChallenge := base64.RawURLEncoding.EncodeToString(hash[:])
+	if !ok || request.clientId != r.PostFormValue("client_id") || request.redirectURI != r.PostFormValue("redirect_uri") || request.codeChallenge != codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant"}`)
+		return
+	}
+
+	idToken, err := idp.SignToken(map[string]interface{}{
+		"iss":                idp.Issuer,
+		"sub":                idp.Subject,
+		"aud":                request.clientId,
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              request.nonce,
+		"preferred_username": idp.User,
+		"groups":             idp.Groups,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error": "server_error"}`)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": idToken,
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+
+}
+
+// SignToken signs claims with the key of the IdP, so tests can build their own tokens
+func (idp *IdP) SignToken(claims map[string]interface{}) (string, error) {
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": keyId, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.signingKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+
+}
@@ -0,0 +1,624 @@
+/*
+oidc.go lets users log in with the company identity provider (IdP) thanks to
+the OpenID Connect authorization code flow with PKCE, instead of the .htpasswd.
+1. /oidc/login redirects the browser to the IdP with a random state, nonce and
+PKCE code challenge. The state, nonce and code verifier are kept in the local db.
+The hash of the state is also set in a short-lived cookie.
+2. The IdP redirects the browser to /oidc/callback with a code. The state must
+match the cookie, so only the browser which started the login can finish it:
+nobody can log a victim into another account with its own callback URL (login
+CSRF). The code is exchanged for an ID token at the token endpoint with the code
+verifier.
+3. The signature of the ID token is checked with the keys of the IdP (see
+oidc_jwks.go), then its claims (issuer, audience, expiry, nonce), the
+user is created if needed, its role is given by its IdP groups (see groupRoles
+in policy.go), and a session is opened like with the login form.
+IdP users are identified by the issuer and the sub claim of the ID token, never by
+their name: a name picked at the IdP must not give access to the local user with
+the same name. An IdP user whose name is already taken by a local user is refused,
+unless the local user linked its IdP account: logged in with its password, it
+opens /oidc/login?link=true and logs in on the IdP.
+The issuer must use https, except on localhost so it can be tested against a
+local mock IdP (see mock_idp).
+Only the standard library is used.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long users have to log in on the IdP
+const oidcStateTTL = 10 * time.Minute
+
+// Name of the cookie tying the state to the browser which started the login
+const oidcStateCookieName = "oidc_state"
+
+// oidcConfig stores the endpoints of the IdP read from its discovery document
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcTokenRes stores the response of the token endpoint
+type oidcTokenRes struct {
+	IdToken string `json:"id_token"`
+	Error   string `json:"error"`
+}
+
+// oidcClaims stores the standard claims of an ID token we check.
+// Audience can be a string or a list of strings.
+type oidcClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	Nonce     string          `json:"nonce"`
+}
+
+// Discovery document is read once, when the first user logs in
+var oidcDiscovery struct {
+	sync.Mutex
+	config *oidcConfig
+}
+
+// getOIDCIssuer gets the URL of the IdP from env var set by Docker run.
+// If no env var set, single sign-on is disabled.
+func getOIDCIssuer() string {
+	return strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+}
+
+// getOIDCClientId gets the client id of the app registered on the IdP from env var set by Docker run
+func getOIDCClientId() string {
+	return os.Getenv("OIDC_CLIENT_ID")
+}
+
+// getOIDCClientSecret gets the client secret of the app registered on the IdP from env var
+// set by Docker run. It can be empty for public clients since PKCE is used.
+func getOIDCClientSecret() string {
+	return os.Getenv("OIDC_CLIENT_SECRET")
+}
+
+// getOIDCRedirectURL gets the URL of /oidc/callback as seen by browsers, registered on
+// the IdP, from env var set by Docker run.
+// If no env var set, set it to localhost.
+func getOIDCRedirectURL() string {
+	envContent := os.Getenv("OIDC_REDIRECT_URL")
+	if envContent == "" {
+		envContent = "http://127.0.0.1:8000/oidc/callback"
+	}
+	return envContent
+}
+
+// getOIDCScopes gets the scopes asked to the IdP from env var set by Docker run.
+// If no env var set, ask the groups too since roles depend on them.
+func getOIDCScopes() string {
+	envContent := os.Getenv("OIDC_SCOPES")
+	if envContent == "" {
+		envContent = "openid profile email groups"
+	}
+	return envContent
+}
+
+// getOIDCUserClaim gets the claim of the ID token used as user name from env var
+// set by Docker run.
+// If no env var set, set it to preferred_username.
+func getOIDCUserClaim() string {
+	envContent := os.Getenv("OIDC_USER_CLAIM")
+	if envContent == "" {
+		envContent = "preferred_username"
+	}
+	return envContent
+}
+
+// getOIDCGroupsClaim gets the claim of the ID token listing the groups of the user
+// from env var set by Docker run.
+// If no env var set, set it to groups.
+func getOIDCGroupsClaim() string {
+	envContent := os.Getenv("OIDC_GROUPS_CLAIM")
+	if envContent == "" {
+		envContent = "groups"
+	}
+	return envContent
+}
+
+// getPostLoginURL gets where browsers go once logged in from env var set by Docker run.
+// If no env var set, go to the search form of the frontend.
+func getPostLoginURL() string {
+	envContent := os.Getenv("POST_LOGIN_URL")
+	if envContent == "" {
+		envContent = getCorsAllowedOrigin() + "/#/get-companies"
+	}
+	return envContent
+}
+
+// isSecureIssuer tells if the issuer can be trusted through TLS.
+// Plain http is only accepted on localhost for a mock IdP.
+func isSecureIssuer(issuer string) bool {
+	issuerURL, err := url.Parse(issuer)
+	if err != nil {
+		return false
+	}
+	host := issuerURL.Hostname()
+	return issuerURL.Scheme == "https" || host == "localhost" || host == "127.0.0.1"
+}
+
+// getOIDCConfig reads the discovery document of the IdP, once
+func getOIDCConfig(ctx context.Context) (*oidcConfig, error) {
+
+	oidcDiscovery.Lock()
+	defer oidcDiscovery.Unlock()
+
+	if oidcDiscovery.config != nil {
+		return oidcDiscovery.config, nil
+	}
+
+	issuer := getOIDCIssuer()
+	if !isSecureIssuer(issuer) {
+		return nil, errors.New("OIDC issuer must use https: " + issuer)
+	}
+
+	req, err := http.NewRequest("GET", issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, CustErr(err, "Cannot build discovery request.\nStopping here.")
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, CustErr(err, "Cannot get discovery document of the IdP.\nStopping here.")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Discovery document of the IdP returned status %d.", res.StatusCode))
+	}
+
+	var config oidcConfig
+	err = json.NewDecoder(res.Body).Decode(&config)
+	if err != nil {
+		return nil, CustErr(err, "Cannot unmarshall discovery document.\nStopping here.")
+	}
+	if config.Issuer != issuer {
+		return nil, errors.New("Issuer of the discovery document does not match: " + config.Issuer)
+	}
+	if config.JwksURI == "" {
+		return nil, errors.New("Discovery document of the IdP has no jwks_uri, ID tokens cannot be checked.")
+	}
+
+	oidcDiscovery.config = &config
+	return oidcDiscovery.config, nil
+
+}
+
+// pkceChallenge computes the S256 code challenge of a code verifier
+func pkceChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// OIDCLogin redirects the browser to the IdP.
+// With link=true in the query string, the IdP account is linked to the logged in user.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+
+	if getOIDCIssuer() == "" {
+		http.Error(w, "Single sign-on is not enabled.", http.StatusNotFound)
+		return
+	}
+
+	// This route is public so the user linking its account is authenticated here
+	var linkUser sql.NullString
+	if r.URL.Query().Get("link") == "true" {
+		user, err := authenticate(r)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if user == "" {
+			http.Error(w, "Please log in with your password before linking your account.", http.StatusUnauthorized)
+			return
+		}
+		linkUser = sql.NullString{String: user, Valid: true}
+	}
+
+	config, err := getOIDCConfig(r.Context())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Identity provider is not available.", http.StatusBadGateway)
+		return
+	}
+
+	// Random state, nonce and code verifier. Only the hash of the state is stored,
+	// like session ids.
+	state, stateHash, err := newSecret()
+	if err != nil {
+		err = CustErr(err, "Could not generate state.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	nonce, _, err := newSecret()
+	if err != nil {
+		err = CustErr(err, "Could not generate nonce.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	codeVerifier, _, err := newSecret()
+	if err != nil {
+		err = CustErr(err, "Could not generate code verifier.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Logins never finished are cleaned at each login
+	sqlStatement := `DELETE FROM oidc_state WHERE created_on < $1`
+	_, err = db.ExecContext(r.Context(), sqlStatement, time.Now().Add(-oidcStateTTL))
+	if err != nil {
+		log.Println(CustErr(err, "Following query failed: "+sqlStatement+"\nNOT stopping here."))
+	}
+
+	sqlStatement = `INSERT INTO oidc_state (state_hash, nonce, code_verifier, link_user) VALUES ($1, $2, $3, $4)`
+	_, err = db.ExecContext(r.Context(), sqlStatement, stateHash, nonce, codeVerifier, linkUser)
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    stateHash,
+		Path:     "/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", getOIDCClientId())
+	params.Set("redirect_uri", getOIDCRedirectURL())
+	params.Set("scope", getOIDCScopes())
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", pkceChallenge(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, config.AuthorizationEndpoint+separator+params.Encode(), http.StatusFound)
+
+}
+
+// exchangeOIDCCode exchanges the code sent by the IdP for an ID token
+func exchangeOIDCCode(ctx context.Context, config *oidcConfig, code string, codeVerifier string) (string, error) {
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", getOIDCRedirectURL())
+	form.Set("client_id", getOIDCClientId())
+	form.Set("code_verifier", codeVerifier)
+	if clientSecret := getOIDCClientSecret(); clientSecret != "" {
+		form.Set("client_secret", clientSecret)
+	}
+
+	req, err := http.NewRequest("POST", config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", CustErr(err, "Cannot build token request.\nStopping here.")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", CustErr(err, "Token request to the IdP failed.\nStopping here.")
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", CustErr(err, "Cannot read token response.\nStopping here.")
+	}
+	var tokenRes oidcTokenRes
+	err = json.Unmarshal(body, &tokenRes)
+	if err != nil {
+		return "", CustErr(err, "Cannot unmarshall token response.\nStopping here.")
+	}
+	if res.StatusCode != http.StatusOK || tokenRes.IdToken == "" {
+		return "", errors.New(fmt.Sprintf("Token endpoint returned status %d and error %q.", res.StatusCode, tokenRes.Error))
+	}
+
+	return tokenRes.IdToken, nil
+
+}
+
+// parseIdToken reads the claims of an ID token and checks the standard ones.
+// All the claims are returned to read the user name and groups.
+func parseIdToken(idToken string, issuer string, nonce string) (map[string]interface{}, error) {
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID token is not a JWT.")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, CustErr(err, "Cannot decode ID token.\nStopping here.")
+	}
+
+	var claims oidcClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, CustErr(err, "Cannot unmarshall ID token.\nStopping here.")
+	}
+	var allClaims map[string]interface{}
+	err = json.Unmarshal(payload, &allClaims)
+	if err != nil {
+		return nil, CustErr(err, "Cannot unmarshall ID token.\nStopping here.")
+	}
+
+	if claims.Issuer != issuer {
+		return nil, errors.New("Issuer of the ID token does not match: " + claims.Issuer)
+	}
+	var audiences []string
+	if json.Unmarshal(claims.Audience, &audiences) != nil {
+		var audience string
+		json.Unmarshal(claims.Audience, &audience)
+		audiences = []string{audience}
+	}
+	isAudience := false
+	for _, audience := range audiences {
+		if audience == getOIDCClientId() {
+			isAudience = true
+		}
+	}
+	if !isAudience {
+		return nil, errors.New("ID token was not issued for this app.")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("ID token is expired.")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("Nonce of the ID token does not match.")
+	}
+
+	return allClaims, nil
+
+}
+
+// getStringClaims reads a claim which can be a string or a list of strings
+func getStringClaims(claims map[string]interface{}, name string) []string {
+	switch claim := claims[name].(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		var values []string
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Errors of findIdpUser telling the user why it cannot log in
+var (
+	errIdpUserNameTaken = errors.New("Name of the IdP user is taken by a local user.")
+	errIdpAccountLinked = errors.New("This identity provider account is already linked to another user.")
+)
+
+// findIdpUser returns the local user of an IdP account, identified by the issuer
+// and the subject, and tells if it is active. The role given by the IdP groups is
+// stored for the next startups.
+// If linkUser is set, the IdP account is linked to this existing user.
+// Otherwise an IdP account seen for the first time gets a new user named after
+// its name claim. A local user with the same name is never reused, it has to
+// link its IdP account itself.
+func findIdpUser(ctx context.Context, db *sql.DB, issuer string, subject string, name string, linkUser sql.NullString, idpRole string) (string, bool, error) {
+
+	var user string
+	var isActive bool
+
+	if linkUser.Valid {
+		sqlStatement := `UPDATE app_user SET idp_issuer = $1, idp_subject = $2, idp_role = $3
+			WHERE name = $4 RETURNING name, active`
+		err := db.QueryRowContext(ctx, sqlStatement, issuer, subject, idpRole, linkUser.String).Scan(&user, &isActive)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+			return "", false, errIdpAccountLinked
+		}
+		if err != nil {
+			return "", false, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		}
+		return user, isActive, nil
+	}
+
+	sqlStatement := `UPDATE app_user SET idp_role = $3
+		WHERE idp_issuer = $1 AND idp_subject = $2 RETURNING name, active`
+	err := db.QueryRowContext(ctx, sqlStatement, issuer, subject, idpRole).Scan(&user, &isActive)
+	if err == nil {
+		return user, isActive, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", false, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	// Users logging in with the IdP have no password
+	sqlStatement = `INSERT INTO app_user (name, password_hash, idp_role, idp_issuer, idp_subject)
+		VALUES ($1, '', $2, $3, $4)
+		ON CONFLICT (name) DO NOTHING
+		RETURNING name, active`
+	err = db.QueryRowContext(ctx, sqlStatement, name, idpRole, issuer, subject).Scan(&user, &isActive)
+	if err == sql.ErrNoRows {
+		return "", false, errIdpUserNameTaken
+	}
+	if err != nil {
+		return "", false, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	return user, isActive, nil
+
+}
+
+// OIDCCallback finishes the login once the IdP redirects the browser back to us
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+
+	if getOIDCIssuer() == "" {
+		http.Error(w, "Single sign-on is not enabled.", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	if idpErr := params.Get("error"); idpErr != "" {
+		log.Println("IdP refused the login: " + idpErr + " " + params.Get("error_description"))
+		http.Error(w, "Login refused by the identity provider.", http.StatusUnauthorized)
+		return
+	}
+
+	// The state must come from the browser which started the login. The cookie
+	// is not needed anymore, whatever happens next.
+	stateHash := hashSecret(params.Get("state"))
+	stateCookie, err := r.Cookie(oidcStateCookieName)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err != nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(stateHash)) != 1 {
+		log.Println("OIDC state does not match the state cookie of the browser.\nStopping here.")
+		http.Error(w, "Login expired, please try again.", http.StatusBadRequest)
+		return
+	}
+
+	config, err := getOIDCConfig(r.Context())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Identity provider is not available.", http.StatusBadGateway)
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// A state can only be used once
+	var nonce, codeVerifier string
+	var linkUser sql.NullString
+	sqlStatement := `DELETE FROM oidc_state WHERE state_hash = $1 AND created_on >= $2
+		RETURNING nonce, code_verifier, link_user`
+	err = db.QueryRowContext(r.Context(), sqlStatement, stateHash, time.Now().Add(-oidcStateTTL)).Scan(&nonce, &codeVerifier, &linkUser)
+	if err == sql.ErrNoRows {
+		log.Println("Unknown or expired OIDC state.\nStopping here.")
+		http.Error(w, "Login expired, please try again.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	idToken, err := exchangeOIDCCode(r.Context(), config, params.Get("code"), codeVerifier)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Login refused by the identity provider.", http.StatusUnauthorized)
+		return
+	}
+	err = verifyIdTokenSignature(r.Context(), config, idToken)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Login refused by the identity provider.", http.StatusUnauthorized)
+		return
+	}
+	claims, err := parseIdToken(idToken, config.Issuer, nonce)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Login refused by the identity provider.", http.StatusUnauthorized)
+		return
+	}
+
+	subjects := getStringClaims(claims, "sub")
+	userClaims := getStringClaims(claims, getOIDCUserClaim())
+	if len(subjects) == 0 || subjects[0] == "" || len(userClaims) == 0 || userClaims[0] == "" {
+		log.Println("ID token has no sub or no " + getOIDCUserClaim() + " claim.\nStopping here.")
+		http.Error(w, "Login refused by the identity provider.", http.StatusUnauthorized)
+		return
+	}
+	idpRole := roleFromGroups(getStringClaims(claims, getOIDCGroupsClaim()))
+
+	user, isActive, err := findIdpUser(r.Context(), db, config.Issuer, subjects[0], userClaims[0], linkUser, idpRole)
+	if err == errIdpUserNameTaken {
+		log.Println("IdP user cannot log in since its name is taken by a local user: " + userClaims[0])
+		http.Error(w, "An account named "+userClaims[0]+" already exists. Log in with its password then "+
+			"open /oidc/login?link=true to link it to your identity provider account.", http.StatusConflict)
+		return
+	}
+	if err == errIdpAccountLinked {
+		log.Println("IdP account already linked to another user, cannot link it to: " + linkUser.String)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !isActive {
+		log.Println("Disabled user tried to log in with the IdP: " + user)
+		http.Error(w, "Your account is disabled.", http.StatusForbidden)
+		return
+	}
+	setIdpRole(user, idpRole)
+
+	err = openSession(r.Context(), db, user, w)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, getPostLoginURL(), http.StatusFound)
+
+}
@@ -0,0 +1,292 @@
+/*
+oidc_jwks.go checks the signature of ID tokens with the public keys of the IdP
+(JSON Web Key Set, read from the jwks_uri of its discovery document).
+RSA (RS256, RS384, RS512) and ECDSA (ES256, ES384, ES512) signatures are
+supported, unsigned tokens (alg none) and shared secrets (HS256...) are refused.
+Keys are read once and read again when a token is signed with an unknown key id,
+since IdPs rotate their keys, at most once per minute so forged tokens cannot be
+used to flood the IdP.
+Only the standard library is used.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum time between two reads of the keys of the IdP
+const oidcKeysMinRefresh = time.Minute
+
+// jsonWebKey stores a public key of the IdP, RSA (n, e) or elliptic curve (crv, x, y)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtHeader stores the header of an ID token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Signature algorithms supported, with their hash and the type of key they need
+var jwtAlgorithms = map[string]struct {
+	hash crypto.Hash
+	kty  string
+}{
+	"RS256": {crypto.SHA256, "RSA"},
+	"RS384": {crypto.SHA384, "RSA"},
+	"RS512": {crypto.SHA512, "RSA"},
+	"ES256": {crypto.SHA256, "EC"},
+	"ES384": {crypto.SHA384, "EC"},
+	"ES512": {crypto.SHA512, "EC"},
+}
+
+// Curves of elliptic curve keys
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// Keys of the IdP by key id, read from its JWKS
+var oidcKeys struct {
+	sync.Mutex
+	keys    map[string]crypto.PublicKey
+	readOn  time.Time
+	jwksURI string
+}
+
+// keyType returns the type of a public key as written in JSON Web Keys
+func keyType(key crypto.PublicKey) string {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "EC"
+	}
+	return ""
+}
+
+// decodeBigInt decodes a base64url number of a JSON Web Key
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(bytes) == 0 {
+		return nil, errors.New("Number of a JSON Web Key is not valid base64url.")
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// publicKey converts a JSON Web Key to a public key
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("Exponent of RSA key is not valid: " + jwk.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := jwkCurves[jwk.Crv]
+		if !ok {
+			return nil, errors.New("Curve of key is not supported: " + jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("Point of EC key is not on its curve: " + jwk.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("Type of key is not supported: " + jwk.Kty)
+
+}
+
+// readOIDCKeys reads the signing keys of the IdP.
+// Keys which cannot be used are skipped, some IdPs publish encryption keys too.
+func readOIDCKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, error) {
+
+	req, err := http.NewRequest("GET", jwksURI, nil)
+	if err != nil {
+		return nil, CustErr(err, "Cannot build JWKS request.\nStopping here.")
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, CustErr(err, "Cannot get keys of the IdP.\nStopping here.")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Keys of the IdP returned status %d.", res.StatusCode))
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&jwks)
+	if err != nil {
+		return nil, CustErr(err, "Cannot unmarshall keys of the IdP.\nStopping here.")
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("IdP publishes no signing key we can use.")
+	}
+
+	return keys, nil
+
+}
+
+// findOIDCKey returns the key of the IdP with a key id and a type.
+// Without key id, the IdP must have a single key of this type.
+// Keys are read again if the key is unknown, in case the IdP rotated its keys.
+func findOIDCKey(ctx context.Context, jwksURI string, kid string, kty string) (crypto.PublicKey, error) {
+
+	oidcKeys.Lock()
+	defer oidcKeys.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if oidcKeys.keys == nil || oidcKeys.jwksURI != jwksURI || (attempt == 1 && time.Since(oidcKeys.readOn) >= oidcKeysMinRefresh) {
+			keys, err := readOIDCKeys(ctx, jwksURI)
+			if err != nil {
+				return nil, err
+			}
+			oidcKeys.keys = keys
+			oidcKeys.jwksURI = jwksURI
+			oidcKeys.readOn = time.Now()
+		}
+
+		if kid != "" {
+			if key, ok := oidcKeys.keys[kid]; ok && keyType(key) == kty {
+				return key, nil
+			}
+			continue
+		}
+		var found crypto.PublicKey
+		keysNb := 0
+		for _, key := range oidcKeys.keys {
+			if keyType(key) == kty {
+				found = key
+				keysNb++
+			}
+		}
+		if keysNb == 1 {
+			return found, nil
+		}
+	}
+
+	return nil, errors.New("No key of the IdP matches the ID token: " + kid)
+
+}
+
+// verifySignature checks the signature of signed content with a public key
+func verifySignature(key crypto.PublicKey, hash crypto.Hash, signed string, signature []byte) error {
+
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		// ECDSA signatures of JWTs are r and s concatenated, with the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("ECDSA signature has a wrong size.")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("ECDSA signature is not valid.")
+		}
+		return nil
+	}
+
+	return errors.New("Type of key is not supported.")
+
+}
+
+// verifyIdTokenSignature checks that an ID token was signed by the IdP
+func verifyIdTokenSignature(ctx context.Context, config *oidcConfig, idToken string) error {
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return errors.New("ID token is not a JWT.")
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return CustErr(err, "Cannot decode header of ID token.\nStopping here.")
+	}
+	var header jwtHeader
+	err = json.Unmarshal(headerJson, &header)
+	if err != nil {
+		return CustErr(err, "Cannot unmarshall header of ID token.\nStopping here.")
+	}
+	algorithm, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return errors.New("Signature algorithm of ID token is not supported: " + header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return CustErr(err, "Cannot decode signature of ID token.\nStopping here.")
+	}
+
+	key, err := findOIDCKey(ctx, config.JwksURI, header.Kid, algorithm.kty)
+	if err != nil {
+		return err
+	}
+	err = verifySignature(key, algorithm.hash, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return CustErr(err, "Signature of ID token is not valid.\nStopping here.")
+	}
+
+	return nil
+
+}
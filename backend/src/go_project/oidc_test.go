@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"go_project/mockidp"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startMockIdP starts the mock IdP and points the app to it
+func startMockIdP(t *testing.T, user string) *mockidp.IdP {
+
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	idp, err := mockidp.New("http://"+srv.Listener.Addr().String(), user, []string{"analysts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.Handler = idp
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OIDC_ISSUER", idp.Issuer)
+	t.Setenv("OIDC_CLIENT_ID", "mock")
+	t.Setenv("COOKIE_SECURE", "false")
+	resetOIDCCaches()
+	t.Cleanup(resetOIDCCaches)
+
+	return idp
+
+}
+
+// resetOIDCCaches forgets the discovery document and the keys of the previous IdP
+func resetOIDCCaches() {
+	oidcDiscovery.Lock()
+	oidcDiscovery.config = nil
+	oidcDiscovery.Unlock()
+	oidcKeys.Lock()
+	oidcKeys.keys = nil
+	oidcKeys.Unlock()
+}
+
+// startApp starts the routes of the login flow behind the auth middleware, like main
+func startApp(t *testing.T) *httptest.Server {
+
+	t.Helper()
+	router := mux.NewRouter()
+	router.Use(requireAuth)
+	router.HandleFunc("/oidc/login", OIDCLogin).Methods("GET")
+	router.HandleFunc("/oidc/callback", OIDCCallback).Methods("GET")
+	router.HandleFunc("/get-current-user", ReturnCurrentUser).Methods("GET")
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OIDC_REDIRECT_URL", srv.URL+"/oidc/callback")
+	t.Setenv("POST_LOGIN_URL", srv.URL+"/get-current-user")
+
+	return srv
+
+}
+
+// newBrowser returns a client keeping cookies like a browser.
+// If followRedirects is false, redirects are returned instead of being followed.
+func newBrowser(t *testing.T, followRedirects bool) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	if !followRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// randomName returns a user name no other test uses
+func randomName(t *testing.T, prefix string) string {
+	t.Helper()
+	secret, _, err := newSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix + strings.ToLower(secret[:12])
+}
+
+// mustParseURL parses a URL of a test server
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsedURL
+}
+
+// deleteUser removes a user created by a test
+func deleteUser(t *testing.T, user string) {
+	t.Helper()
+	db := requireLocalDB(t)
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM app_user WHERE name = $1`, user)
+	})
+}
+
+// loginWithIdP runs the whole login flow and returns the user the app logged in,
+// or the status code if the login failed
+func loginWithIdP(t *testing.T, browser *http.Client, loginURL string) (string, int) {
+
+	t.Helper()
+	res, err := browser.Get(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", res.StatusCode
+	}
+
+	var currentUser CurrentUser
+	err = json.NewDecoder(res.Body).Decode(&currentUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return currentUser.Name, res.StatusCode
+
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+
+	requireLocalDB(t)
+	user := randomName(t, "oidc-user-")
+	deleteUser(t, user)
+	startMockIdP(t, user)
+	app := startApp(t)
+
+	// Not logged in yet
+	browser := newBrowser(t, true)
+	res, err := browser.Get(app.URL + "/get-current-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d before login, want 401", res.StatusCode)
+	}
+
+	// login, IdP, callback, then the session cookie is accepted by requireAuth
+	loggedUser, statusCode := loginWithIdP(t, browser, app.URL+"/oidc/login")
+	if statusCode != http.StatusOK || loggedUser != user {
+		t.Fatalf("got user %q and status %d, want %q and 200", loggedUser, statusCode, user)
+	}
+	res, err = browser.Get(app.URL + "/get-current-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d with the session cookie, want 200", res.StatusCode)
+	}
+
+	// Logging in again gets the same user
+	loggedUser, statusCode = loginWithIdP(t, newBrowser(t, true), app.URL+"/oidc/login")
+	if statusCode != http.StatusOK || loggedUser != user {
+		t.Fatalf("got user %q and status %d at the second login, want %q and 200", loggedUser, statusCode, user)
+	}
+
+}
+
+func TestOIDCCallbackNeedsTheBrowserWhichStartedTheLogin(t *testing.T) {
+
+	requireLocalDB(t)
+	user := randomName(t, "oidc-user-")
+	deleteUser(t, user)
+	startMockIdP(t, user)
+	app := startApp(t)
+
+	// The attacker starts a login and stops at the callback URL
+	attacker := newBrowser(t, false)
+	res, err := attacker.Get(app.URL + "/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	res, err = attacker.Get(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	callbackURL := res.Header.Get("Location")
+	if !strings.HasPrefix(callbackURL, app.URL+"/oidc/callback?") {
+		t.Fatalf("IdP redirected to %q, want the callback", callbackURL)
+	}
+
+	// The victim opens it
+	res, err = newBrowser(t, false).Get(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d in another browser, want 400", res.StatusCode)
+	}
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			t.Fatal("another browser got a session")
+		}
+	}
+
+}
+
+func TestOIDCLoginDoesNotReuseLocalUsers(t *testing.T) {
+
+	db := requireLocalDB(t)
+	user := randomName(t, "local-user-")
+	deleteUser(t, user)
+	_, err := db.Exec(`INSERT INTO app_user (name, password_hash) VALUES ($1, $2)`, user, string(dummyPasswordHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone picks the name of the local user at the IdP
+	idp := startMockIdP(t, user)
+	idp.Subject = randomName(t, "subject-")
+	app := startApp(t)
+
+	_, statusCode := loginWithIdP(t, newBrowser(t, true), app.URL+"/oidc/login")
+	if statusCode != http.StatusConflict {
+		t.Fatalf("got status %d, want 409", statusCode)
+	}
+
+	// The local user links its IdP account once logged in with its password
+	browser := newBrowser(t, true)
+	sessionId, sessionIdHash, err := newSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO user_session (id_hash, user_name, expires_on) VALUES ($1, $2, $3)`,
+		sessionIdHash, user, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser.Jar.SetCookies(mustParseURL(t, app.URL), []*http.Cookie{{Name: sessionCookieName, Value: sessionId}})
+	loggedUser, statusCode := loginWithIdP(t, browser, app.URL+"/oidc/login?link=true")
+	if statusCode != http.StatusOK || loggedUser != user {
+		t.Fatalf("got user %q and status %d when linking, want %q and 200", loggedUser, statusCode, user)
+	}
+
+	// Then the IdP account logs in as the local user
+	loggedUser, statusCode = loginWithIdP(t, newBrowser(t, true), app.URL+"/oidc/login")
+	if statusCode != http.StatusOK || loggedUser != user {
+		t.Fatalf("got user %q and status %d once linked, want %q and 200", loggedUser, statusCode, user)
+	}
+
+	// Linking needs a logged in user
+	_, statusCode = loginWithIdP(t, newBrowser(t, true), app.URL+"/oidc/login?link=true")
+	if statusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d when linking without session, want 401", statusCode)
+	}
+
+}
+
+func TestVerifyIdTokenSignature(t *testing.T) {
+
+	idp := startMockIdP(t, "alice")
+	config, err := getOIDCConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{"iss": idp.Issuer, "sub": "alice"}
+	idToken, err := idp.SignToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyIdTokenSignature(context.Background(), config, idToken); err != nil {
+		t.Fatalf("token signed by the IdP refused: %v", err)
+	}
+
+	parts := strings.Split(idToken, ".")
+	encode := func(value string) string { return base64.RawURLEncoding.EncodeToString([]byte(value)) }
+	forged := map[string]string{
+		"other payload":   parts[0] + "." + encode(`{"sub":"admin"}`) + "." + parts[2],
+		"no signature":    parts[0] + "." + parts[1] + ".",
+		"alg none":        encode(`{"alg":"none"}`) + "." + parts[1] + ".",
+		"shared secret":   encode(`{"alg":"HS256","kid":"mock"}`) + "." + parts[1] + "." + parts[2],
+		"unknown key id":  encode(`{"alg":"RS256","kid":"other"}`) + "." + parts[1] + "." + parts[2],
+		"not a jwt":       parts[1],
+		"invalid base64":  parts[0] + "." + parts[1] + ".%%%",
+		"key of a tester": signWithOtherKey(t, claims),
+	}
+	for name, token := range forged {
+		if verifyIdTokenSignature(context.Background(), config, token) == nil {
+			t.Errorf("%s: forged token accepted", name)
+		}
+	}
+
+}
+
+// signWithOtherKey signs claims with a key the IdP does not publish
+func signWithOtherKey(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	other, err := mockidp.New("http://127.0.0.1", "mallory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := other.SignToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParseIdToken(t *testing.T) {
+
+	idp := startMockIdP(t, "alice")
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   idp.Issuer,
+			"sub":   "alice",
+			"aud":   "mock",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": "nonce",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		change  func(map[string]interface{})
+		isValid bool
+	}{
+		{"valid", func(claims map[string]interface{}) {}, true},
+		{"audience list", func(claims map[string]interface{}) { claims["aud"] = []string{"other", "mock"} }, true},
+		{"other issuer", func(claims map[string]interface{}) { claims["iss"] = "http://evil" }, false},
+		{"other audience", func(claims map[string]interface{}) { claims["aud"] = "other" }, false},
+		{"expired", func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }, false},
+		{"other nonce", func(claims map[string]interface{}) { claims["nonce"] = "replayed" }, false},
+	}
+	for _, test := range tests {
+		claims := valid()
+		test.change(claims)
+		idToken, err := idp.SignToken(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseIdToken(idToken, idp.Issuer, "nonce")
+		if (err == nil) != test.isValid {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+
+}
@@ -0,0 +1,108 @@
+/*
+pii_masking.go masks emails and phone numbers of the results for roles without
+PII rights, so junior staff can explore segments without seeing raw contact data.
+Masked fields are set per role in the policy (see policy.go), with the JSON names
+of the fields: contEmail, contTelephone, compEmail, compTelephone.
+Masking is applied to both JSON and CSV output:
+- emails keep their first letter and domain: j***@domain.com. Each email of
+company fields holding several emails is masked on its own.
+- phone numbers keep their first 3 and last 2 digits: +33 612345678 becomes
++33 6******78
+*/
+
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Separator of multiple values aggregated in a single field (see buildSQLReq)
+const multiValuesSeparator = "¤"
+
+// Fields which can be masked, with how to mask them and where they are in a row
+var maskableFields = map[string]struct {
+	mask  func(string) string
+	field func(*CompAndContRow) *JsonNullString
+}{
+	"contEmail":     {maskEmail, func(row *CompAndContRow) *JsonNullString { return &row.ContEmail }},
+	"contTelephone": {maskPhone, func(row *CompAndContRow) *JsonNullString { return &row.ContTelephone }},
+	"compEmail":     {maskEmail, func(row *CompAndContRow) *JsonNullString { return &row.CompEmail }},
+	"compTelephone": {maskPhone, func(row *CompAndContRow) *JsonNullString { return &row.CompTelephone }},
+}
+
+// maskEmail keeps the first letter and the domain of an email: j***@domain.com.
+// Several emails aggregated in one field (see buildSQLReq) are masked one by one.
+func maskEmail(emails string) string {
+	values := strings.Split(emails, multiValuesSeparator)
+	for i, email := range values {
+		at := strings.LastIndex(email, "@")
+		if at < 1 {
+			values[i] = "***"
+			continue
+		}
+		firstLetter, _ := utf8.DecodeRuneInString(email)
+		values[i] = string(firstLetter) + "***" + email[at:]
+	}
+	return strings.Join(values, multiValuesSeparator)
+}
+
+// maskPhone replaces the digits of a phone number with stars, except the first 3
+// and the last 2 ones. Short numbers only keep the last 2 digits.
+// Spaces and other separators are kept: +33 6 12 34 56 78 becomes +33 6 ** ** ** 78
+func maskPhone(phone string) string {
+
+	digitsNb := 0
+	for _, char := range phone {
+		if unicode.IsDigit(char) {
+			digitsNb++
+		}
+	}
+	keptFirst := 3
+	if digitsNb <= 7 {
+		keptFirst = 0
+	}
+
+	var masked strings.Builder
+	digitIndex := 0
+	for _, char := range phone {
+		if !unicode.IsDigit(char) {
+			masked.WriteRune(char)
+			continue
+		}
+		if digitIndex < keptFirst || digitIndex >= digitsNb-2 {
+			masked.WriteRune(char)
+		} else {
+			masked.WriteRune('*')
+		}
+		digitIndex++
+	}
+
+	return masked.String()
+
+}
+
+// maskRows masks the given fields of the rows.
+// Rows may come from cache so they are copied instead of being modified.
+func maskRows(compAndContRows []CompAndContRow, maskedFields []string) []CompAndContRow {
+
+	if len(maskedFields) == 0 {
+		return compAndContRows
+	}
+
+	maskedRows := make([]CompAndContRow, len(compAndContRows))
+	copy(maskedRows, compAndContRows)
+	for i := range maskedRows {
+		for _, fieldName := range maskedFields {
+			maskable := maskableFields[fieldName]
+			field := maskable.field(&maskedRows[i])
+			if field.Valid && field.String != "" {
+				field.String = maskable.mask(field.String)
+			}
+		}
+	}
+
+	return maskedRows
+
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMaskEmail(t *testing.T) {
+
+	tests := map[string]string{
+		"john.doe@example.com":             "j***@example.com",
+		"élodie@example.fr":                "é***@example.fr",
+		"info@acme.com¤sales@acme.com":     "i***@acme.com¤s***@acme.com",
+		"info@acme.com¤not an email":       "i***@acme.com¤***",
+		"@example.com":                     "***",
+		"weird\"@name\"@example.com":       "w***@example.com",
+		"ørjan@example.no¤¤åsa@example.se": "ø***@example.no¤***¤å***@example.se",
+		"":                                 "***",
+	}
+	for email, want := range tests {
+		if got := maskEmail(email); got != want {
+			t.Errorf("got %q for %q, want %q", got, email, want)
+		}
+	}
+
+}
+
+func TestMaskPhone(t *testing.T) {
+
+	tests := map[string]string{
+		"+33 6 12 34 56 78": "+33 6 ** ** ** 78",
+		"+33612345678":      "+336******78",
+		"1234567":           "*****67",
+		"":                  "",
+	}
+	for phone, want := range tests {
+		if got := maskPhone(phone); got != want {
+			t.Errorf("got %q for %q, want %q", got, phone, want)
+		}
+	}
+
+}
+
+func TestMaskRows(t *testing.T) {
+
+	var row CompAndContRow
+	row.CompEmail = nullString("info@acme.com¤sales@acme.com")
+	row.ContEmail = nullString("john@acme.com")
+	row.ContTelephone = nullString("+33612345678")
+	rows := []CompAndContRow{row}
+
+	maskedRows := maskRows(rows, []string{"compEmail", "contTelephone"})
+	if got := maskedRows[0].CompEmail.String; got != "i***@acme.com¤s***@acme.com" {
+		t.Errorf("got company emails %q", got)
+	}
+	if got := maskedRows[0].ContTelephone.String; got != "+336******78" {
+		t.Errorf("got contact telephone %q", got)
+	}
+	if got := maskedRows[0].ContEmail.String; got != "john@acme.com" {
+		t.Errorf("contact email not in masked fields was masked: %q", got)
+	}
+	if rows[0].CompEmail.String != "info@acme.com¤sales@acme.com" {
+		t.Error("rows given were modified")
+	}
+
+}
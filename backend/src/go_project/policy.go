@@ -0,0 +1,300 @@
+/*
+policy.go decides what each user is allowed to do. Not everyone should be able
+to export 100,000 contacts with emails.
+Every user has a role and every role has permissions:
+- steps: the steps of a search the role can run (estimate, dry-run, count, full)
+- maxRows: max number of rows returned in JSON by the full step, 0 means no cap.
+Above it, the first maxRows rows are returned with an X-Results-Capped header.
+- canExport: results can be sent by email or stored as files (export step,
+big full results, background and scheduled exports)
+- canSeeAudit: the search audit trail can be read
+- canSeeMissions: the emails checked by John can be read
+- canApproveExports: very large exports of other users can be approved or
+rejected (see export_approvals.go)
+- canManageSuppressions: the suppression list can be read and changed (see
+suppressions.go)
+- canHandleSubjectRequests: GDPR access reports can be created and people added
+to the suppression list with them (see subject_access.go)
+- maskedFields: fields of the results masked for the role (see pii_masking.go)
+The default policy has 4 roles: viewer, analyst, exporter and admin. It can be
+replaced by a JSON policy file with the same structure as Policy, which also
+tells the role of each user. Users logging in with the IdP (see oidc.go) get the
+role of the first of their groups found in groupRoles. Other users get the
+default role. Roles set for a user in the policy file always win.
+The policy file also sets teams, export quotas (see quotas.go) and the email
+address of users, where their export approval notifications are sent.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	_ "github.com/lib/pq"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"sync"
+)
+
+// Roles of the default policy
+const (
+	roleViewer   = "viewer"
+	roleAnalyst  = "analyst"
+	roleExporter = "exporter"
+	roleAdmin    = "admin"
+)
+
+// RolePermissions stores what a role is allowed to do
+type RolePermissions struct {
+	Steps                    []string `json:"steps"`
+	MaxRows                  int      `json:"maxRows"`
+	CanExport                bool     `json:"canExport"`
+	CanSeeAudit              bool     `json:"canSeeAudit"`
+	CanSeeMissions           bool     `json:"canSeeMissions"`
+	CanApproveExports        bool     `json:"canApproveExports"`
+	CanManageSuppressions    bool     `json:"canManageSuppressions"`
+	CanHandleSubjectRequests bool     `json:"canHandleSubjectRequests"`
+	MaskedFields             []string `json:"maskedFields"`
+}
+
+// GroupRole gives a role to the members of an IdP group
+type GroupRole struct {
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+// Policy stores the permissions of every role and the role of every user.
+// GroupRoles are ordered: the first group a user is member of gives its role.
+type Policy struct {
+	DefaultRole string                     `json:"defaultRole"`
+	Roles       map[string]RolePermissions `json:"roles"`
+	Users       map[string]string          `json:"users"`
+	GroupRoles  []GroupRole                `json:"groupRoles"`
+	Teams       map[string][]string        `json:"teams"`
+	Quotas      QuotaPolicy                `json:"quotas"`
+	Emails      map[string]string          `json:"emails"`
+}
+
+// Fields with contact data, masked by default for roles which cannot export
+var piiFields = []string{"contEmail", "contTelephone", "compEmail", "compTelephone"}
+
+// Policy used if no policy file set. Nobody is admin until a policy file says so.
+var defaultPolicy = Policy{
+	DefaultRole: roleViewer,
+	Roles: map[string]RolePermissions{
+		roleViewer: {
+			Steps:        []string{"estimate", "count"},
+			MaskedFields: piiFields,
+		},
+		roleAnalyst: {
+			Steps:        []string{"estimate", "dry-run", "count", "full"},
+			MaxRows:      1000,
+			MaskedFields: piiFields,
+		},
+		roleExporter: {
+			Steps:     []string{"estimate", "dry-run", "count", "full"},
+			CanExport: true,
+		},
+		roleAdmin: {
+			Steps:                    []string{"estimate", "dry-run", "count", "full"},
+			CanExport:                true,
+			CanSeeAudit:              true,
+			CanSeeMissions:           true,
+			CanApproveExports:        true,
+			CanManageSuppressions:    true,
+			CanHandleSubjectRequests: true,
+		},
+	},
+	Users: map[string]string{},
+}
+
+// Policy in use, loaded at startup
+var policy = defaultPolicy
+
+// Roles given by the IdP groups of users at their last login, loaded at startup
+var idpRoles = struct {
+	sync.RWMutex
+	roles map[string]string
+}{roles: map[string]string{}}
+
+// getPolicyFilePath gets the path of the JSON policy file from env var set by Docker run.
+// If no env var set, the default policy is used.
+func getPolicyFilePath() string {
+	return os.Getenv("POLICY_FILE_PATH")
+}
+
+// validatePolicy checks that a policy only refers to roles and steps which exist
+func validatePolicy(p Policy) error {
+
+	if _, ok := p.Roles[p.DefaultRole]; !ok {
+		return errors.New("Default role of the policy does not exist: " + p.DefaultRole)
+	}
+	for roleName, role := range p.Roles {
+		for _, step := range role.Steps {
+			if step != "estimate" && step != "dry-run" && step != "count" && step != "full" {
+				return errors.New("Step of role " + roleName + " should be either estimate, dry-run, count or full: " + step)
+			}
+		}
+		if role.MaxRows < 0 {
+			return errors.New("Max rows of role " + roleName + " should not be negative.")
+		}
+		for _, fieldName := range role.MaskedFields {
+			if _, ok := maskableFields[fieldName]; !ok {
+				return errors.New("Masked field of role " + roleName + " cannot be masked: " + fieldName)
+			}
+		}
+	}
+	for user, role := range p.Users {
+		if _, ok := p.Roles[role]; !ok {
+			return errors.New("Role of user " + user + " does not exist: " + role)
+		}
+	}
+	for user, email := range p.Emails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return errors.New("Email of user " + user + " is not valid: " + email)
+		}
+	}
+	for _, groupRole := range p.GroupRoles {
+		if _, ok := p.Roles[groupRole.Role]; !ok {
+			return errors.New("Role of group " + groupRole.Group + " does not exist: " + groupRole.Role)
+		}
+	}
+
+	return validateQuotaPolicy(p)
+
+}
+
+// loadPolicy loads the policy file if set, otherwise keeps the default policy
+func loadPolicy() error {
+
+	policyFilePath := getPolicyFilePath()
+	if policyFilePath == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(policyFilePath)
+	if err != nil {
+		return CustErr(err, "Cannot read policy file.\nStopping here.")
+	}
+	var filePolicy Policy
+	err = json.Unmarshal(content, &filePolicy)
+	if err != nil {
+		return CustErr(err, "Cannot unmarshall policy file.\nStopping here.")
+	}
+	err = validatePolicy(filePolicy)
+	if err != nil {
+		return err
+	}
+	if filePolicy.Users == nil {
+		filePolicy.Users = map[string]string{}
+	}
+
+	policy = filePolicy
+	return nil
+
+}
+
+// roleFromGroups returns the role given by IdP groups, or an empty string if
+// none of the groups is in the policy
+func roleFromGroups(groups []string) string {
+	for _, groupRole := range policy.GroupRoles {
+		for _, group := range groups {
+			if group == groupRole.Group {
+				return groupRole.Role
+			}
+		}
+	}
+	return ""
+}
+
+// setIdpRole stores the role given by the IdP groups of a user
+func setIdpRole(user string, role string) {
+	idpRoles.Lock()
+	defer idpRoles.Unlock()
+	if role == "" {
+		delete(idpRoles.roles, user)
+		return
+	}
+	idpRoles.roles[user] = role
+}
+
+// loadIdpRoles loads the roles given by IdP groups at the last login of users.
+// Roles which no longer exist in the policy are ignored.
+func loadIdpRoles() error {
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT name, idp_role FROM app_user WHERE idp_role <> ''`
+	rows, err := db.Query(sqlStatement)
+	if err != nil {
+		return CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user, role string
+		err = rows.Scan(&user, &role)
+		if err != nil {
+			return CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+		}
+		if _, ok := policy.Roles[role]; ok {
+			setIdpRole(user, role)
+		}
+	}
+
+	return rows.Err()
+
+}
+
+// getUserRole returns the role of a user
+func getUserRole(user string) string {
+	if role, ok := policy.Users[user]; ok {
+		return role
+	}
+	idpRoles.RLock()
+	defer idpRoles.RUnlock()
+	if role, ok := idpRoles.roles[user]; ok {
+		return role
+	}
+	return policy.DefaultRole
+}
+
+// getUserPermissions returns the permissions of a user
+func getUserPermissions(user string) RolePermissions {
+	return policy.Roles[getUserRole(user)]
+}
+
+// getUserEmailAddress returns the email address of a user set in the policy, or
+// USER_EMAIL if none
+func getUserEmailAddress(user string) string {
+	if email, ok := policy.Emails[user]; ok {
+		return email
+	}
+	return getUserEmail()
+}
+
+// allowsStep tells if a step of a search can be run.
+// Export is allowed to roles which can export.
+func (p RolePermissions) allowsStep(step string) bool {
+	if step == "export" {
+		return p.CanExport
+	}
+	for _, allowedStep := range p.Steps {
+		if allowedStep == step {
+			return true
+		}
+	}
+	return false
+}
+
+// forbid answers the http request when the user is not allowed to do something
+func forbid(msg string, w http.ResponseWriter) {
+	http.Error(w, msg, http.StatusForbidden)
+}
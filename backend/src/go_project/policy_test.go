@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidatePolicyEmails(t *testing.T) {
+
+	p := defaultPolicy
+	p.Emails = map[string]string{"alice": "alice@example.com", "bob": "Bob <bob@example.com>"}
+	if err := validatePolicy(p); err != nil {
+		t.Errorf("valid emails refused: %v", err)
+	}
+
+	p.Emails = map[string]string{"alice": "alice"}
+	if err := validatePolicy(p); err == nil {
+		t.Error("email without domain accepted")
+	}
+
+}
+
+func TestGetUserEmailAddress(t *testing.T) {
+
+	savedPolicy := policy
+	t.Cleanup(func() { policy = savedPolicy })
+	t.Setenv("USER_EMAIL", "results@example.com")
+
+	policy = defaultPolicy
+	policy.Emails = map[string]string{"alice": "alice@example.com"}
+
+	if got := getUserEmailAddress("alice"); got != "alice@example.com" {
+		t.Errorf("got %s for alice, want the address of the policy", got)
+	}
+	if got := getUserEmailAddress("bob"); got != "results@example.com" {
+		t.Errorf("got %s for bob, want USER_EMAIL", got)
+	}
+
+}
@@ -0,0 +1,146 @@
+/*
+pseudonymization.go replaces personal data of the results with hashes, so analysts
+can study how segments are distributed without getting personal data.
+Contact ids, names, emails, phone numbers and social profile URLs are replaced
+with a salted hash (HMAC-SHA256). Job titles and the street of contacts are removed
+and their postal code is cut to its first characters (the département in France),
+since they are enough to find someone. Company, country, industry, level and
+function fields are kept.
+The same value always gets the same hash as long as the salt does not change, so
+pseudonymized exports can still be joined with each other.
+Values are normalized before being hashed so John@Domain.com and john@domain.com,
+or +33 6 12 34 56 78 and +33612345678, get the same hash.
+Pseudonymization is applied to both JSON and CSV output, instead of PII masking
+since it already covers all maskable fields (see pii_masking.go).
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Number of hex characters kept from a hash, enough to avoid collisions
+const pseudonymLength = 20
+
+// Number of characters kept from the postal code of contacts
+const postalCodePrefixLength = 2
+
+// Fields replaced with a hash, with how to normalize them before hashing
+var pseudonymizedFields = []struct {
+	normalize func(string) string
+	field     func(*CompAndContRow) *JsonNullString
+}{
+	{strings.TrimSpace, func(row *CompAndContRow) *JsonNullString { return &row.ContId }},
+	{normalizeName, func(row *CompAndContRow) *JsonNullString { return &row.ContFirstName }},
+	{normalizeName, func(row *CompAndContRow) *JsonNullString { return &row.ContLastName }},
+	{normalizeEmail, func(row *CompAndContRow) *JsonNullString { return &row.ContEmail }},
+	{normalizeEmail, func(row *CompAndContRow) *JsonNullString { return &row.CompEmail }},
+	{normalizePhone, func(row *CompAndContRow) *JsonNullString { return &row.ContTelephone }},
+	{normalizePhone, func(row *CompAndContRow) *JsonNullString { return &row.CompTelephone }},
+	{normalizePhone, func(row *CompAndContRow) *JsonNullString { return &row.CompFaxNumber }},
+	{normalizeURL, func(row *CompAndContRow) *JsonNullString { return &row.ContSocProfURL }},
+	{normalizeURL, func(row *CompAndContRow) *JsonNullString { return &row.CompSocProfURL }},
+}
+
+// Fields removed from pseudonymized results
+var droppedFields = []func(*CompAndContRow) *JsonNullString{
+	func(row *CompAndContRow) *JsonNullString { return &row.ContJobTitle },
+	func(row *CompAndContRow) *JsonNullString { return &row.ContStreetNumber },
+	func(row *CompAndContRow) *JsonNullString { return &row.ContRoute },
+}
+
+// getPseudonymizationSalt gets the secret salt of the hashes from env var set by Docker run.
+// It should never change, otherwise hashes of new exports do not match the old ones.
+// If no env var set, pseudonymized exports are disabled.
+func getPseudonymizationSalt() string {
+	return os.Getenv("PSEUDONYMIZATION_SALT")
+}
+
+// normalizeName lowercases a name and removes extra spaces
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// normalizeEmail lowercases an email and removes surrounding spaces
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizePhone only keeps the digits of a phone number
+func normalizePhone(phone string) string {
+	var digits strings.Builder
+	for _, char := range phone {
+		if unicode.IsDigit(char) {
+			digits.WriteRune(char)
+		}
+	}
+	return digits.String()
+}
+
+// normalizeURL lowercases a URL and removes surrounding spaces and the trailing slash
+func normalizeURL(url string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(url)), "/")
+}
+
+// generalizePostalCode only keeps the first characters of a postal code
+func generalizePostalCode(postalCode string) string {
+	runes := []rune(strings.TrimSpace(postalCode))
+	if len(runes) > postalCodePrefixLength {
+		runes = runes[:postalCodePrefixLength]
+	}
+	return string(runes)
+}
+
+// pseudonymize returns the salted hash of a value
+func pseudonymize(value string, salt string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:pseudonymLength]
+}
+
+// pseudonymizeRows replaces personal fields of the rows with their salted hash,
+// removes the other ones and generalizes the postal code of contacts.
+// Fields holding several values get one hash per value.
+// Rows may come from cache so they are copied instead of being modified.
+func pseudonymizeRows(compAndContRows []CompAndContRow, salt string) []CompAndContRow {
+
+	pseudonymizedRows := make([]CompAndContRow, len(compAndContRows))
+	copy(pseudonymizedRows, compAndContRows)
+	for i := range pseudonymizedRows {
+		for _, pseudonymized := range pseudonymizedFields {
+			field := pseudonymized.field(&pseudonymizedRows[i])
+			if !field.Valid || field.String == "" {
+				continue
+			}
+			values := strings.Split(field.String, multiValuesSeparator)
+			for j, value := range values {
+				values[j] = pseudonymize(pseudonymized.normalize(value), salt)
+			}
+			field.String = strings.Join(values, multiValuesSeparator)
+		}
+		for _, dropped := range droppedFields {
+			*dropped(&pseudonymizedRows[i]) = JsonNullString{}
+		}
+		postalCode := &pseudonymizedRows[i].ContPostalCode
+		postalCode.String = generalizePostalCode(postalCode.String)
+	}
+
+	return pseudonymizedRows
+
+}
+
+// protectRows hides the personal data of the rows before they are sent: the rows
+// are pseudonymized if the user asked for it, otherwise fields the role should not
+// see are masked
+func protectRows(compAndContRows []CompAndContRow, userInput UserInput, maskedFields []string) []CompAndContRow {
+	if userInput.Pseudonymize {
+		return pseudonymizeRows(compAndContRows, getPseudonymizationSalt())
+	}
+	return maskRows(compAndContRows, maskedFields)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+
+	tests := []struct {
+		normalize func(string) string
+		value     string
+		want      string
+	}{
+		{normalizeName, "  Jean   Pierre ", "jean pierre"},
+		{normalizeEmail, " John@Domain.COM ", "john@domain.com"},
+		{normalizePhone, "+33 6 12-34.56 78", "33612345678"},
+		{normalizeURL, " https://LinkedIn.com/in/John/ ", "https://linkedin.com/in/john"},
+	}
+	for _, test := range tests {
+		if got := test.normalize(test.value); got != test.want {
+			t.Errorf("got %q for %q, want %q", got, test.value, test.want)
+		}
+	}
+
+}
+
+func TestGeneralizePostalCode(t *testing.T) {
+
+	tests := map[string]string{
+		"75001":    "75",
+		" 69003 ":  "69",
+		"SW1A 1AA": "SW",
+		"7":        "7",
+		"":         "",
+		"ÅÄÖ12":    "ÅÄ",
+	}
+	for postalCode, want := range tests {
+		if got := generalizePostalCode(postalCode); got != want {
+			t.Errorf("got %q for %q, want %q", got, postalCode, want)
+		}
+	}
+
+}
+
+func TestPseudonymizeRows(t *testing.T) {
+
+	const salt = "test salt"
+	var row CompAndContRow
+	row.CompId = "12"
+	row.CompName = nullString("ACME")
+	row.CompEmail = nullString("info@acme.com¤Sales@ACME.com")
+	row.CompCountry = nullString("France")
+	row.ContId = nullString("34")
+	row.ContFirstName = nullString("John")
+	row.ContLastName = nullString("Doe")
+	row.ContJobTitle = nullString("Head of the Lyon office")
+	row.ContStreetNumber = nullString("12")
+	row.ContRoute = nullString("rue de la République")
+	row.ContPostalCode = nullString("69002")
+	row.ContLocality = nullString("Lyon")
+	row.ContEmail = nullString("John.Doe@acme.com")
+	row.ContJobLevel = nullString("Director")
+	rows := []CompAndContRow{row}
+
+	pseudonymizedRows := pseudonymizeRows(rows, salt)
+	got := pseudonymizedRows[0]
+
+	if rows[0].ContFirstName.String != "John" || rows[0].ContJobTitle.String != "Head of the Lyon office" {
+		t.Error("rows given were modified")
+	}
+	if got.ContId.String != pseudonymize("34", salt) {
+		t.Errorf("contact id not hashed: %q", got.ContId.String)
+	}
+	if got.ContEmail.String != pseudonymize("john.doe@acme.com", salt) {
+		t.Errorf("contact email not hashed once normalized: %q", got.ContEmail.String)
+	}
+	compEmails := strings.Split(got.CompEmail.String, multiValuesSeparator)
+	if len(compEmails) != 2 || compEmails[1] != pseudonymize("sales@acme.com", salt) {
+		t.Errorf("company emails not hashed one by one: %q", got.CompEmail.String)
+	}
+	for name, field := range map[string]JsonNullString{"job title": got.ContJobTitle, "street number": got.ContStreetNumber, "route": got.ContRoute} {
+		if field.Valid {
+			t.Errorf("contact %s not removed: %q", name, field.String)
+		}
+	}
+	if got.ContPostalCode.String != "69" {
+		t.Errorf("got contact postal code %q, want 69", got.ContPostalCode.String)
+	}
+	if got.CompId != "12" || got.CompName.String != "ACME" || got.CompCountry.String != "France" || got.ContLocality.String != "Lyon" || got.ContJobLevel.String != "Director" {
+		t.Errorf("kept fields changed: %+v", got)
+	}
+	if pseudonymizeRows(rows, "other salt")[0].ContId.String == got.ContId.String {
+		t.Error("hashes do not depend on the salt")
+	}
+
+}
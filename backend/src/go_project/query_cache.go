@@ -0,0 +1,233 @@
+/*
+query_cache.go keeps the results of recent searches in memory so the remote DB
+does not run the same big query again when a user clicks "count" and then
+"full" with the same criteria, or reruns yesterday's search.
+Entries are keyed on a hash of the cleaned and validated user input, the kind
+of result and the user, so users never see each other's results. Full results
+are shared by the full step and background exports since both run the same
+query. Entries expire after a TTL and the least recently used ones are dropped
+when the cache holds too many rows.
+*/
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of results stored in cache
+const (
+	cacheKindCount = "count"
+	cacheKindRows  = "rows"
+)
+
+// Values of the X-Cache response header
+const (
+	cacheHit  = "HIT"
+	cacheMiss = "MISS"
+)
+
+// cacheEntry stores the result of one search.
+// Only one of countRes and rows is set depending on the kind of result.
+// size is the number of rows of the entry, a count counts for one row.
+type cacheEntry struct {
+	key       string
+	countRes  CountRes
+	rows      []CompAndContRow
+	size      int
+	expiresAt time.Time
+}
+
+// resultCache is an LRU cache of search results.
+// Handlers run concurrently so it is protected by a mutex.
+// The front of order is the most recently used entry.
+type resultCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+}
+
+var queryCache = &resultCache{entries: make(map[string]*list.Element), order: list.New()}
+
+// getCacheTTL gets how long results are kept in cache from env var set by Docker run,
+// in seconds.
+// If no env var set, set it to 10 minutes. Data of the remote DB changes during the day
+// so results should not be kept much longer.
+func getCacheTTL() time.Duration {
+	ttl, err := strconv.Atoi(os.Getenv("CACHE_TTL"))
+	if err != nil {
+		ttl = 600
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// getCacheMaxRows gets the max total number of rows kept in cache from env var
+// set by Docker run. 0 disables the cache.
+// If no env var set, set it to 200000, a few hundred MB in memory at most.
+func getCacheMaxRows() int {
+	maxRows, err := strconv.Atoi(os.Getenv("CACHE_MAX_ROWS"))
+	if err != nil {
+		maxRows = 200000
+	}
+	return maxRows
+}
+
+// buildCacheKey hashes the user input in a canonical form.
+// userInput must already be validated and cleaned.
+// Step, query id and shape are left out since they do not change the rows returned
+// by the db, and lists are sorted since the order of criteria does not matter either.
+func buildCacheKey(userInput UserInput, kind string, user string) string {
+
+	userInput.Step = ""
+	userInput.QueryId = ""
+	userInput.Shape = ""
+	// Rows are cached before being pseudonymized
+	userInput.Pseudonymize = false
+	if userInput.Mode == "" {
+		userInput.Mode = modeAll
+	}
+	for _, criterion := range []*[]string{
+		&userInput.CompanyCountries,
+		&userInput.CompanyIndustries,
+		&userInput.CompanySizes,
+		&userInput.CompanyTypes,
+		&userInput.CompanyDomains,
+		&userInput.ExcludedCompanyDomains,
+		&userInput.ContactCountries,
+		&userInput.ContactIndustries,
+		&userInput.ContactFunctions,
+		&userInput.ContactJobLevels,
+		&userInput.ContactRemoteAccounts,
+		&userInput.ExcludedContactRemoteAccounts,
+	} {
+		// Sort a copy, slices are shared with the caller's user input
+		sorted := append([]string(nil), (*criterion)...)
+		sort.Strings(sorted)
+		*criterion = sorted
+	}
+	excludedExportIds := append([]int(nil), userInput.ExcludedExportIds...)
+	sort.Ints(excludedExportIds)
+	userInput.ExcludedExportIds = excludedExportIds
+
+	// Fields of a struct are always marshalled in the same order so the JSON is canonical.
+	// An error is impossible here since UserInput only contains strings and ints.
+	canonical, _ := json.Marshal(userInput)
+
+	hash := sha256.New()
+	hash.Write([]byte(kind))
+	hash.Write([]byte{0})
+	hash.Write([]byte(user))
+	hash.Write([]byte{0})
+	hash.Write(canonical)
+	// Contacts excluded are not in the JSON but change as soon as someone exports
+	for _, contactId := range userInput.excludedContactIds {
+		hash.Write([]byte{0})
+		hash.Write([]byte(strconv.FormatInt(contactId, 10)))
+	}
+	// Same thing for the suppression list, read sorted from the local db
+	for _, suppressed := range [][]string{userInput.suppressedEmails, userInput.suppressedDomains} {
+		hash.Write([]byte{1})
+		for _, value := range suppressed {
+			hash.Write([]byte{0})
+			hash.Write([]byte(value))
+		}
+	}
+	for _, contactId := range userInput.suppressedContactIds {
+		hash.Write([]byte{0})
+		hash.Write([]byte(strconv.FormatInt(contactId, 10)))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+
+}
+
+// get returns the entry stored for a key if any and not expired
+func (c *resultCache) get(key string) (*cacheEntry, bool) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	return entry, true
+
+}
+
+// set stores an entry and drops the least recently used entries if the cache is full.
+// Entries bigger than the whole cache are not stored.
+func (c *resultCache) set(entry *cacheEntry) {
+
+	maxRows := getCacheMaxRows()
+	if entry.size > maxRows {
+		return
+	}
+	entry.expiresAt = time.Now().Add(getCacheTTL())
+
+	c.Lock()
+	defer c.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += entry.size
+
+	for c.size > maxRows {
+		c.remove(c.order.Back())
+	}
+
+}
+
+// remove drops an entry. Mutex must be locked by caller.
+func (c *resultCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// getCachedCount returns a count from cache if any
+func getCachedCount(key string) (CountRes, bool) {
+	entry, ok := queryCache.get(key)
+	if !ok {
+		return CountRes{}, false
+	}
+	return entry.countRes, true
+}
+
+// setCachedCount stores a count in cache
+func setCachedCount(key string, countRes CountRes) {
+	queryCache.set(&cacheEntry{key: key, countRes: countRes, size: 1})
+}
+
+// getCachedRows returns the rows of a full query from cache if any.
+// Rows are shared between requests so they must never be modified.
+func getCachedRows(key string) ([]CompAndContRow, bool) {
+	entry, ok := queryCache.get(key)
+	if !ok {
+		return nil, false
+	}
+	return entry.rows, true
+}
+
+// setCachedRows stores the rows of a full query in cache
+func setCachedRows(key string, compAndContRows []CompAndContRow) {
+	queryCache.set(&cacheEntry{key: key, rows: compAndContRows, size: len(compAndContRows) + 1})
+}
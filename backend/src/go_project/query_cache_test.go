@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildCacheKeyIsCanonical(t *testing.T) {
+
+	userInput := UserInput{
+		Step:              "full",
+		QueryId:           "query-1",
+		CompanyCountries:  []string{"France", "Spain"},
+		ContactFunctions:  []string{"Sales", "IT"},
+		ExcludedExportIds: []int{3, 1},
+	}
+	key := buildCacheKey(userInput, "full", "alice")
+
+	same := UserInput{
+		Step:              "count",
+		QueryId:           "query-2",
+		Mode:              modeAll,
+		Pseudonymize:      true,
+		CompanyCountries:  []string{"Spain", "France"},
+		ContactFunctions:  []string{"IT", "Sales"},
+		ExcludedExportIds: []int{1, 3},
+	}
+	if buildCacheKey(same, "full", "alice") != key {
+		t.Error("step, query id, pseudonymization, default mode and order of criteria should not change the key")
+	}
+	if userInput.CompanyCountries[0] != "France" || same.CompanyCountries[0] != "Spain" {
+		t.Error("criteria of the caller should not be sorted in place")
+	}
+
+	criteria := userInput
+	criteria.CompanyCountries = []string{"France"}
+	mode := userInput
+	mode.Mode = modeCompanies
+	excluded := userInput
+	excluded.excludedContactIds = []int64{12}
+	suppressed := userInput
+	suppressed.suppressedDomains = []string{"EXAMPLE.COM"}
+	different := map[string]string{
+		"kind":              buildCacheKey(userInput, "count", "alice"),
+		"user":              buildCacheKey(userInput, "full", "bob"),
+		"criteria":          buildCacheKey(criteria, "full", "alice"),
+		"mode":              buildCacheKey(mode, "full", "alice"),
+		"excluded contacts": buildCacheKey(excluded, "full", "alice"),
+		"suppressions":      buildCacheKey(suppressed, "full", "alice"),
+	}
+	for change, otherKey := range different {
+		if otherKey == key {
+			t.Errorf("%s should change the key", change)
+		}
+	}
+
+}
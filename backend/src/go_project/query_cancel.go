@@ -0,0 +1,122 @@
+/*
+query_cancel.go lets users cancel a long running search.
+Frontend generates a query id and sends it with the search. While the search
+runs, its cancel function is stored here so the cancel endpoint can stop it.
+Query ids are chosen by clients so they are only unique per user: users can only
+cancel their own searches, and a search reusing the id of a running search of
+the same user is refused. A canceled search may still be finishing when its id
+is reused, so each registration gets a token and a search only unregisters its own.
+Canceling the context makes lib/pq send a cancel request to PostgreSQL so the
+query really stops on the remote DB.
+*/
+
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// statusClientClosedRequest is the non standard status code used by nginx when
+// the client closed the request before the server answered
+const statusClientClosedRequest = 499
+
+// runningQueryKey identifies a running search
+type runningQueryKey struct {
+	user    string
+	queryId string
+}
+
+// runningQuery stores the cancel function of a running search and the token
+// of its registration
+type runningQuery struct {
+	cancel context.CancelFunc
+	token  uint64
+}
+
+// runningQueries stores running searches by user and query id. lastToken is the
+// token of the last registration. Handlers run concurrently so they are protected
+// by a mutex.
+var runningQueries = struct {
+	sync.Mutex
+	queries   map[runningQueryKey]runningQuery
+	lastToken uint64
+}{queries: make(map[runningQueryKey]runningQuery)}
+
+// queryIdRegexp is what a query id generated by frontend looks like
+var queryIdRegexp = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// isValidQueryId checks a query id sent by frontend
+func isValidQueryId(queryId string) bool {
+	return queryIdRegexp.MatchString(queryId)
+}
+
+// registerQuery stores the cancel function of a running search of a user and
+// returns the token to unregister it.
+// It returns false if the user already runs a search with this query id.
+func registerQuery(user string, queryId string, cancel context.CancelFunc) (uint64, bool) {
+	runningQueries.Lock()
+	defer runningQueries.Unlock()
+	key := runningQueryKey{user, queryId}
+	if _, ok := runningQueries.queries[key]; ok {
+		return 0, false
+	}
+	runningQueries.lastToken++
+	runningQueries.queries[key] = runningQuery{cancel: cancel, token: runningQueries.lastToken}
+	return runningQueries.lastToken, true
+}
+
+// unregisterQuery forgets a search once it is done. The query id may have been
+// registered again by another search after this one was canceled, so the
+// registration is only removed if the token is the one of this search.
+func unregisterQuery(user string, queryId string, token uint64) {
+	runningQueries.Lock()
+	defer runningQueries.Unlock()
+	key := runningQueryKey{user, queryId}
+	if query, ok := runningQueries.queries[key]; ok && query.token == token {
+		delete(runningQueries.queries, key)
+	}
+}
+
+// cancelQuery cancels a running search of a user and tells if it was found
+func cancelQuery(user string, queryId string) bool {
+	runningQueries.Lock()
+	defer runningQueries.Unlock()
+	key := runningQueryKey{user, queryId}
+	query, ok := runningQueries.queries[key]
+	if ok {
+		query.cancel()
+		delete(runningQueries.queries, key)
+	}
+	return ok
+}
+
+// CancelQuery cancels the running search of the user whose id is passed in url.
+// Searches of other users are not found.
+func CancelQuery(w http.ResponseWriter, r *http.Request) {
+
+	params := mux.Vars(r)
+	queryId := params["queryid"]
+
+	if !isValidQueryId(queryId) {
+		log.Println("Query id is not valid: " + queryId + "\nStopping here.")
+		http.Error(w, "Query id is not valid", http.StatusBadRequest)
+		return
+	}
+
+	// Search may be over already
+	user := getRequestUser(r)
+	if !cancelQuery(user, queryId) {
+		log.Println("No running query of user " + user + " found for this query id: " + queryId + "\nStopping here.")
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	log.Println("Query canceled by user " + user + ": " + queryId)
+	w.WriteHeader(http.StatusNoContent)
+
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCancelQueryIsScopedToUser(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	token, ok := registerQuery("alice", "query-1", cancel)
+	if !ok {
+		t.Fatal("first query refused")
+	}
+	defer unregisterQuery("alice", "query-1", token)
+
+	// Same id for another user is another query
+	otherCtx, otherCancel := context.WithCancel(context.Background())
+	defer otherCancel()
+	otherToken, ok := registerQuery("bob", "query-1", otherCancel)
+	if !ok {
+		t.Fatal("query of another user with the same id refused")
+	}
+	defer unregisterQuery("bob", "query-1", otherToken)
+
+	// A running id cannot be reused, the first cancel function is kept
+	if _, ok := registerQuery("alice", "query-1", func() {}); ok {
+		t.Fatal("duplicate query id accepted")
+	}
+
+	if cancelQuery("mallory", "query-1") {
+		t.Fatal("query of another user canceled")
+	}
+	if ctx.Err() != nil || otherCtx.Err() != nil {
+		t.Fatal("context canceled by another user")
+	}
+
+	if !cancelQuery("alice", "query-1") {
+		t.Fatal("own query not found")
+	}
+	if ctx.Err() == nil {
+		t.Fatal("own query not canceled")
+	}
+	if otherCtx.Err() != nil {
+		t.Fatal("query of another user with the same id canceled")
+	}
+
+	// Once over, the id can be used again
+	newToken, ok := registerQuery("alice", "query-1", func() {})
+	if !ok {
+		t.Fatal("id of a canceled query refused")
+	}
+	defer unregisterQuery("alice", "query-1", newToken)
+
+}
+
+func TestCanceledQueryDoesNotUnregisterNewQuery(t *testing.T) {
+
+	oldToken, ok := registerQuery("alice", "query-2", func() {})
+	if !ok {
+		t.Fatal("first query refused")
+	}
+	if !cancelQuery("alice", "query-2") {
+		t.Fatal("first query not found")
+	}
+
+	// The id is reused while the canceled search is still finishing
+	newCtx, newCancel := context.WithCancel(context.Background())
+	defer newCancel()
+	newToken, ok := registerQuery("alice", "query-2", newCancel)
+	if !ok {
+		t.Fatal("id of a canceled query refused")
+	}
+	defer unregisterQuery("alice", "query-2", newToken)
+
+	// The canceled search is done and unregisters itself
+	unregisterQuery("alice", "query-2", oldToken)
+
+	// The new search can still be canceled and its id is still taken
+	if _, ok := registerQuery("alice", "query-2", func() {}); ok {
+		t.Fatal("id of the running query accepted")
+	}
+	if !cancelQuery("alice", "query-2") {
+		t.Fatal("new query unregistered by the canceled one")
+	}
+	if newCtx.Err() == nil {
+		t.Fatal("new query not canceled")
+	}
+
+}
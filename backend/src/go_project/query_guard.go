@@ -0,0 +1,283 @@
+/*
+query_guard.go protects the remote DB against careless searches.
+Every step has its own statement timeout, enforced by PostgreSQL itself.
+Before running the count step, the full step or an export, we ask the planner for
+the estimated cost of the query. Every step has its own max cost. Above it, count
+queries and exports are rejected with a message explaining how to narrow the
+search. Full queries are either rejected or turned into a background export whose
+results are sent by email, depending on the policy set by Docker run, if the cost
+is below the max cost of exports.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Possible values of the QUERY_COST_POLICY env var
+const (
+	costPolicyReject = "reject"
+	costPolicyAsync  = "async"
+)
+
+// Default statement timeouts in milliseconds per step, used if no env var set.
+// Export is the step used by background jobs so it can be much longer.
+var defaultStatementTimeouts = map[string]int{
+	"estimate": 10000,
+	"count":    60000,
+	"full":     120000,
+	"export":   1800000,
+}
+
+// Default max planner costs per step, used if no env var set. 10 millions is roughly
+// what the planner gives for a search on a single country with no other criteria.
+// Exports run in the background with a long timeout so they can be much heavier.
+var defaultMaxQueryCosts = map[string]float64{
+	"count":  10000000,
+	"full":   10000000,
+	"export": 100000000,
+}
+
+// pqQueryCanceled is the PostgreSQL error code raised when a statement
+// is canceled because of statement_timeout or a user request
+const pqQueryCanceled = "57014"
+
+// getStatementTimeout gets the statement timeout in milliseconds of a step from env var
+// set by Docker run: ESTIMATE_STATEMENT_TIMEOUT, COUNT_STATEMENT_TIMEOUT,
+// FULL_STATEMENT_TIMEOUT, or EXPORT_STATEMENT_TIMEOUT.
+// If no env var set or not an integer, use the default one.
+func getStatementTimeout(step string) int {
+	envName := ""
+	switch step {
+	case "estimate":
+		envName = "ESTIMATE_STATEMENT_TIMEOUT"
+	case "count":
+		envName = "COUNT_STATEMENT_TIMEOUT"
+	case "full":
+		envName = "FULL_STATEMENT_TIMEOUT"
+	case "export":
+		envName = "EXPORT_STATEMENT_TIMEOUT"
+	}
+	timeout, err := strconv.Atoi(os.Getenv(envName))
+	if err != nil {
+		return defaultStatementTimeouts[step]
+	}
+	return timeout
+}
+
+// getMaxQueryCost gets the max planner cost accepted for a step from env var
+// set by Docker run: MAX_COUNT_QUERY_COST, MAX_QUERY_COST (full step) or
+// MAX_EXPORT_QUERY_COST.
+// If no env var set or not a number, use the default one.
+func getMaxQueryCost(step string) float64 {
+	envName := ""
+	switch step {
+	case "count":
+		envName = "MAX_COUNT_QUERY_COST"
+	case "full":
+		envName = "MAX_QUERY_COST"
+	case "export":
+		envName = "MAX_EXPORT_QUERY_COST"
+	}
+	maxCost, err := strconv.ParseFloat(os.Getenv(envName), 64)
+	if err != nil {
+		return defaultMaxQueryCosts[step]
+	}
+	return maxCost
+}
+
+// getQueryCostPolicy gets what to do with queries above the max cost from env var
+// set by Docker run.
+// If no env var set, set it to reject.
+func getQueryCostPolicy() string {
+	envContent := os.Getenv("QUERY_COST_POLICY")
+	if envContent != costPolicyAsync {
+		envContent = costPolicyReject
+	}
+	return envContent
+}
+
+// isQueryTooExpensive tells if the planner thinks the query of a step is too heavy
+// for the remote DB
+func isQueryTooExpensive(queryPlan QueryPlan, step string) bool {
+	return queryPlan.TotalCost > getMaxQueryCost(step)
+}
+
+// tooExpensiveMessage explains to users why a query is rejected
+func tooExpensiveMessage(queryPlan QueryPlan, step string) string {
+	return fmt.Sprintf("This search is too heavy for the database (estimated cost %.0f, max %.0f). "+
+		"Please narrow it down, for example by adding a country, an industry or a job level.",
+		queryPlan.TotalCost, getMaxQueryCost(step))
+}
+
+// refuseTooExpensive answers the http request when a query is too heavy for a step
+func refuseTooExpensive(queryPlan QueryPlan, step string, w http.ResponseWriter) {
+	log.Println(fmt.Sprintf("Query cost %.0f of the %s step is above max cost %.0f.\nStopping here.", queryPlan.TotalCost, step, getMaxQueryCost(step)))
+	http.Error(w, tooExpensiveMessage(queryPlan, step), http.StatusUnprocessableEntity)
+}
+
+// isQueryCanceled tells if an error returned by the db is a canceled statement
+func isQueryCanceled(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code == pqQueryCanceled
+	}
+	// CustErr only keeps the error message so also check the message
+	return err != nil && (strings.Contains(err.Error(), "canceling statement due to statement timeout") ||
+		strings.Contains(err.Error(), "canceling statement due to user request"))
+}
+
+// httpErrorFromSQLErr answers the http request with the right status code for
+// an error returned by the db.
+// If ctx is done the query was canceled by the user (or the client is gone
+// and nobody will read the answer anyway), otherwise a canceled query means
+// the statement timeout was reached.
+func httpErrorFromSQLErr(ctx context.Context, err error, w http.ResponseWriter) {
+	if ctx.Err() != nil {
+		http.Error(w, "The search was canceled.", statusClientClosedRequest)
+		return
+	}
+	if isQueryCanceled(err) {
+		http.Error(w, "The search took too long and was stopped. Please add more criteria.", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// rejectOrRunInBackground handles a full query above the max cost according to policy.
+// Users whose role cannot export and queries too heavy even for exports are always rejected.
+func rejectOrRunInBackground(sqlStmtStr string, sqlArgs []interface{}, userInput UserInput, queryPlan QueryPlan, cacheKey string, user string, canExport bool, w http.ResponseWriter) {
+
+	log.Println(fmt.Sprintf("Query cost %.0f is above max cost %.0f, policy is %s.", queryPlan.TotalCost, getMaxQueryCost("full"), getQueryCostPolicy()))
+
+	if getQueryCostPolicy() == costPolicyReject || !canExport {
+		refuseTooExpensive(queryPlan, "full", w)
+		return
+	}
+	if isQueryTooExpensive(queryPlan, "export") {
+		refuseTooExpensive(queryPlan, "export", w)
+		return
+	}
+
+	startBackgroundExport(sqlStmtStr, sqlArgs, userInput, cacheKey, user, w)
+
+}
+
+// startBackgroundExport queues an export of the full results sent by email and
+// answers the http request right away
+func startBackgroundExport(sqlStmtStr string, sqlArgs []interface{}, userInput UserInput, cacheKey string, user string, w http.ResponseWriter) {
+
+	// Take a place in the export queue now so the user knows right away if the
+	// export is refused. The export itself waits for its turn in the background.
+	ticket, err := queryLimiters[limitExport].enqueue(user, "")
+	if err != nil {
+		httpErrorFromLimiterErr(context.Background(), limitExport, err, w)
+		return
+	}
+
+	// Run the query with the longer export timeout and send results by email
+	go runExportInBackground(sqlStmtStr, sqlArgs, userInput, cacheKey, ticket, 0)
+
+	http.Error(w, "This search is running in the background. Results will be sent by email.", http.StatusAccepted)
+
+}
+
+// runExportInBackground runs the full query and sends results by email without
+// any http request attached to it.
+// Rows are cached like for the full step so asking the same search again
+// does not hit the remote DB.
+// Results above the approval threshold are not sent and an approval request is
+// stored instead (see export_approvals.go), unless approvedRowsNb rows were approved
+// and results did not grow well past them.
+// The export is audited again once done since the number of rows is only known now.
+// Errors are returned for approved exports, which store them.
+func runExportInBackground(sqlStmtStr string, sqlArgs []interface{}, userInput UserInput, cacheKey string, ticket *queryTicket, approvedRowsNb int) error {
+
+	startedOn := time.Now()
+	userInput.Step = "export"
+
+	// Background exports wait as long as needed for their turn
+	ticket.wait(context.Background(), 0)
+	defer ticket.release()
+
+	compAndContRows, isCached := getCachedRows(cacheKey)
+	if !isCached {
+		var err error
+		// Not using the request context here since the http request is over
+		compAndContRows, err = queryFullSQLReq(context.Background(), sqlStmtStr, sqlArgs, userInput.Mode, getStatementTimeout("export"))
+		if err != nil {
+			log.Println(err)
+			recordSearchAudit(ticket.user, userInput, nil, deliveryEmail, http.StatusInternalServerError, time.Since(startedOn))
+			return err
+		}
+		setCachedRows(cacheKey, compAndContRows)
+	}
+	rowsNb := len(compAndContRows)
+	if rowsNb == 0 {
+		log.Println("No result found for background export\nStopping here.")
+		recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryNone, http.StatusNotFound, time.Since(startedOn))
+		return errors.New("No result found.")
+	}
+
+	// Quota may have been used by other searches while waiting, no approval is
+	// requested for exports over quota
+	quotaStatuses, err := getQuotaStatuses(context.Background(), ticket.user)
+	if err != nil {
+		log.Println(err)
+		recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryEmail, http.StatusInternalServerError, time.Since(startedOn))
+		return err
+	}
+	if reason := checkQuotas(quotaStatuses, rowsNb); reason != "" {
+		log.Println("Background export of user " + ticket.user + " would go over quota: " + reason + "\nStopping here.")
+		recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryNone, http.StatusTooManyRequests, time.Since(startedOn))
+		return errors.New(reason)
+	}
+
+	if needsApproval(rowsNb) && !approvalCovers(approvedRowsNb, rowsNb) {
+		_, err = requestExportApproval(context.Background(), ticket.user, userInput, rowsNb)
+		if err != nil {
+			log.Println(err)
+			recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryApproval, http.StatusInternalServerError, time.Since(startedOn))
+			return err
+		}
+		recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryApproval, http.StatusAccepted, time.Since(startedOn))
+		if approvedRowsNb > 0 {
+			return errApprovedRowsOutgrown
+		}
+		return nil
+	}
+
+	// Quotas are checked again while recording the export, so concurrent exports
+	// cannot all pass the check above
+	exportId, reason, err := reserveExport(context.Background(), ticket.user, "export", userInput, compAndContRows)
+	if err != nil {
+		log.Println(err)
+		recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryEmail, http.StatusInternalServerError, time.Since(startedOn))
+		return err
+	}
+	if reason != "" {
+		log.Println("Background export of user " + ticket.user + " would go over quota: " + reason + "\nStopping here.")
+		recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryNone, http.StatusTooManyRequests, time.Since(startedOn))
+		return errors.New(reason)
+	}
+
+	err = returnCSVByEmail(protectRows(compAndContRows, userInput, getUserPermissions(ticket.user).MaskedFields), userInput)
+	if err != nil {
+		cancelExport(exportId)
+		recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryEmail, http.StatusInternalServerError, time.Since(startedOn))
+		return err
+	}
+	recordSearchAudit(ticket.user, userInput, &rowsNb, deliveryEmail, http.StatusOK, time.Since(startedOn))
+
+	return nil
+
+}
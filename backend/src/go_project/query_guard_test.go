@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMaxQueryCostPerStep(t *testing.T) {
+
+	t.Setenv("MAX_COUNT_QUERY_COST", "500")
+	t.Setenv("MAX_QUERY_COST", "")
+	t.Setenv("MAX_EXPORT_QUERY_COST", "not a number")
+
+	tests := []struct {
+		step    string
+		maxCost float64
+	}{
+		{"count", 500},
+		{"full", defaultMaxQueryCosts["full"]},
+		{"export", defaultMaxQueryCosts["export"]},
+	}
+	for _, test := range tests {
+		if maxCost := getMaxQueryCost(test.step); maxCost != test.maxCost {
+			t.Errorf("%s: got max cost %.0f, want %.0f", test.step, maxCost, test.maxCost)
+		}
+	}
+
+	queryPlan := QueryPlan{TotalCost: 1000}
+	if !isQueryTooExpensive(queryPlan, "count") {
+		t.Error("count query above MAX_COUNT_QUERY_COST should be too expensive")
+	}
+	if isQueryTooExpensive(queryPlan, "export") {
+		t.Error("export query below the default max cost should not be too expensive")
+	}
+
+}
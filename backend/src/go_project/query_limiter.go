@@ -0,0 +1,360 @@
+/*
+query_limiter.go limits how many heavy queries run at the same time on the
+remote DB. A few big searches running together are enough to saturate it.
+Count, full and export queries have their own limit. When all slots are
+taken, queries wait in a FIFO queue. The position in queue can be polled with
+the query id while waiting. Headers are only sent with the response, once the
+query is over, so the X-Queue-Position header only tells afterwards how far in
+queue the query started.
+If the queue is full, or the user already has too many queries running or
+waiting, the query is refused with a Retry-After header.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of queries limited. Estimate and dry-run only ask the planner so they are not limited.
+const (
+	limitCount  = "count"
+	limitFull   = "full"
+	limitExport = "export"
+)
+
+// Default max number of queries running at the same time per kind, used if no env var set
+var defaultMaxConcurrentQueries = map[string]int{
+	limitCount:  4,
+	limitFull:   2,
+	limitExport: 1,
+}
+
+var (
+	errQueueFull          = errors.New("Too many searches are waiting, queue is full.")
+	errQueueTimeout       = errors.New("Search waited too long in queue.")
+	errTooManyUserQueries = errors.New("User already has too many searches running or waiting.")
+)
+
+// getMaxConcurrentQueries gets the max number of queries of a kind running at the same
+// time from env var set by Docker run: COUNT_MAX_CONCURRENT, FULL_MAX_CONCURRENT,
+// or EXPORT_MAX_CONCURRENT.
+// If no env var set or not a positive integer, use the default one.
+func getMaxConcurrentQueries(kind string) int {
+	envName := ""
+	switch kind {
+	case limitCount:
+		envName = "COUNT_MAX_CONCURRENT"
+	case limitFull:
+		envName = "FULL_MAX_CONCURRENT"
+	case limitExport:
+		envName = "EXPORT_MAX_CONCURRENT"
+	}
+	maxQueries, err := strconv.Atoi(os.Getenv(envName))
+	if err != nil || maxQueries < 1 {
+		return defaultMaxConcurrentQueries[kind]
+	}
+	return maxQueries
+}
+
+// getMaxQueueSize gets the max number of queries waiting per kind from env var
+// set by Docker run.
+// If no env var set, set it to 10.
+func getMaxQueueSize() int {
+	maxSize, err := strconv.Atoi(os.Getenv("QUEUE_MAX_SIZE"))
+	if err != nil {
+		return 10
+	}
+	return maxSize
+}
+
+// getMaxQueueWait gets how long a search can wait in queue from env var
+// set by Docker run, in seconds. Background exports wait as long as needed.
+// If no env var set, set it to 2 minutes.
+func getMaxQueueWait() time.Duration {
+	maxWait, err := strconv.Atoi(os.Getenv("QUEUE_MAX_WAIT"))
+	if err != nil {
+		maxWait = 120
+	}
+	return time.Duration(maxWait) * time.Second
+}
+
+// getMaxQueriesPerUser gets the max number of queries of a kind a user can have
+// running or waiting at the same time from env var set by Docker run.
+// If no env var set, set it to 2.
+func getMaxQueriesPerUser() int {
+	maxQueries, err := strconv.Atoi(os.Getenv("QUERIES_PER_USER"))
+	if err != nil || maxQueries < 1 {
+		return 2
+	}
+	return maxQueries
+}
+
+// queryLimiter counts the running queries of a kind and stores the waiting ones.
+// Handlers run concurrently so it is protected by a mutex.
+// avgDuration is a moving average of the duration of the queries, used to tell
+// clients when to retry.
+type queryLimiter struct {
+	sync.Mutex
+	kind        string
+	running     int
+	queue       []*queryTicket
+	perUser     map[string]int
+	avgDuration time.Duration
+}
+
+// queryTicket is given to a query allowed to run or waiting in queue.
+// position is the position in queue when the ticket was given, 0 if the query
+// could run right away. ready is closed when the query can run.
+type queryTicket struct {
+	limiter   *queryLimiter
+	user      string
+	queryId   string
+	position  int
+	ready     chan struct{}
+	startedAt time.Time
+}
+
+var queryLimiters = map[string]*queryLimiter{
+	limitCount:  newQueryLimiter(limitCount),
+	limitFull:   newQueryLimiter(limitFull),
+	limitExport: newQueryLimiter(limitExport),
+}
+
+func newQueryLimiter(kind string) *queryLimiter {
+	return &queryLimiter{kind: kind, perUser: make(map[string]int)}
+}
+
+// enqueue gives a ticket to a query. The query can run right away if a slot is free,
+// otherwise it is put at the end of the queue and must wait for its ticket.
+func (l *queryLimiter) enqueue(user string, queryId string) (*queryTicket, error) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.perUser[user] >= getMaxQueriesPerUser() {
+		return nil, errTooManyUserQueries
+	}
+
+	ticket := &queryTicket{limiter: l, user: user, queryId: queryId, ready: make(chan struct{})}
+
+	if l.running < getMaxConcurrentQueries(l.kind) && len(l.queue) == 0 {
+		l.running++
+		close(ticket.ready)
+	} else {
+		if len(l.queue) >= getMaxQueueSize() {
+			return nil, errQueueFull
+		}
+		l.queue = append(l.queue, ticket)
+		ticket.position = len(l.queue)
+	}
+	l.perUser[user]++
+
+	return ticket, nil
+
+}
+
+// wait blocks until the query can run, the context is done, or maxWait is over.
+// maxWait = 0 means waiting as long as needed.
+func (t *queryTicket) wait(ctx context.Context, maxWait time.Duration) error {
+
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-t.ready:
+		t.startedAt = time.Now()
+		return nil
+	case <-ctx.Done():
+		t.leave()
+		return ctx.Err()
+	case <-timeout:
+		t.leave()
+		return errQueueTimeout
+	}
+
+}
+
+// leave removes a query from queue when it stops waiting. If a slot was given to it
+// in the meantime, the slot is released for the next one.
+func (t *queryTicket) leave() {
+
+	l := t.limiter
+	l.Lock()
+	for i, queued := range l.queue {
+		if queued == t {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			l.forgetUserQuery(t.user)
+			l.Unlock()
+			return
+		}
+	}
+	l.Unlock()
+
+	t.release()
+
+}
+
+// release frees the slot of a query which is done and gives it to the first query
+// waiting, if any
+func (t *queryTicket) release() {
+
+	l := t.limiter
+	l.Lock()
+	defer l.Unlock()
+
+	l.forgetUserQuery(t.user)
+
+	if !t.startedAt.IsZero() {
+		duration := time.Since(t.startedAt)
+		if l.avgDuration == 0 {
+			l.avgDuration = duration
+		} else {
+			l.avgDuration = (l.avgDuration*4 + duration) / 5
+		}
+	}
+
+	if len(l.queue) > 0 {
+		next := l.queue[0]
+		l.queue = l.queue[1:]
+		close(next.ready)
+	} else {
+		l.running--
+	}
+
+}
+
+// forgetUserQuery decrements the number of queries of a user.
+// Mutex must be locked by caller.
+func (l *queryLimiter) forgetUserQuery(user string) {
+	l.perUser[user]--
+	if l.perUser[user] <= 0 {
+		delete(l.perUser, user)
+	}
+}
+
+// positionOf returns the current position in queue of a query of a user, 0 if not waiting.
+// Query ids are only unique per user.
+func (l *queryLimiter) positionOf(user string, queryId string) int {
+	l.Lock()
+	defer l.Unlock()
+	for i, queued := range l.queue {
+		if queued.user == user && queued.queryId == queryId {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// retryAfter estimates in seconds when a slot should be free based on the
+// average duration of queries and the number of queries waiting
+func (l *queryLimiter) retryAfter() int {
+	l.Lock()
+	defer l.Unlock()
+	avgDuration := l.avgDuration
+	if avgDuration == 0 {
+		avgDuration = 10 * time.Second
+	}
+	wait := avgDuration * time.Duration(len(l.queue)+1) / time.Duration(getMaxConcurrentQueries(l.kind))
+	seconds := int(wait / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// httpErrorFromLimiterErr answers the http request with the right status code when
+// a query could not get a slot
+func httpErrorFromLimiterErr(ctx context.Context, kind string, err error, w http.ResponseWriter) {
+
+	if ctx.Err() != nil {
+		http.Error(w, "The search was canceled.", statusClientClosedRequest)
+		return
+	}
+
+	log.Println(fmt.Sprintf("No slot for %s query: %s", kind, err))
+
+	w.Header().Set("Retry-After", strconv.Itoa(queryLimiters[kind].retryAfter()))
+	if err == errTooManyUserQueries {
+		http.Error(w, "You already have too many searches running. Please wait for them to finish.", http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, "The database is busy with other searches. Please try again later.", http.StatusServiceUnavailable)
+
+}
+
+// acquireQuerySlot waits for a slot to run a query of a kind on the remote DB.
+// The position in queue when the query was queued is sent in the X-Queue-Position
+// header, 0 if a slot was free right away. It is not updated while waiting: the
+// header is only sent with the response, use ReturnQueuePosition to follow the queue.
+// The caller must release the ticket once the query is done.
+func acquireQuerySlot(ctx context.Context, kind string, user string, queryId string, w http.ResponseWriter) (*queryTicket, error) {
+
+	ticket, err := queryLimiters[kind].enqueue(user, queryId)
+	if err != nil {
+		httpErrorFromLimiterErr(ctx, kind, err, w)
+		return nil, err
+	}
+	w.Header().Set("X-Queue-Position", strconv.Itoa(ticket.position))
+
+	err = ticket.wait(ctx, getMaxQueueWait())
+	if err != nil {
+		httpErrorFromLimiterErr(ctx, kind, err, w)
+		return nil, err
+	}
+
+	return ticket, err
+
+}
+
+// QueuePosition stores the position in queue of a search
+type QueuePosition struct {
+	QueuePosition int `json:"queuePosition"`
+}
+
+// ReturnQueuePosition tells frontend the position in queue of a waiting search
+// of the user thanks to its query id. 0 means the search is not waiting (running
+// or done), or is not a search of the user.
+func ReturnQueuePosition(w http.ResponseWriter, r *http.Request) {
+
+	// Get query id from URL
+	queryId := mux.Vars(r)["queryid"]
+	if !isValidQueryId(queryId) {
+		http.Error(w, "Query id is not valid.", http.StatusBadRequest)
+		return
+	}
+
+	user := getRequestUser(r)
+	var queuePosition QueuePosition
+	for _, limiter := range queryLimiters {
+		if position := limiter.positionOf(user, queryId); position > 0 {
+			queuePosition.QueuePosition = position
+		}
+	}
+
+	returnedJson, err := json.Marshal(queuePosition)
+	if err != nil {
+		err = CustErr(err, "Could not not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
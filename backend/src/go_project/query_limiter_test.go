@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueuePositionIsScopedToUser(t *testing.T) {
+
+	t.Setenv("COUNT_MAX_CONCURRENT", "1")
+	limiter := newQueryLimiter(limitCount)
+
+	running, err := limiter.enqueue("alice", "query-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting, err := limiter.enqueue("alice", "query-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherWaiting, err := limiter.enqueue("bob", "query-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		queryId  string
+		position int
+	}{
+		{"alice", "query-1", 0},
+		{"alice", "query-2", 1},
+		{"bob", "query-2", 2},
+		{"mallory", "query-2", 0},
+		{"bob", "query-1", 0},
+	}
+	for _, test := range tests {
+		if position := limiter.positionOf(test.user, test.queryId); position != test.position {
+			t.Errorf("%s %s: got position %d, want %d", test.user, test.queryId, position, test.position)
+		}
+	}
+
+	// Once the first query is done, the next one of alice runs and bob moves up
+	running.release()
+	<-waiting.ready
+	if position := limiter.positionOf("bob", "query-2"); position != 1 {
+		t.Errorf("got position %d for bob, want 1", position)
+	}
+	waiting.release()
+	<-otherWaiting.ready
+	otherWaiting.release()
+
+}
+
+func TestQueuePositionHeaderTellsWhereQueryStarted(t *testing.T) {
+
+	t.Setenv("COUNT_MAX_CONCURRENT", "1")
+	savedLimiter := queryLimiters[limitCount]
+	t.Cleanup(func() { queryLimiters[limitCount] = savedLimiter })
+	queryLimiters[limitCount] = newQueryLimiter(limitCount)
+
+	w := httptest.NewRecorder()
+	running, err := acquireQuerySlot(context.Background(), limitCount, "alice", "query-1", w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position := w.Header().Get("X-Queue-Position"); position != "0" {
+		t.Errorf("got position %s for a query which did not wait, want 0", position)
+	}
+
+	// The header keeps the position in queue at the start once the query runs
+	waitingW := httptest.NewRecorder()
+	acquired := make(chan *queryTicket)
+	go func() {
+		waiting, err := acquireQuerySlot(context.Background(), limitCount, "bob", "query-1", waitingW)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- waiting
+	}()
+	for queryLimiters[limitCount].positionOf("bob", "query-1") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	running.release()
+	waiting := <-acquired
+	if waiting == nil {
+		return
+	}
+	waiting.release()
+	if position := waitingW.Header().Get("X-Queue-Position"); position != "1" {
+		t.Errorf("got position %s for a query which waited, want 1", position)
+	}
+
+}
@@ -0,0 +1,152 @@
+/*
+query_plan.go asks the PostgreSQL planner what it thinks of the big query
+without executing it, thanks to EXPLAIN (FORMAT JSON).
+The planner answers within milliseconds, even on the remote DB, but numbers
+are only estimates based on table statistics.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+)
+
+// QueryPlan stores the interesting parts of the top node of an EXPLAIN (FORMAT JSON).
+// The whole plan is kept as raw JSON for power users.
+type QueryPlan struct {
+	PlanRows  float64         `json:"planRows"`
+	TotalCost float64         `json:"totalCost"`
+	Raw       json.RawMessage `json:"plan"`
+}
+
+// EstimateRes stores the result of the estimate step.
+// Approximate is always true, it is only here so nobody can mistake
+// the estimate for the result of the count step.
+type EstimateRes struct {
+	EstimatedRowsNb int64 `json:"estimatedRowsNb"`
+	Approximate     bool  `json:"approximate"`
+}
+
+// DryRunRes stores the result of the dry-run step: the SQL built for the full
+// step with its positional arguments ($1 is Args[0]...) and what the planner
+// thinks of it, without running the search. Useful for analysts who want to
+// understand why a combination of criteria is slow or returns nothing.
+// Contacts already exported and suppressed values are never disclosed: their
+// arguments only tell how many values they hold, like "<12 hidden values>".
+type DryRunRes struct {
+	SQL  string        `json:"sql"`
+	Args []interface{} `json:"args"`
+	QueryPlan
+}
+
+// hideExcludedValues returns a copy of the user input where the ids of the contacts
+// already exported and the suppressed values are replaced with as many blank values.
+// The dry-run SQL is the same as the real one and its plan is close, but neither the
+// arguments nor the filters of the plan show the real values.
+func hideExcludedValues(userInput UserInput) UserInput {
+	userInput.excludedContactIds = make([]int64, len(userInput.excludedContactIds))
+	userInput.suppressedContactIds = make([]int64, len(userInput.suppressedContactIds))
+	userInput.suppressedEmails = make([]string, len(userInput.suppressedEmails))
+	userInput.suppressedDomains = make([]string, len(userInput.suppressedDomains))
+	return userInput
+}
+
+// describeDryRunArgs replaces the array arguments of a query, only used for excluded
+// and suppressed values (see NotInArray and UpperNotInArray), with their number of values
+func describeDryRunArgs(sqlArgs []interface{}) []interface{} {
+	describedArgs := make([]interface{}, len(sqlArgs))
+	for i, sqlArg := range sqlArgs {
+		switch array := sqlArg.(type) {
+		case *pq.Int64Array:
+			describedArgs[i] = fmt.Sprintf("<%d hidden values>", len(*array))
+		case *pq.StringArray:
+			describedArgs[i] = fmt.Sprintf("<%d hidden values>", len(*array))
+		default:
+			describedArgs[i] = sqlArg
+		}
+	}
+	return describedArgs
+}
+
+// explainOutput maps the JSON returned by EXPLAIN (FORMAT JSON) which is
+// an array containing one object per statement
+type explainOutput []struct {
+	Plan struct {
+		PlanRows  float64 `json:"Plan Rows"`
+		TotalCost float64 `json:"Total Cost"`
+	} `json:"Plan"`
+}
+
+// parseQueryPlan reads the top node of the plan returned by EXPLAIN (FORMAT JSON)
+func parseQueryPlan(rawPlan []byte) (QueryPlan, error) {
+
+	var queryPlan QueryPlan
+	var output explainOutput
+
+	err := json.Unmarshal(rawPlan, &output)
+	if err != nil {
+		return queryPlan, err
+	}
+	if len(output) == 0 {
+		return queryPlan, errors.New("EXPLAIN returned an empty plan.")
+	}
+
+	queryPlan.PlanRows = output[0].Plan.PlanRows
+	queryPlan.TotalCost = output[0].Plan.TotalCost
+	queryPlan.Raw = json.RawMessage(rawPlan)
+
+	return queryPlan, err
+
+}
+
+// queryExplainSQLReq runs EXPLAIN (FORMAT JSON) on an SQL query with its positional arguments.
+// The query is only planned, never executed.
+// It does not write anything to the http response so it can also be used by background jobs.
+func queryExplainSQLReq(ctx context.Context, sqlStmtStr string, sqlArgs []interface{}) (QueryPlan, error) {
+
+	var queryPlan QueryPlan
+	var err error
+
+	// Connect to db:
+	db, err := sql.Open("postgres", getRemoteDBInfo(getStatementTimeout("estimate")))
+	if err != nil {
+		return queryPlan, CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	var rawPlan []byte
+	row := db.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) "+sqlStmtStr, sqlArgs...)
+	err = row.Scan(&rawPlan)
+	if err != nil {
+		return queryPlan, CustErr(err, "EXPLAIN query failed.\nStopping here.")
+	}
+
+	queryPlan, err = parseQueryPlan(rawPlan)
+	if err != nil {
+		return queryPlan, CustErr(err, "Could not read query plan.\nStopping here.")
+	}
+
+	return queryPlan, err
+
+}
+
+// runExplainSQLReq plans an SQL query and answers the http request itself if
+// anything goes wrong
+func runExplainSQLReq(ctx context.Context, sqlStmtStr string, sqlArgs []interface{}, w http.ResponseWriter) (QueryPlan, error) {
+
+	queryPlan, err := queryExplainSQLReq(ctx, sqlStmtStr, sqlArgs)
+	if err != nil {
+		log.Println(err)
+		httpErrorFromSQLErr(ctx, err, w)
+	}
+
+	return queryPlan, err
+
+}
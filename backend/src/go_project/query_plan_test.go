@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// hiddenValuesInput is a search excluding contacts already exported and suppressed values
+func hiddenValuesInput() UserInput {
+	return UserInput{
+		CompanyCountries:     []string{"France"},
+		excludedContactIds:   []int64{987654321, 987654322},
+		suppressedEmails:     []string{"optout@suppressed.example"},
+		suppressedDomains:    []string{"competitor.example"},
+		suppressedContactIds: []int64{876543210},
+	}
+}
+
+// hiddenValues are the values of hiddenValuesInput a dry-run must never show
+var hiddenValues = []string{"987654321", "987654322", "optout@suppressed.example", "competitor.example", "876543210"}
+
+// checkNoHiddenValue fails if a value of hiddenValues appears in a dry-run response, whatever its case
+func checkNoHiddenValue(t *testing.T, name string, response []byte) {
+	t.Helper()
+	upperResponse := strings.ToUpper(string(response))
+	for _, value := range hiddenValues {
+		if strings.Contains(upperResponse, strings.ToUpper(value)) {
+			t.Errorf("%s: %s found in the dry-run response %s", name, value, response)
+		}
+	}
+}
+
+func TestDryRunHidesExcludedValues(t *testing.T) {
+
+	for _, mode := range []string{modeAll, modeCompanies, modeContacts} {
+		userInput := hiddenValuesInput()
+		userInput.Mode = mode
+
+		sqlText, sqlArgs := buildSQLReq(false, hideExcludedValues(userInput))
+		if realSQLText, _ := buildSQLReq(false, userInput); sqlText != realSQLText {
+			t.Errorf("mode %s: got dry-run SQL %s, want the real one %s", mode, sqlText, realSQLText)
+		}
+
+		describedArgs := describeDryRunArgs(sqlArgs)
+		response, err := json.Marshal(DryRunRes{SQL: sqlText, Args: describedArgs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkNoHiddenValue(t, "mode "+mode, response)
+
+		// Only the number of values of each array is told
+		descriptions := map[interface{}]int{}
+		for _, describedArg := range describedArgs {
+			descriptions[describedArg]++
+		}
+		if descriptions["France"] != 1 || descriptions["<1 hidden values>"] == 0 {
+			t.Errorf("mode %s: got args %v, want the country and the number of suppressed values", mode, describedArgs)
+		}
+		if mode != modeCompanies && descriptions["<2 hidden values>"] != 1 {
+			t.Errorf("mode %s: got args %v, want the number of excluded contacts", mode, describedArgs)
+		}
+	}
+
+}
+
+func TestDryRunPlanHidesExcludedValues(t *testing.T) {
+
+	db := requireSearchDB(t)
+
+	for _, mode := range []string{modeAll, modeCompanies, modeContacts} {
+		userInput := hiddenValuesInput()
+		userInput.Mode = mode
+		sqlText, sqlArgs := buildSQLReq(false, hideExcludedValues(userInput))
+
+		// Filters of the plan show the values of the arguments
+		var rawPlan []byte
+		err := db.QueryRow("EXPLAIN (FORMAT JSON) "+sqlText, sqlArgs...).Scan(&rawPlan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkNoHiddenValue(t, "plan of mode "+mode, rawPlan)
+	}
+
+}
@@ -0,0 +1,256 @@
+/*
+predicates.go contains the criteria which can be used in a WHERE clause.
+Every constructor returns nil if the user input is empty, so callers can pass
+user inputs without checking them first.
+*/
+
+package querybuilder
+
+import (
+	"github.com/lib/pq"
+	"strings"
+)
+
+// Predicate is a criterion of a WHERE clause
+type Predicate interface {
+	writeTo(b *builder)
+}
+
+// writePredicates writes predicates separated by a logical operator
+func writePredicates(b *builder, predicates []Predicate, operator string) {
+	for i, predicate := range predicates {
+		if i > 0 {
+			b.WriteString(operator)
+		}
+		predicate.writeTo(b)
+	}
+}
+
+// group is a list of predicates combined with AND or OR, between parentheses
+type group struct {
+	operator   string
+	predicates []Predicate
+}
+
+func (g group) writeTo(b *builder) {
+	if len(g.predicates) == 1 {
+		g.predicates[0].writeTo(b)
+		return
+	}
+	b.WriteString("(")
+	writePredicates(b, g.predicates, g.operator)
+	b.WriteString(")")
+}
+
+// newGroup drops nil predicates and returns nil if nothing is left
+func newGroup(operator string, predicates []Predicate) Predicate {
+	var kept []Predicate
+	for _, predicate := range predicates {
+		if predicate != nil {
+			kept = append(kept, predicate)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return group{operator: operator, predicates: kept}
+}
+
+// And combines predicates with AND
+func And(predicates ...Predicate) Predicate {
+	return newGroup(" AND ", predicates)
+}
+
+// Or combines predicates with OR
+func Or(predicates ...Predicate) Predicate {
+	return newGroup(" OR ", predicates)
+}
+
+// comparison compares a column to a value passed as a positional argument.
+// format contains a %c for the column and a %v for the placeholder.
+type comparison struct {
+	format string
+	column string
+	value  interface{}
+}
+
+func (c comparison) writeTo(b *builder) {
+	sqlText := strings.Replace(c.format, "%c", c.column, -1)
+	b.WriteString(strings.Replace(sqlText, "%v", b.arg(c.value), -1))
+}
+
+// UpperEq is a case insensitive equality: UPPER(column) = UPPER($1)
+func UpperEq(column string, value string) Predicate {
+	if value == "" {
+		return nil
+	}
+	return comparison{format: "UPPER(%c) = UPPER(%v)", column: column, value: value}
+}
+
+// UpperNotEq is a case insensitive inequality: UPPER(column) <> UPPER($1)
+func UpperNotEq(column string, value string) Predicate {
+	if value == "" {
+		return nil
+	}
+	return comparison{format: "UPPER(%c) <> UPPER(%v)", column: column, value: value}
+}
+
+// UpperLike is a case insensitive "contains": UPPER(column) LIKE UPPER('%' || $1 || '%')
+func UpperLike(column string, value string) Predicate {
+	if value == "" {
+		return nil
+	}
+	return comparison{format: "UPPER(%c) LIKE UPPER(%v)", column: column, value: "%" + value + "%"}
+}
+
+// UpperIn is a case insensitive equality to any of the values
+func UpperIn(column string, values []string) Predicate {
+	var predicates []Predicate
+	for _, value := range values {
+		predicates = append(predicates, UpperEq(column, value))
+	}
+	return Or(predicates...)
+}
+
+// UpperNotIn is a case insensitive inequality to all of the values
+func UpperNotIn(column string, values []string) Predicate {
+	var predicates []Predicate
+	for _, value := range values {
+		predicates = append(predicates, UpperNotEq(column, value))
+	}
+	return And(predicates...)
+}
+
+// Eq is an exact equality: column = $1
+func Eq(column string, value string) Predicate {
+	if value == "" {
+		return nil
+	}
+	return comparison{format: "%c = %v", column: column, value: value}
+}
+
+// NotEq is an exact inequality: column <> $1
+func NotEq(column string, value string) Predicate {
+	if value == "" {
+		return nil
+	}
+	return comparison{format: "%c <> %v", column: column, value: value}
+}
+
+// In is an exact equality to any of the values
+func In(column string, values []string) Predicate {
+	var predicates []Predicate
+	for _, value := range values {
+		predicates = append(predicates, Eq(column, value))
+	}
+	return Or(predicates...)
+}
+
+// NotIn is an exact inequality to all of the values
+func NotIn(column string, values []string) Predicate {
+	var predicates []Predicate
+	for _, value := range values {
+		predicates = append(predicates, NotEq(column, value))
+	}
+	return And(predicates...)
+}
+
+// WithinDays checks that a date column is within the last days: column >= now() - $1 days
+func WithinDays(column string, days int) Predicate {
+	if days <= 0 {
+		return nil
+	}
+	return comparison{format: "%c >= now() - make_interval(days => %v)", column: column, value: days}
+}
+
+// NotInArray checks that an integer column is not in a list of values passed as a
+// single array argument, which stays fast with thousands of values.
+// Rows where the column is NULL are kept: column IS NULL OR column <> ALL($1)
+func NotInArray(column string, values []int64) Predicate {
+	if len(values) == 0 {
+		return nil
+	}
+	return comparison{format: "(%c IS NULL OR %c <> ALL(%v))", column: column, value: pq.Array(values)}
+}
+
+// UpperNotInArray is a case insensitive inequality to all of the values passed as
+// a single array argument, which stays fast with thousands of values.
+// Rows where the column is NULL are kept: column IS NULL OR UPPER(column) <> ALL($1)
+func UpperNotInArray(column string, values []string) Predicate {
+	if len(values) == 0 {
+		return nil
+	}
+	upperValues := make([]string, len(values))
+	for i, value := range values {
+		upperValues[i] = strings.ToUpper(value)
+	}
+	return comparison{format: "(%c IS NULL OR UPPER(%c) <> ALL(%v))", column: column, value: pq.Array(upperValues)}
+}
+
+// DomainNotInArray is like UpperNotInArray for a column holding a domain, but also
+// excludes the subdomains of the domains: example.com excludes www.example.com and
+// mail.example.com, not myexample.com. Rows where the column is NULL are kept.
+func DomainNotInArray(column string, domains []string) Predicate {
+	if len(domains) == 0 {
+		return nil
+	}
+	upperDomains := make([]string, len(domains))
+	for i, domain := range domains {
+		upperDomains[i] = strings.ToUpper(domain)
+	}
+	return comparison{
+		format: "(%c IS NULL OR NOT EXISTS (SELECT 1 FROM unnest(%v::text[]) AS excluded_domain(name) " +
+			"WHERE UPPER(%c) = excluded_domain.name OR right(UPPER(%c), length(excluded_domain.name) + 1) = '.' || excluded_domain.name))",
+		column: column,
+		value:  pq.Array(upperDomains),
+	}
+}
+
+// raw is a predicate written as is, without arguments
+type raw string
+
+func (r raw) writeTo(b *builder) {
+	b.WriteString(string(r))
+}
+
+// Raw is a predicate written as is, typically to compare two columns
+// (e.g. "cont_group.prospect_id = cont.id"). Never put user input in it.
+func Raw(sqlText string) Predicate {
+	return raw(sqlText)
+}
+
+// exists checks that a subquery returns at least one row (or none if not is set).
+// The subquery can reference the aliases of the outer query.
+type exists struct {
+	not      bool
+	subquery *Query
+}
+
+func (e exists) writeTo(b *builder) {
+	if e.not {
+		b.WriteString("NOT ")
+	}
+	b.WriteString("EXISTS (")
+	e.subquery.writeTo(b)
+	b.WriteString(")")
+}
+
+// Exists checks that a subquery returns at least one row: EXISTS (SELECT ...)
+func Exists(subquery *Query) Predicate {
+	return exists{subquery: subquery}
+}
+
+// NotExists checks that a subquery returns no row: NOT EXISTS (SELECT ...)
+func NotExists(subquery *Query) Predicate {
+	return exists{not: true, subquery: subquery}
+}
+
+// NotEmpty checks that a text column is neither NULL nor empty
+func NotEmpty(column string) Predicate {
+	return raw("(" + column + " IS NOT NULL AND " + column + " <> '')")
+}
+
+// Empty checks that a text column is NULL or empty
+func Empty(column string) Predicate {
+	return raw("(" + column + " IS NULL OR " + column + " = '')")
+}
@@ -0,0 +1,262 @@
+/*
+Package querybuilder builds PostgreSQL SELECT queries made of many optional
+criteria, like the big companies and contacts query.
+
+Criteria are predicates which take care of their own positional arguments
+($1, $2...): placeholders are numbered when the query is built so callers
+never have to thread an index by hand. Predicates built from an empty user
+input are nil and simply ignored.
+
+Joins are declared once with Join() but only written in the query if the
+SELECT, WHERE or GROUP BY clauses (or another written join) reference their
+alias. So a table is only joined when a selected column or a criterion
+actually needs it. Predicates can be added to the ON clause of a join with
+And(), to only join some rows of a one-to-many table.
+
+Subqueries (Exists, NotExists) share the placeholders of the outer query and
+can reference its aliases, which is handy to filter on one-to-many tables
+without multiplying rows.
+
+Example:
+
+	q := querybuilder.New("company", "comp").
+		Join(querybuilder.LeftJoin("postal_address", "comp_ad", "comp_ad.id = comp.postal_address_id")).
+		Select("comp.id", "comp.name").
+		Where(querybuilder.UpperEq("comp_ad.locality", city))
+	sqlStmt, sqlArgs := q.Build()
+*/
+
+package querybuilder
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Join is a table which can be joined to the query
+type Join struct {
+	Kind    string
+	Table   string
+	Alias   string
+	On      string
+	filters []Predicate
+}
+
+// LeftJoin declares a LEFT JOIN
+func LeftJoin(table string, alias string, on string) Join {
+	return Join{Kind: "LEFT JOIN", Table: table, Alias: alias, On: on}
+}
+
+// InnerJoin declares an INNER JOIN
+func InnerJoin(table string, alias string, on string) Join {
+	return Join{Kind: "INNER JOIN", Table: table, Alias: alias, On: on}
+}
+
+// And adds predicates to the ON clause of a join. They should only reference the
+// joined alias, or the aliases already referenced by On, since joins needed by
+// them are not looked for. Nil predicates are ignored.
+func (j Join) And(predicates ...Predicate) Join {
+	filters := append([]Predicate{}, j.filters...)
+	for _, predicate := range predicates {
+		if predicate != nil {
+			filters = append(filters, predicate)
+		}
+	}
+	j.filters = filters
+	return j
+}
+
+// Query is a SELECT query built incrementally
+type Query struct {
+	table    string
+	alias    string
+	joins    []Join
+	selects  []string
+	where    []Predicate
+	groupBy  []string
+	required map[string]bool
+}
+
+// New starts a query on a base table
+func New(table string, alias string) *Query {
+	return &Query{table: table, alias: alias, required: make(map[string]bool)}
+}
+
+// Join declares tables which can be joined. Joins are written in the order they
+// are declared, so a join must be declared after the joins it depends on.
+func (q *Query) Join(joins ...Join) *Query {
+	q.joins = append(q.joins, joins...)
+	return q
+}
+
+// Require forces joins to be written even if nothing references them,
+// e.g. an INNER JOIN used to filter rows
+func (q *Query) Require(aliases ...string) *Query {
+	for _, alias := range aliases {
+		q.required[alias] = true
+	}
+	return q
+}
+
+// Select adds columns (or any SQL expression) to the SELECT clause
+func (q *Query) Select(columns ...string) *Query {
+	q.selects = append(q.selects, columns...)
+	return q
+}
+
+// Where adds predicates to the WHERE clause. All predicates are combined with AND.
+// Nil predicates are ignored.
+func (q *Query) Where(predicates ...Predicate) *Query {
+	for _, predicate := range predicates {
+		if predicate != nil {
+			q.where = append(q.where, predicate)
+		}
+	}
+	return q
+}
+
+// GroupBy adds columns to the GROUP BY clause
+func (q *Query) GroupBy(columns ...string) *Query {
+	q.groupBy = append(q.groupBy, columns...)
+	return q
+}
+
+// Build returns the SQL query and its positional arguments.
+// Arguments must be passed to db.Query() in this order.
+func (q *Query) Build() (string, []interface{}) {
+	b := &builder{}
+	q.writeTo(b)
+	return b.String(), b.args
+}
+
+// writeTo writes the query to a builder which may be shared with an outer
+// query, so placeholders of subqueries follow the ones of the outer query
+func (q *Query) writeTo(b *builder) {
+
+	// SELECT, WHERE and GROUP BY are written first in a separate builder
+	// sharing the same arguments, because we need them to know which joins to keep
+	tail := &builder{args: b.args}
+	if len(q.where) > 0 {
+		tail.WriteString(" WHERE ")
+		writePredicates(tail, q.where, " AND ")
+	}
+	if len(q.groupBy) > 0 {
+		tail.WriteString(" GROUP BY ")
+		tail.WriteString(strings.Join(q.groupBy, ", "))
+	}
+	selects := strings.Join(q.selects, ", ")
+
+	joins := q.neededJoins(selects + tail.String())
+
+	// Arguments of the ON clauses follow the ones of the other clauses, even if
+	// joins are written before them
+	ons := make([]string, len(joins))
+	for i, join := range joins {
+		on := &builder{args: tail.args}
+		on.WriteString(join.On)
+		for _, predicate := range join.filters {
+			on.WriteString(" AND ")
+			predicate.writeTo(on)
+		}
+		ons[i] = on.String()
+		tail.args = on.args
+	}
+
+	b.WriteString("SELECT ")
+	b.WriteString(selects)
+	b.WriteString(" FROM ")
+	b.WriteString(q.table)
+	b.WriteString(" AS ")
+	b.WriteString(q.alias)
+	for i, join := range joins {
+		b.WriteString(" ")
+		b.WriteString(join.Kind)
+		b.WriteString(" ")
+		b.WriteString(join.Table)
+		if join.Alias != join.Table {
+			b.WriteString(" AS ")
+			b.WriteString(join.Alias)
+		}
+		b.WriteString(" ON ")
+		b.WriteString(ons[i])
+	}
+	b.WriteString(tail.String())
+	b.args = tail.args
+
+}
+
+// neededJoins keeps the joins whose alias is referenced in sqlText or required,
+// plus the joins they depend on through their ON clause
+func (q *Query) neededJoins(sqlText string) []Join {
+
+	needed := make(map[string]bool)
+	for alias := range q.required {
+		needed[alias] = true
+	}
+	for _, join := range q.joins {
+		if references(sqlText, join.Alias) {
+			needed[join.Alias] = true
+		}
+	}
+
+	// A join may depend on a join declared before it (cont_ad depends on cont),
+	// so walk joins backwards until no new dependency is found
+	for changed := true; changed; {
+		changed = false
+		for i := len(q.joins) - 1; i >= 0; i-- {
+			if !needed[q.joins[i].Alias] {
+				continue
+			}
+			for _, other := range q.joins[:i] {
+				if !needed[other.Alias] && references(q.joins[i].On, other.Alias) {
+					needed[other.Alias] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	var joins []Join
+	for _, join := range q.joins {
+		if needed[join.Alias] {
+			joins = append(joins, join)
+		}
+	}
+	return joins
+
+}
+
+// references tells if some SQL uses a column of a table alias (e.g. "comp_ad.").
+// The alias must not be the end of a longer name: "ad." is not referenced by "comp_ad.".
+// It is called for every join of every query so it only scans the text, no regexp.
+func references(sqlText string, alias string) bool {
+	needle := alias + "."
+	for offset := 0; ; {
+		i := strings.Index(sqlText[offset:], needle)
+		if i < 0 {
+			return false
+		}
+		i += offset
+		if i == 0 || !isWordChar(sqlText[i-1]) {
+			return true
+		}
+		offset = i + 1
+	}
+}
+
+// isWordChar tells if a byte can be part of an SQL name
+func isWordChar(char byte) bool {
+	return char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+}
+
+// builder accumulates SQL text and positional arguments
+type builder struct {
+	strings.Builder
+	args []interface{}
+}
+
+// arg stores an argument and returns its placeholder
+func (b *builder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return "$" + strconv.Itoa(len(b.args))
+}
@@ -0,0 +1,176 @@
+package querybuilder
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestReferences(t *testing.T) {
+
+	tests := []struct {
+		sqlText string
+		alias   string
+		want    bool
+	}{
+		{"comp_ad.locality", "comp_ad", true},
+		{"UPPER(comp_ad.locality)", "comp_ad", true},
+		{"x = 1 AND comp_ad.country = $1", "comp_ad", true},
+		{"comp_ad.locality", "ad", false},
+		{"comp_ad.locality, ad.id", "ad", true},
+		{"comp_adx.locality", "comp_ad", false},
+		{"comp_ad locality", "comp_ad", false},
+		{"string_agg(DISTINCT job_function.name,'¤')", "job_function", true},
+		{"'¤'job_function.name", "job_function", true},
+		{"", "comp", false},
+		{"comp.", "comp", true},
+		{"2comp.id", "comp", false},
+	}
+	for _, test := range tests {
+		if got := references(test.sqlText, test.alias); got != test.want {
+			t.Errorf("references(%q, %q) = %v, want %v", test.sqlText, test.alias, got, test.want)
+		}
+		// Same result as the word boundary regexp used before
+		regexpResult := regexp.MustCompile(`\b` + regexp.QuoteMeta(test.alias) + `\.`).MatchString(test.sqlText)
+		if got := references(test.sqlText, test.alias); got != regexpResult {
+			t.Errorf("references(%q, %q) = %v, regexp gives %v", test.sqlText, test.alias, got, regexpResult)
+		}
+	}
+
+}
+
+func TestBuildKeepsOnlyNeededJoins(t *testing.T) {
+
+	newQuery := func() *Query {
+		return New("company", "comp").Join(
+			LeftJoin("postal_address", "comp_ad", "comp_ad.id = comp.postal_address_id"),
+			LeftJoin("prospect", "cont", "cont.company_id = comp.id"),
+			LeftJoin("postal_address", "cont_ad", "cont_ad.id = cont.postal_address_id"),
+		).Select("comp.id")
+	}
+
+	tests := []struct {
+		query    *Query
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			newQuery(),
+			"SELECT comp.id FROM company AS comp",
+			nil,
+		},
+		{
+			newQuery().Where(UpperEq("comp_ad.locality", "Paris")),
+			"SELECT comp.id FROM company AS comp LEFT JOIN postal_address AS comp_ad ON comp_ad.id = comp.postal_address_id WHERE UPPER(comp_ad.locality) = UPPER($1)",
+			[]interface{}{"Paris"},
+		},
+		{
+			// cont_ad needs cont
+			newQuery().Where(UpperEq("cont_ad.locality", "Paris"), UpperIn("comp.size", []string{"1-10", "11-50"})),
+			"SELECT comp.id FROM company AS comp LEFT JOIN prospect AS cont ON cont.company_id = comp.id LEFT JOIN postal_address AS cont_ad ON cont_ad.id = cont.postal_address_id WHERE UPPER(cont_ad.locality) = UPPER($1) AND (UPPER(comp.size) = UPPER($2) OR UPPER(comp.size) = UPPER($3))",
+			[]interface{}{"Paris", "1-10", "11-50"},
+		},
+		{
+			newQuery().Require("cont"),
+			"SELECT comp.id FROM company AS comp LEFT JOIN prospect AS cont ON cont.company_id = comp.id",
+			nil,
+		},
+		{
+			// Subqueries share the placeholders of the outer query
+			newQuery().Where(Eq("comp.domain", "example.com"), Exists(New("prospect", "p").Select("1").Where(Raw("p.company_id = comp.id"), Eq("p.gender", "F")))),
+			"SELECT comp.id FROM company AS comp WHERE comp.domain = $1 AND EXISTS (SELECT 1 FROM prospect AS p WHERE p.company_id = comp.id AND p.gender = $2)",
+			[]interface{}{"example.com", "F"},
+		},
+	}
+	for _, test := range tests {
+		sqlText, args := test.query.Build()
+		if sqlText != test.wantSQL {
+			t.Errorf("got SQL\n%s\nwant\n%s", sqlText, test.wantSQL)
+		}
+		if !reflect.DeepEqual(args, test.wantArgs) {
+			t.Errorf("got args %v, want %v", args, test.wantArgs)
+		}
+	}
+
+}
+
+func TestJoinPredicates(t *testing.T) {
+
+	emailJoin := LeftJoin("companyemail", "companyemail", "companyemail.company_id = comp.id")
+	tests := []struct {
+		query    *Query
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			// Arguments of ON clauses follow the ones of WHERE
+			New("company", "comp").Join(emailJoin.And(Eq("companyemail.status", "valid"), nil)).
+				Select("comp.id", "string_agg(companyemail.email, ',')").
+				Where(Eq("comp.size", "1-10")).GroupBy("comp.id"),
+			"SELECT comp.id, string_agg(companyemail.email, ',') FROM company AS comp LEFT JOIN companyemail ON companyemail.company_id = comp.id AND companyemail.status = $2 WHERE comp.size = $1 GROUP BY comp.id",
+			[]interface{}{"1-10", "valid"},
+		},
+		{
+			// Predicates alone do not make the join needed
+			New("company", "comp").Join(emailJoin.And(Eq("companyemail.status", "valid"))).Select("comp.id"),
+			"SELECT comp.id FROM company AS comp",
+			nil,
+		},
+		{
+			// The declared join is not changed by And()
+			New("company", "comp").Join(emailJoin).Select("companyemail.email"),
+			"SELECT companyemail.email FROM company AS comp LEFT JOIN companyemail ON companyemail.company_id = comp.id",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		sqlText, args := test.query.Build()
+		if sqlText != test.wantSQL {
+			t.Errorf("got SQL\n%s\nwant\n%s", sqlText, test.wantSQL)
+		}
+		if !reflect.DeepEqual(args, test.wantArgs) {
+			t.Errorf("got args %v, want %v", args, test.wantArgs)
+		}
+	}
+
+}
+
+func TestArrayPredicates(t *testing.T) {
+
+	tests := []struct {
+		predicate Predicate
+		wantSQL   string
+		wantArgs  []interface{}
+	}{
+		{
+			UpperNotInArray("cont_email.email", []string{"Ann@example.com"}),
+			"SELECT comp.id FROM company AS comp WHERE (cont_email.email IS NULL OR UPPER(cont_email.email) <> ALL($1))",
+			[]interface{}{pq.Array([]string{"ANN@EXAMPLE.COM"})},
+		},
+		{
+			// Subdomains are matched with a leading dot so that example.com does not exclude myexample.com
+			DomainNotInArray("comp.domain", []string{"example.com"}),
+			"SELECT comp.id FROM company AS comp WHERE (comp.domain IS NULL OR NOT EXISTS (SELECT 1 FROM unnest($1::text[]) AS excluded_domain(name) " +
+				"WHERE UPPER(comp.domain) = excluded_domain.name OR right(UPPER(comp.domain), length(excluded_domain.name) + 1) = '.' || excluded_domain.name))",
+			[]interface{}{pq.Array([]string{"EXAMPLE.COM"})},
+		},
+		{
+			// Empty arrays filter nothing
+			DomainNotInArray("comp.domain", nil),
+			"SELECT comp.id FROM company AS comp",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		sqlText, args := New("company", "comp").Select("comp.id").Where(test.predicate).Build()
+		if sqlText != test.wantSQL {
+			t.Errorf("got SQL\n%s\nwant\n%s", sqlText, test.wantSQL)
+		}
+		if !reflect.DeepEqual(args, test.wantArgs) {
+			t.Errorf("got args %v, want %v", args, test.wantArgs)
+		}
+	}
+
+}
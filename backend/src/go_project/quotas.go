@@ -0,0 +1,370 @@
+/*
+quotas.go limits how many rows and how many exports each user and each team can
+get, so nobody empties the database in a day.
+Quotas are set in the policy file (see policy.go), per user and per team, with a
+default quota for users not listed. A team quota applies to all its members
+together. Limits are:
+- rowsPerDay and rowsPerMonth: rows of full searches and exports (calendar day and month)
+- exportsPerDay: number of full searches and exports with results
+0 means no limit, which is the default.
+Usage is read from the export history (see export_history.go).
+Quotas are checked before the full step or an export starts, and again once the
+number of rows is known, when the export is reserved: usage is checked and the
+export recorded in one transaction, so concurrent searches of a user or of a team
+cannot all pass the check before any of them is recorded. The reservation is
+deleted if results cannot be delivered.
+Users over quota get a 429 error telling what is left.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Scopes of a quota
+const (
+	quotaScopeUser = "user"
+	quotaScopeTeam = "team"
+)
+
+// Quota stores the limits of a user or a team, 0 means no limit
+type Quota struct {
+	RowsPerDay    int `json:"rowsPerDay"`
+	RowsPerMonth  int `json:"rowsPerMonth"`
+	ExportsPerDay int `json:"exportsPerDay"`
+}
+
+// QuotaPolicy stores the quotas of users and teams
+type QuotaPolicy struct {
+	Default Quota            `json:"default"`
+	Users   map[string]Quota `json:"users"`
+	Teams   map[string]Quota `json:"teams"`
+}
+
+// QuotaUsage stores what a user or a team already got
+type QuotaUsage struct {
+	RowsToday     int `json:"rowsToday"`
+	RowsThisMonth int `json:"rowsThisMonth"`
+	ExportsToday  int `json:"exportsToday"`
+}
+
+// QuotaStatus stores the quota of a user or a team and what is left of it.
+// Remaining values are null when there is no limit.
+type QuotaStatus struct {
+	Scope            string     `json:"scope"`
+	Name             string     `json:"name"`
+	Quota            Quota      `json:"quota"`
+	Used             QuotaUsage `json:"used"`
+	RemainingRows    *int       `json:"remainingRows"`
+	RemainingExports *int       `json:"remainingExports"`
+}
+
+// validateQuota checks that limits are not negative
+func validateQuota(quota Quota, owner string) error {
+	if quota.RowsPerDay < 0 || quota.RowsPerMonth < 0 || quota.ExportsPerDay < 0 {
+		return errors.New("Quota of " + owner + " should not be negative.")
+	}
+	return nil
+}
+
+// validateQuotaPolicy checks that quotas are not negative and only refer to teams which exist
+func validateQuotaPolicy(p Policy) error {
+
+	err := validateQuota(p.Quotas.Default, "default")
+	if err != nil {
+		return err
+	}
+	for user, quota := range p.Quotas.Users {
+		err = validateQuota(quota, "user "+user)
+		if err != nil {
+			return err
+		}
+	}
+	for team, quota := range p.Quotas.Teams {
+		if _, ok := p.Teams[team]; !ok {
+			return errors.New("Team with a quota does not exist: " + team)
+		}
+		err = validateQuota(quota, "team "+team)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// getUserTeams returns the teams a user is member of
+func getUserTeams(user string) []string {
+	var teams []string
+	for team, members := range policy.Teams {
+		for _, member := range members {
+			if member == user {
+				teams = append(teams, team)
+				break
+			}
+		}
+	}
+	return teams
+}
+
+// getTeamMembers returns a user and the members of all its teams, sorted
+func getTeamMembers(user string) []string {
+	members := map[string]bool{user: true}
+	for _, team := range getUserTeams(user) {
+		for _, member := range policy.Teams[team] {
+			members[member] = true
+		}
+	}
+	var teamMembers []string
+	for member := range members {
+		teamMembers = append(teamMembers, member)
+	}
+	sort.Strings(teamMembers)
+	return teamMembers
+}
+
+// remaining returns what is left of a limit, or nil if there is no limit
+func remaining(limit int, used int) *int {
+	if limit == 0 {
+		return nil
+	}
+	left := limit - used
+	if left < 0 {
+		left = 0
+	}
+	return &left
+}
+
+// newQuotaStatus computes what is left of a quota
+func newQuotaStatus(scope string, name string, quota Quota, used QuotaUsage) QuotaStatus {
+	remainingRows := remaining(quota.RowsPerDay, used.RowsToday)
+	remainingMonthRows := remaining(quota.RowsPerMonth, used.RowsThisMonth)
+	if remainingRows == nil || (remainingMonthRows != nil && *remainingMonthRows < *remainingRows) {
+		remainingRows = remainingMonthRows
+	}
+	return QuotaStatus{
+		Scope:            scope,
+		Name:             name,
+		Quota:            quota,
+		Used:             used,
+		RemainingRows:    remainingRows,
+		RemainingExports: remaining(quota.ExportsPerDay, used.ExportsToday),
+	}
+}
+
+// queryRower runs queries returning one row, on a db or in a transaction
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// queryQuotaUsage reads from the export history what some users already got
+func queryQuotaUsage(ctx context.Context, db queryRower, users []string) (QuotaUsage, error) {
+
+	var used QuotaUsage
+	sqlStatement := `SELECT
+			COALESCE(SUM(rows_nb) FILTER (WHERE created_on >= date_trunc('day', now())), 0),
+			COALESCE(SUM(rows_nb), 0),
+			COUNT(*) FILTER (WHERE created_on >= date_trunc('day', now()))
+		FROM export
+		WHERE owner = ANY($1) AND created_on >= date_trunc('month', now())`
+	err := db.QueryRowContext(ctx, sqlStatement, pq.Array(users)).Scan(&used.RowsToday, &used.RowsThisMonth, &used.ExportsToday)
+	if err != nil {
+		return used, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	return used, nil
+
+}
+
+// getQuotaStatuses returns the quota of a user and of its teams with what is left
+func getQuotaStatuses(ctx context.Context, user string) ([]QuotaStatus, error) {
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return nil, CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	return queryQuotaStatuses(ctx, db, user)
+
+}
+
+// queryQuotaStatuses reads the quota of a user and of its teams with what is left
+func queryQuotaStatuses(ctx context.Context, db queryRower, user string) ([]QuotaStatus, error) {
+
+	userQuota, ok := policy.Quotas.Users[user]
+	if !ok {
+		userQuota = policy.Quotas.Default
+	}
+	used, err := queryQuotaUsage(ctx, db, []string{user})
+	if err != nil {
+		return nil, err
+	}
+	quotaStatuses := []QuotaStatus{newQuotaStatus(quotaScopeUser, user, userQuota, used)}
+
+	for _, team := range getUserTeams(user) {
+		teamQuota, ok := policy.Quotas.Teams[team]
+		if !ok {
+			continue
+		}
+		used, err = queryQuotaUsage(ctx, db, policy.Teams[team])
+		if err != nil {
+			return nil, err
+		}
+		quotaStatuses = append(quotaStatuses, newQuotaStatus(quotaScopeTeam, team, teamQuota, used))
+	}
+
+	return quotaStatuses, nil
+
+}
+
+// reserveExport checks that the rows of an export fit in the quotas of the owner
+// and of its teams, and records the export if they do. It returns the id of the
+// export, or why it would go over quota.
+// Usage of the owner and of its teammates is locked until the export is recorded,
+// always in the same order so two reservations cannot wait for each other.
+func reserveExport(ctx context.Context, owner string, step string, userInput UserInput, compAndContRows []CompAndContRow) (int, string, error) {
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return 0, "", CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", CustErr(err, "Could not start transaction.\nStopping here.")
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `SELECT pg_advisory_xact_lock(hashtext('quota:' || member))
+		FROM unnest($1::text[]) AS member ORDER BY member`
+	_, err = tx.ExecContext(ctx, sqlStatement, pq.Array(getTeamMembers(owner)))
+	if err != nil {
+		return 0, "", CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	quotaStatuses, err := queryQuotaStatuses(ctx, tx, owner)
+	if err != nil {
+		return 0, "", err
+	}
+	if reason := checkQuotas(quotaStatuses, len(compAndContRows)); reason != "" {
+		return 0, reason, nil
+	}
+
+	exportId, err := insertExport(ctx, tx, owner, step, userInput, compAndContRows)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, "", CustErr(err, "Could not commit transaction.\nStopping here.")
+	}
+
+	return exportId, "", nil
+
+}
+
+// describeRowsLimits describes the rows limits of a quota, like "1000 rows per day"
+func (q QuotaStatus) describeRowsLimits() string {
+	var limits []string
+	if q.Quota.RowsPerDay > 0 {
+		limits = append(limits, fmt.Sprintf("%d rows per day (%d used today)", q.Quota.RowsPerDay, q.Used.RowsToday))
+	}
+	if q.Quota.RowsPerMonth > 0 {
+		limits = append(limits, fmt.Sprintf("%d rows per month (%d used this month)", q.Quota.RowsPerMonth, q.Used.RowsThisMonth))
+	}
+	return strings.Join(limits, " and ")
+}
+
+// exceededBy tells why getting some rows would go over the quota, or returns
+// an empty string if it would not.
+// With 0 rows, it tells if the quota is already used up.
+func (q QuotaStatus) exceededBy(rowsNb int) string {
+
+	owner := "Your quota"
+	if q.Scope == quotaScopeTeam {
+		owner = "The quota of team " + q.Name
+	}
+
+	if q.RemainingExports != nil && *q.RemainingExports == 0 {
+		return fmt.Sprintf("%s of %d exports per day is used up. Please try again tomorrow.", owner, q.Quota.ExportsPerDay)
+	}
+	if q.RemainingRows == nil {
+		return ""
+	}
+	if *q.RemainingRows == 0 {
+		return fmt.Sprintf("%s of %s is used up. Please try again later.", owner, q.describeRowsLimits())
+	}
+	if rowsNb > *q.RemainingRows {
+		return fmt.Sprintf("This search returns %d rows but only %d rows are left. %s is %s. Please narrow the search down.",
+			rowsNb, *q.RemainingRows, owner, q.describeRowsLimits())
+	}
+
+	return ""
+
+}
+
+// checkQuotas tells why getting some rows would go over the quota of a user or
+// of one of its teams, or returns an empty string if it would not
+func checkQuotas(quotaStatuses []QuotaStatus, rowsNb int) string {
+	var reasons []string
+	for _, quotaStatus := range quotaStatuses {
+		if reason := quotaStatus.exceededBy(rowsNb); reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	return strings.Join(reasons, " ")
+}
+
+// refuseOverQuota answers the http request when the user is over quota
+func refuseOverQuota(reason string, w http.ResponseWriter) {
+	http.Error(w, reason, http.StatusTooManyRequests)
+}
+
+// ReturnQuotaStatus returns the quotas of the logged in user and of its teams
+// with what is left of them.
+// Roles allowed to see the audit trail can see the quotas of another user with
+// the user parameter in the query string.
+func ReturnQuotaStatus(w http.ResponseWriter, r *http.Request) {
+
+	user := getRequestUser(r)
+	if otherUser := r.URL.Query().Get("user"); otherUser != "" && otherUser != user {
+		if !getUserPermissions(user).CanSeeAudit {
+			forbid("Your role does not allow to see the quotas of other users.", w)
+			return
+		}
+		user = otherUser
+	}
+
+	quotaStatuses, err := getQuotaStatuses(r.Context(), user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	returnedJson, err := json.Marshal(quotaStatuses)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
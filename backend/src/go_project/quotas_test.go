@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewQuotaStatus(t *testing.T) {
+
+	tests := []struct {
+		name             string
+		quota            Quota
+		used             QuotaUsage
+		remainingRows    *int
+		remainingExports *int
+	}{
+		{"no limit", Quota{}, QuotaUsage{RowsToday: 50, ExportsToday: 3}, nil, nil},
+		{"day only", Quota{RowsPerDay: 100}, QuotaUsage{RowsToday: 30}, intPtr(70), nil},
+		{"month only", Quota{RowsPerMonth: 1000}, QuotaUsage{RowsThisMonth: 400}, intPtr(600), nil},
+		{"month is lower", Quota{RowsPerDay: 100, RowsPerMonth: 1000}, QuotaUsage{RowsToday: 10, RowsThisMonth: 950}, intPtr(50), nil},
+		{"day is lower", Quota{RowsPerDay: 100, RowsPerMonth: 1000}, QuotaUsage{RowsToday: 80, RowsThisMonth: 500}, intPtr(20), nil},
+		{"used over limit", Quota{RowsPerDay: 100, ExportsPerDay: 2}, QuotaUsage{RowsToday: 130, ExportsToday: 5}, intPtr(0), intPtr(0)},
+		{"exports", Quota{ExportsPerDay: 5}, QuotaUsage{ExportsToday: 2}, nil, intPtr(3)},
+	}
+	for _, test := range tests {
+		quotaStatus := newQuotaStatus(quotaScopeUser, "alice", test.quota, test.used)
+		if !equalIntPtr(quotaStatus.RemainingRows, test.remainingRows) {
+			t.Errorf("%s: got remaining rows %s, want %s", test.name, formatIntPtr(quotaStatus.RemainingRows), formatIntPtr(test.remainingRows))
+		}
+		if !equalIntPtr(quotaStatus.RemainingExports, test.remainingExports) {
+			t.Errorf("%s: got remaining exports %s, want %s", test.name, formatIntPtr(quotaStatus.RemainingExports), formatIntPtr(test.remainingExports))
+		}
+	}
+
+}
+
+func TestCheckQuotas(t *testing.T) {
+
+	userStatus := newQuotaStatus(quotaScopeUser, "alice", Quota{RowsPerDay: 100}, QuotaUsage{RowsToday: 60})
+	teamStatus := newQuotaStatus(quotaScopeTeam, "sales", Quota{RowsPerMonth: 1000, ExportsPerDay: 10}, QuotaUsage{RowsThisMonth: 980})
+	usedUpStatus := newQuotaStatus(quotaScopeUser, "alice", Quota{ExportsPerDay: 1}, QuotaUsage{ExportsToday: 1})
+
+	tests := []struct {
+		name          string
+		quotaStatuses []QuotaStatus
+		rowsNb        int
+		reasons       []string
+	}{
+		{"no quota", nil, 1000000, nil},
+		{"within both", []QuotaStatus{userStatus, teamStatus}, 20, nil},
+		{"over team", []QuotaStatus{userStatus, teamStatus}, 30, []string{"only 20 rows are left. The quota of team sales"}},
+		{"over both", []QuotaStatus{userStatus, teamStatus}, 50, []string{"only 40 rows are left. Your quota", "only 20 rows are left. The quota of team sales"}},
+		{"exports used up", []QuotaStatus{usedUpStatus}, 0, []string{"Your quota of 1 exports per day is used up."}},
+	}
+	for _, test := range tests {
+		reason := checkQuotas(test.quotaStatuses, test.rowsNb)
+		if len(test.reasons) == 0 && reason != "" {
+			t.Errorf("%s: got %q, want no reason", test.name, reason)
+		}
+		for _, want := range test.reasons {
+			if !strings.Contains(reason, want) {
+				t.Errorf("%s: got %q, want it to contain %q", test.name, reason, want)
+			}
+		}
+	}
+
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func equalIntPtr(a *int, b *int) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func formatIntPtr(i *int) string {
+	if i == nil {
+		return "no limit"
+	}
+	return fmt.Sprint(*i)
+}
+
+func TestConcurrentExportsCannotGoOverQuota(t *testing.T) {
+
+	db := requireLocalDB(t)
+	owner := randomName(t, "quota-")
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM export WHERE owner = $1`, owner)
+	})
+	savedPolicy := policy
+	t.Cleanup(func() { policy = savedPolicy })
+	policy = defaultPolicy
+	policy.Quotas = QuotaPolicy{Users: map[string]Quota{owner: {RowsPerDay: 25}}}
+
+	// 10 rows each, only 2 exports fit in the quota
+	var rows []CompAndContRow
+	for i := 0; i < 10; i++ {
+		var row CompAndContRow
+		row.CompId = fmt.Sprint(i + 1)
+		rows = append(rows, row)
+	}
+
+	const exportsNb = 8
+	var wg sync.WaitGroup
+	reasons := make([]string, exportsNb)
+	errs := make([]error, exportsNb)
+	for i := 0; i < exportsNb; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, reasons[i], errs[i] = reserveExport(context.Background(), owner, "export", UserInput{}, rows)
+		}(i)
+	}
+	wg.Wait()
+
+	reservedNb := 0
+	for i := 0; i < exportsNb; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if reasons[i] == "" {
+			reservedNb++
+		}
+	}
+	if reservedNb != 2 {
+		t.Errorf("%d exports of 10 rows reserved with a quota of 25 rows, want 2", reservedNb)
+	}
+
+	// Exports which could not be delivered do not count
+	var exportId int
+	err := db.QueryRow(`SELECT id FROM export WHERE owner = $1 LIMIT 1`, owner).Scan(&exportId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelExport(exportId)
+	if _, reason, err := reserveExport(context.Background(), owner, "export", UserInput{}, rows); err != nil || reason != "" {
+		t.Errorf("export refused once another one was canceled: %v %s", err, reason)
+	}
+
+}
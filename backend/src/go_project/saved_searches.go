@@ -0,0 +1,462 @@
+/*
+saved_searches.go lets users save the criteria of a search under a name, so
+they do not have to fill the twenty fields of the form (and upload the same
+domains CSV) every week.
+Saved searches are stored in the local db. A user sees their own searches plus
+the ones shared by the members of their teams of the policy (see policy.go), but
+only the owner can modify or delete one.
+A saved search can be run directly by id for a count, the full results or an
+export by email.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SavedSearch stores a named user input.
+// UserInput is not returned in lists to keep them light since domain lists can be huge.
+type SavedSearch struct {
+	Id        int        `json:"id"`
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Shared    bool       `json:"shared"`
+	UserInput *UserInput `json:"userInput,omitempty"`
+	CreatedOn time.Time  `json:"createdOn"`
+	UpdatedOn time.Time  `json:"updatedOn"`
+}
+
+// SavedSearchRun stores what to do with a saved search: step can be count, full or export.
+// QueryId and Shape have the same meaning as in UserInput.
+type SavedSearchRun struct {
+	Step    string `json:"step"`
+	QueryId string `json:"queryId"`
+	Shape   string `json:"shape"`
+}
+
+// validateSavedSearch applies validation rules on a saved search sent by frontend
+// and cleans its user input
+func validateSavedSearch(savedSearchPtr *SavedSearch) error {
+
+	savedSearchPtr.Name = strings.TrimSpace(savedSearchPtr.Name)
+	if savedSearchPtr.Name == "" {
+		return errors.New("Name of the saved search is empty.")
+	}
+	if len(savedSearchPtr.Name) > 200 {
+		return errors.New("Name of the saved search is too long (200 max).")
+	}
+	if savedSearchPtr.UserInput == nil {
+		return errors.New("Search criteria are missing.")
+	}
+
+	// Step and query id only make sense when running a search so they are not saved.
+	// Step is set to count only to pass validation.
+	userInput := *savedSearchPtr.UserInput
+	userInput.Step = "count"
+	userInput.QueryId = ""
+	err := validateUserInput(&userInput)
+	if err != nil {
+		return err
+	}
+	cleanUserInput(&userInput)
+	userInput.Step = ""
+	savedSearchPtr.UserInput = &userInput
+
+	return err
+
+}
+
+// readSavedSearch reads and validates the saved search sent in the request body
+func readSavedSearch(r *http.Request, w http.ResponseWriter) (SavedSearch, error) {
+
+	var savedSearch SavedSearch
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = CustErr(err, "Cannot read request body.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return savedSearch, err
+	}
+
+	err = json.Unmarshal(body, &savedSearch)
+	if err != nil {
+		err = CustErr(err, "Cannot unmarshall json.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return savedSearch, err
+	}
+
+	err = validateSavedSearch(&savedSearch)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return savedSearch, err
+	}
+
+	return savedSearch, err
+
+}
+
+// getSavedSearchId gets the saved search id from url
+func getSavedSearchId(r *http.Request, w http.ResponseWriter) (int, error) {
+	savedSearchId, err := strconv.Atoi(mux.Vars(r)["savedsearchid"])
+	if err != nil {
+		err = CustErr(err, "Saved search id is not an integer.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Saved search id should be an integer.", http.StatusBadRequest)
+	}
+	return savedSearchId, err
+}
+
+// querySavedSearch gets a saved search with its user input if the user can see it
+// (owner or search shared by a teammate). Returns sql.ErrNoRows if not found.
+func querySavedSearch(ctx context.Context, savedSearchId int, user string) (SavedSearch, error) {
+
+	var savedSearch SavedSearch
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return savedSearch, CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	var rawUserInput []byte
+	sqlStatement := `SELECT id, name, owner, shared, user_input, created_on, updated_on
+		FROM saved_search WHERE id = $1 AND (owner = $2 OR (shared AND owner = ANY($3)))`
+	err = db.QueryRowContext(ctx, sqlStatement, savedSearchId, user, pq.Array(getTeamMembers(user))).Scan(
+		&savedSearch.Id,
+		&savedSearch.Name,
+		&savedSearch.Owner,
+		&savedSearch.Shared,
+		&rawUserInput,
+		&savedSearch.CreatedOn,
+		&savedSearch.UpdatedOn,
+	)
+	if err == sql.ErrNoRows {
+		return savedSearch, err
+	}
+	if err != nil {
+		return savedSearch, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+
+	savedSearch.UserInput = &UserInput{}
+	err = json.Unmarshal(rawUserInput, savedSearch.UserInput)
+	if err != nil {
+		return savedSearch, CustErr(err, "Cannot unmarshall saved user input.\nStopping here.")
+	}
+
+	return savedSearch, err
+
+}
+
+// getSavedSearchFromDB gets a saved search the user can see and answers the
+// http request with an error if needed
+func getSavedSearchFromDB(ctx context.Context, savedSearchId int, user string, w http.ResponseWriter) (SavedSearch, error) {
+
+	savedSearch, err := querySavedSearch(ctx, savedSearchId, user)
+	if err == sql.ErrNoRows {
+		log.Println("No saved search found for this id: " + strconv.Itoa(savedSearchId) + "\nStopping here.")
+		http.Error(w, "Not found", http.StatusNotFound)
+		return savedSearch, err
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return savedSearch, err
+	}
+
+	return savedSearch, err
+
+}
+
+// writeSavedSearch sends a saved search as JSON with a status code
+func writeSavedSearch(savedSearch SavedSearch, statusCode int, w http.ResponseWriter) {
+
+	returnedJson, err := json.Marshal(savedSearch)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// CreateSavedSearch saves a new search for the user
+func CreateSavedSearch(w http.ResponseWriter, r *http.Request) {
+
+	savedSearch, err := readSavedSearch(r, w)
+	if err != nil {
+		return
+	}
+	savedSearch.Owner = getRequestUser(r)
+
+	rawUserInput, err := json.Marshal(savedSearch.UserInput)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO saved_search (name, owner, shared, user_input)
+		VALUES ($1, $2, $3, $4) RETURNING id, created_on, updated_on`
+	err = db.QueryRowContext(r.Context(), sqlStatement, savedSearch.Name, savedSearch.Owner, savedSearch.Shared, string(rawUserInput)).Scan(
+		&savedSearch.Id,
+		&savedSearch.CreatedOn,
+		&savedSearch.UpdatedOn,
+	)
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeSavedSearch(savedSearch, http.StatusCreated, w)
+
+}
+
+// ReturnSavedSearchesList returns the searches saved by the user and the ones
+// shared by their teammates, most recently updated first, without their criteria
+func ReturnSavedSearchesList(w http.ResponseWriter, r *http.Request) {
+
+	savedSearches := []SavedSearch{}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT id, name, owner, shared, created_on, updated_on
+		FROM saved_search WHERE owner = $1 OR (shared AND owner = ANY($2)) ORDER BY updated_on DESC`
+	user := getRequestUser(r)
+	rows, err := db.QueryContext(r.Context(), sqlStatement, user, pq.Array(getTeamMembers(user)))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var savedSearch SavedSearch
+		err = rows.Scan(
+			&savedSearch.Id,
+			&savedSearch.Name,
+			&savedSearch.Owner,
+			&savedSearch.Shared,
+			&savedSearch.CreatedOn,
+			&savedSearch.UpdatedOn,
+		)
+		if err != nil {
+			err = CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		savedSearches = append(savedSearches, savedSearch)
+	}
+
+	returnedJson, err := json.Marshal(savedSearches)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// ReturnSavedSearch returns a saved search with its criteria
+func ReturnSavedSearch(w http.ResponseWriter, r *http.Request) {
+
+	savedSearchId, err := getSavedSearchId(r, w)
+	if err != nil {
+		return
+	}
+
+	savedSearch, err := getSavedSearchFromDB(r.Context(), savedSearchId, getRequestUser(r), w)
+	if err != nil {
+		return
+	}
+
+	writeSavedSearch(savedSearch, http.StatusOK, w)
+
+}
+
+// UpdateSavedSearch replaces the name, sharing and criteria of a saved search.
+// Only the owner can do it.
+func UpdateSavedSearch(w http.ResponseWriter, r *http.Request) {
+
+	savedSearchId, err := getSavedSearchId(r, w)
+	if err != nil {
+		return
+	}
+
+	savedSearch, err := readSavedSearch(r, w)
+	if err != nil {
+		return
+	}
+	savedSearch.Id = savedSearchId
+	savedSearch.Owner = getRequestUser(r)
+
+	rawUserInput, err := json.Marshal(savedSearch.UserInput)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `UPDATE saved_search SET name = $1, shared = $2, user_input = $3, updated_on = now()
+		WHERE id = $4 AND owner = $5 RETURNING created_on, updated_on`
+	err = db.QueryRowContext(r.Context(), sqlStatement, savedSearch.Name, savedSearch.Shared, string(rawUserInput), savedSearch.Id, savedSearch.Owner).Scan(
+		&savedSearch.CreatedOn,
+		&savedSearch.UpdatedOn,
+	)
+	if err == sql.ErrNoRows {
+		log.Println("No saved search owned by user found for this id: " + strconv.Itoa(savedSearchId) + "\nStopping here.")
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeSavedSearch(savedSearch, http.StatusOK, w)
+
+}
+
+// DeleteSavedSearch deletes a saved search. Only the owner can do it.
+func DeleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+
+	savedSearchId, err := getSavedSearchId(r, w)
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `DELETE FROM saved_search WHERE id = $1 AND owner = $2`
+	res, err := db.ExecContext(r.Context(), sqlStatement, savedSearchId, getRequestUser(r))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if rowsNb, err := res.RowsAffected(); err == nil && rowsNb == 0 {
+		log.Println("No saved search owned by user found for this id: " + strconv.Itoa(savedSearchId) + "\nStopping here.")
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// RunSavedSearch runs a saved search exactly like a search sent by the form
+func RunSavedSearch(w http.ResponseWriter, r *http.Request) {
+
+	savedSearchId, err := getSavedSearchId(r, w)
+	if err != nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = CustErr(err, "Cannot read request body.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var savedSearchRun SavedSearchRun
+	err = json.Unmarshal(body, &savedSearchRun)
+	if err != nil {
+		err = CustErr(err, "Cannot unmarshall json.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if savedSearchRun.Step != "count" && savedSearchRun.Step != "full" && savedSearchRun.Step != "export" {
+		http.Error(w, "Step should be either count, full or export.", http.StatusBadRequest)
+		return
+	}
+
+	savedSearch, err := getSavedSearchFromDB(r.Context(), savedSearchId, getRequestUser(r), w)
+	if err != nil {
+		return
+	}
+
+	// Saved criteria were valid when saved but validation rules may have changed since
+	userInput := *savedSearch.UserInput
+	userInput.Step = savedSearchRun.Step
+	userInput.QueryId = savedSearchRun.QueryId
+	userInput.Shape = savedSearchRun.Shape
+	err = validateUserInput(&userInput)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cleanUserInput(&userInput)
+
+	runSearch(userInput, w, r)
+
+}
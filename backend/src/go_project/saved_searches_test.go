@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSharedSearchesAreOnlySeenByTheTeam(t *testing.T) {
+
+	db := requireLocalDB(t)
+	alice, bob, carol := randomName(t, "alice-"), randomName(t, "bob-"), randomName(t, "carol-")
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM saved_search WHERE owner = $1`, alice)
+	})
+	savedPolicy := policy
+	t.Cleanup(func() { policy = savedPolicy })
+	policy = defaultPolicy
+	policy.Teams = map[string][]string{"sales": {alice, bob}}
+
+	var savedSearchId int
+	err := db.QueryRow(`INSERT INTO saved_search (name, owner, shared, user_input) VALUES ('France', $1, true, '{}') RETURNING id`, alice).Scan(&savedSearchId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for user, wantSeen := range map[string]bool{alice: true, bob: true, carol: false} {
+		_, err := querySavedSearch(context.Background(), savedSearchId, user)
+		if wantSeen && err != nil {
+			t.Errorf("%s cannot get the shared search: %v", user, err)
+		}
+		if !wantSeen && err != sql.ErrNoRows {
+			t.Errorf("%s of another team got the shared search: %v", user, err)
+		}
+
+		r := httptest.NewRequest("GET", "/get-saved-searches-list", nil)
+		r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, user))
+		w := httptest.NewRecorder()
+		ReturnSavedSearchesList(w, r)
+		var savedSearches []SavedSearch
+		if err := json.Unmarshal(w.Body.Bytes(), &savedSearches); err != nil {
+			t.Fatal(err)
+		}
+		seen := false
+		for _, savedSearch := range savedSearches {
+			seen = seen || savedSearch.Id == savedSearchId
+		}
+		if seen != wantSeen {
+			t.Errorf("%s sees the shared search in the list: %v, want %v", user, seen, wantSeen)
+		}
+	}
+
+}
@@ -0,0 +1,686 @@
+/*
+scheduled_exports.go runs saved searches periodically and delivers the export
+automatically, e.g. every Monday at 8:00 the new contacts in France updated
+in the past week.
+A schedule is a saved search, a cron expression (see cron.go) and a timezone.
+Results are either sent by email or stored as a .zip file in the exports
+directory. Every run is recorded with its status and number of rows.
+The scheduler checks every minute for schedules due. A schedule is claimed by
+moving its next run date, so a schedule is run only once even if several
+backends share the same local db.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Possible deliveries of a scheduled export
+const (
+	deliveryEmail = "email"
+	deliveryFile  = "file"
+)
+
+// Possible statuses of a scheduled export run
+const (
+	runStatusRunning = "running"
+	runStatusSuccess = "success"
+	runStatusEmpty   = "empty"
+	runStatusFailed  = "failed"
+	runStatusPending = "pending-approval"
+)
+
+// ScheduledExport stores when to run a saved search and how to deliver results.
+// Email is only used if delivery is email. If empty, results are sent to USER_EMAIL.
+// NextRunOn is null once the cron expression cannot match anymore.
+type ScheduledExport struct {
+	Id            int        `json:"id"`
+	SavedSearchId int        `json:"savedSearchId"`
+	Owner         string     `json:"owner"`
+	Cron          string     `json:"cron"`
+	Timezone      string     `json:"timezone"`
+	Delivery      string     `json:"delivery"`
+	Email         string     `json:"email"`
+	Active        bool       `json:"active"`
+	NextRunOn     *time.Time `json:"nextRunOn"`
+	CreatedOn     time.Time  `json:"createdOn"`
+}
+
+// ScheduledExportRun stores the result of one run of a scheduled export.
+// FilePath is only set for file deliveries.
+type ScheduledExportRun struct {
+	Id                int        `json:"id"`
+	ScheduledExportId int        `json:"scheduledExportId"`
+	StartedOn         time.Time  `json:"startedOn"`
+	EndedOn           *time.Time `json:"endedOn"`
+	Status            string     `json:"status"`
+	RowsNb            *int       `json:"rowsNb"`
+	FilePath          *string    `json:"filePath"`
+	Error             *string    `json:"error"`
+}
+
+// getExportsDir gets the directory where scheduled exports delivered as files are
+// stored from env var set by Docker run. It should be a mounted volume.
+// If no env var set, set it to exports.
+func getExportsDir() string {
+	envContent := os.Getenv("EXPORTS_DIR")
+	if envContent == "" {
+		envContent = "exports"
+	}
+	return envContent
+}
+
+// nextRunOn computes the next run date of a schedule after t.
+// Returns nil if the cron expression cannot match anymore.
+func nextRunOn(cron string, timezone string, t time.Time) (*time.Time, error) {
+
+	schedule, err := parseCron(cron)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, errors.New("Unknown timezone: " + timezone)
+	}
+
+	next := schedule.next(t, loc)
+	if next.IsZero() {
+		return nil, nil
+	}
+	return &next, nil
+
+}
+
+// validateScheduledExport applies validation rules on a scheduled export sent by frontend
+func validateScheduledExport(scheduledExportPtr *ScheduledExport) error {
+
+	scheduledExportPtr.Cron = strings.TrimSpace(scheduledExportPtr.Cron)
+	if scheduledExportPtr.Timezone == "" {
+		scheduledExportPtr.Timezone = "UTC"
+	}
+	next, err := nextRunOn(scheduledExportPtr.Cron, scheduledExportPtr.Timezone, time.Now())
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		return errors.New("Cron expression never matches any date.")
+	}
+	scheduledExportPtr.NextRunOn = next
+
+	switch scheduledExportPtr.Delivery {
+	case deliveryEmail:
+		// Results go to a single bare address: no display name, no list of addresses
+		scheduledExportPtr.Email = strings.TrimSpace(scheduledExportPtr.Email)
+		if scheduledExportPtr.Email != "" {
+			address, err := mail.ParseAddress(scheduledExportPtr.Email)
+			if err != nil || address.Address != scheduledExportPtr.Email {
+				return errors.New("Email should be a single address like name@example.com.")
+			}
+		}
+	case deliveryFile:
+		scheduledExportPtr.Email = ""
+	default:
+		return errors.New("Delivery should be email or file.")
+	}
+
+	return nil
+
+}
+
+// getScheduledExportId gets the scheduled export id from url
+func getScheduledExportId(r *http.Request, w http.ResponseWriter) (int, error) {
+	scheduledExportId, err := strconv.Atoi(mux.Vars(r)["scheduledexportid"])
+	if err != nil {
+		err = CustErr(err, "Scheduled export id is not an integer.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Scheduled export id should be an integer.", http.StatusBadRequest)
+	}
+	return scheduledExportId, err
+}
+
+// CreateScheduledExport schedules a saved search the user can see
+func CreateScheduledExport(w http.ResponseWriter, r *http.Request) {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = CustErr(err, "Cannot read request body.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var scheduledExport ScheduledExport
+	err = json.Unmarshal(body, &scheduledExport)
+	if err != nil {
+		err = CustErr(err, "Cannot unmarshall json.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = validateScheduledExport(&scheduledExport)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scheduledExport.Owner = getRequestUser(r)
+	scheduledExport.Active = true
+
+	if !getUserPermissions(scheduledExport.Owner).CanExport {
+		forbid("Your role does not allow exports.", w)
+		return
+	}
+
+	// Only schedule a search the user can see
+	_, err = getSavedSearchFromDB(r.Context(), scheduledExport.SavedSearchId, scheduledExport.Owner, w)
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO scheduled_export (saved_search_id, owner, cron, timezone, delivery, email, next_run_on)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_on`
+	err = db.QueryRowContext(r.Context(), sqlStatement,
+		scheduledExport.SavedSearchId,
+		scheduledExport.Owner,
+		scheduledExport.Cron,
+		scheduledExport.Timezone,
+		scheduledExport.Delivery,
+		scheduledExport.Email,
+		scheduledExport.NextRunOn,
+	).Scan(
+		&scheduledExport.Id,
+		&scheduledExport.CreatedOn,
+	)
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	returnedJson, err := json.Marshal(scheduledExport)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// ReturnScheduledExportsList returns the scheduled exports of the user
+func ReturnScheduledExportsList(w http.ResponseWriter, r *http.Request) {
+
+	scheduledExports := []ScheduledExport{}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT id, saved_search_id, owner, cron, timezone, delivery, COALESCE(email, ''),
+		active, next_run_on, created_on
+		FROM scheduled_export WHERE owner = $1 ORDER BY created_on DESC`
+	rows, err := db.QueryContext(r.Context(), sqlStatement, getRequestUser(r))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scheduledExport ScheduledExport
+		err = rows.Scan(
+			&scheduledExport.Id,
+			&scheduledExport.SavedSearchId,
+			&scheduledExport.Owner,
+			&scheduledExport.Cron,
+			&scheduledExport.Timezone,
+			&scheduledExport.Delivery,
+			&scheduledExport.Email,
+			&scheduledExport.Active,
+			&scheduledExport.NextRunOn,
+			&scheduledExport.CreatedOn,
+		)
+		if err != nil {
+			err = CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		scheduledExports = append(scheduledExports, scheduledExport)
+	}
+
+	returnedJson, err := json.Marshal(scheduledExports)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// DeleteScheduledExport deletes a scheduled export and its runs. Only the owner can do it.
+func DeleteScheduledExport(w http.ResponseWriter, r *http.Request) {
+
+	scheduledExportId, err := getScheduledExportId(r, w)
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `DELETE FROM scheduled_export WHERE id = $1 AND owner = $2`
+	res, err := db.ExecContext(r.Context(), sqlStatement, scheduledExportId, getRequestUser(r))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if rowsNb, err := res.RowsAffected(); err == nil && rowsNb == 0 {
+		log.Println("No scheduled export owned by user found for this id: " + strconv.Itoa(scheduledExportId) + "\nStopping here.")
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// ReturnScheduledExportRuns returns the last runs of a scheduled export of the user
+func ReturnScheduledExportRuns(w http.ResponseWriter, r *http.Request) {
+
+	scheduledExportId, err := getScheduledExportId(r, w)
+	if err != nil {
+		return
+	}
+
+	scheduledExportRuns := []ScheduledExportRun{}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT run.id, run.scheduled_export_id, run.started_on, run.ended_on, run.status,
+		run.rows_nb, run.file_path, run.error
+		FROM scheduled_export_run AS run
+		INNER JOIN scheduled_export AS sched ON sched.id = run.scheduled_export_id
+		WHERE sched.id = $1 AND sched.owner = $2
+		ORDER BY run.started_on DESC LIMIT 100`
+	rows, err := db.QueryContext(r.Context(), sqlStatement, scheduledExportId, getRequestUser(r))
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scheduledExportRun ScheduledExportRun
+		err = rows.Scan(
+			&scheduledExportRun.Id,
+			&scheduledExportRun.ScheduledExportId,
+			&scheduledExportRun.StartedOn,
+			&scheduledExportRun.EndedOn,
+			&scheduledExportRun.Status,
+			&scheduledExportRun.RowsNb,
+			&scheduledExportRun.FilePath,
+			&scheduledExportRun.Error,
+		)
+		if err != nil {
+			err = CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		scheduledExportRuns = append(scheduledExportRuns, scheduledExportRun)
+	}
+
+	returnedJson, err := json.Marshal(scheduledExportRuns)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// runScheduler checks every minute for scheduled exports due and runs them
+// in the background. It never returns.
+func runScheduler() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := runDueScheduledExports()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// runDueScheduledExports claims the scheduled exports due and runs them
+func runDueScheduledExports() error {
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT id, saved_search_id, owner, cron, timezone, delivery, COALESCE(email, ''), next_run_on
+		FROM scheduled_export WHERE active AND next_run_on <= now()`
+	rows, err := db.Query(sqlStatement)
+	if err != nil {
+		return CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+	var dueExports []ScheduledExport
+	for rows.Next() {
+		var scheduledExport ScheduledExport
+		err = rows.Scan(
+			&scheduledExport.Id,
+			&scheduledExport.SavedSearchId,
+			&scheduledExport.Owner,
+			&scheduledExport.Cron,
+			&scheduledExport.Timezone,
+			&scheduledExport.Delivery,
+			&scheduledExport.Email,
+			&scheduledExport.NextRunOn,
+		)
+		if err != nil {
+			rows.Close()
+			return CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+		}
+		dueExports = append(dueExports, scheduledExport)
+	}
+	rows.Close()
+
+	for _, scheduledExport := range dueExports {
+
+		// Runs missed while the backend was down are not caught up, next run is
+		// computed from now
+		next, err := nextRunOn(scheduledExport.Cron, scheduledExport.Timezone, time.Now())
+		if err != nil {
+			log.Println(CustErr(err, "Scheduled export "+strconv.Itoa(scheduledExport.Id)+" is not valid anymore.\nNOT stopping here."))
+			continue
+		}
+
+		// Claim the run. If next_run_on changed in the meantime, someone else did it.
+		sqlStatement = `UPDATE scheduled_export SET next_run_on = $1, active = $2
+			WHERE id = $3 AND next_run_on = $4`
+		res, err := db.Exec(sqlStatement, next, next != nil, scheduledExport.Id, scheduledExport.NextRunOn)
+		if err != nil {
+			log.Println(CustErr(err, "Following query failed: "+sqlStatement+"\nNOT stopping here."))
+			continue
+		}
+		if rowsNb, err := res.RowsAffected(); err != nil || rowsNb == 0 {
+			continue
+		}
+
+		go runScheduledExport(scheduledExport)
+	}
+
+	return nil
+
+}
+
+// runScheduledExport runs the saved search of a scheduled export, delivers results
+// and records the run
+func runScheduledExport(scheduledExport ScheduledExport) {
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		log.Println(CustErr(err, "DB connection failed\nStopping here."))
+		return
+	}
+	defer db.Close()
+
+	var run ScheduledExportRun
+	sqlStatement := `INSERT INTO scheduled_export_run (scheduled_export_id, status)
+		VALUES ($1, $2) RETURNING id`
+	err = db.QueryRow(sqlStatement, scheduledExport.Id, runStatusRunning).Scan(&run.Id)
+	if err != nil {
+		log.Println(CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here."))
+		return
+	}
+
+	run.Status, run.RowsNb, run.FilePath, err = exportScheduledSearch(scheduledExport)
+	if err != nil {
+		log.Println(err)
+		run.Status = runStatusFailed
+		errMsg := err.Error()
+		run.Error = &errMsg
+	}
+
+	sqlStatement = `UPDATE scheduled_export_run SET ended_on = now(), status = $1, rows_nb = $2,
+		file_path = $3, error = $4 WHERE id = $5`
+	_, err = db.Exec(sqlStatement, run.Status, run.RowsNb, run.FilePath, run.Error, run.Id)
+	if err != nil {
+		log.Println(CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here."))
+	}
+
+}
+
+// exportScheduledSearch runs the saved search of a scheduled export through the same
+// path as background exports and delivers the results.
+// Returns the status of the run, the number of rows and the path of the file if any.
+// The run is audited like any other search.
+func exportScheduledSearch(scheduledExport ScheduledExport) (status string, rowsNb *int, filePath *string, err error) {
+
+	startedOn := time.Now()
+	userInput := UserInput{Step: "export"}
+	defer func() {
+		statusCode, delivery := http.StatusOK, scheduledExport.Delivery
+		switch {
+		case err != nil:
+			statusCode = http.StatusInternalServerError
+		case status == runStatusEmpty:
+			statusCode, delivery = http.StatusNotFound, deliveryNone
+		case status == runStatusPending:
+			statusCode, delivery = http.StatusAccepted, deliveryApproval
+		}
+		recordSearchAudit(scheduledExport.Owner, userInput, rowsNb, delivery, statusCode, time.Since(startedOn))
+	}()
+
+	// The role of the owner may have changed since the export was scheduled
+	if !getUserPermissions(scheduledExport.Owner).CanExport {
+		return runStatusFailed, nil, nil, errors.New("Role of the owner does not allow exports anymore.")
+	}
+
+	// The saved search may have been unshared since the export was scheduled
+	savedSearch, err := querySavedSearch(context.Background(), scheduledExport.SavedSearchId, scheduledExport.Owner)
+	if err == sql.ErrNoRows {
+		return runStatusFailed, nil, nil, errors.New("Saved search not found or not shared anymore.")
+	}
+	if err != nil {
+		return runStatusFailed, nil, nil, err
+	}
+	userInput = *savedSearch.UserInput
+	userInput.Step = "export"
+	err = validateUserInput(&userInput)
+	if err != nil {
+		return runStatusFailed, nil, nil, err
+	}
+	cleanUserInput(&userInput)
+	err = resolveExportExclusions(context.Background(), scheduledExport.Owner, &userInput)
+	if err != nil {
+		return runStatusFailed, nil, nil, err
+	}
+	err = resolveSuppressions(context.Background(), &userInput)
+	if err != nil {
+		return runStatusFailed, nil, nil, err
+	}
+
+	quotaStatuses, err := getQuotaStatuses(context.Background(), scheduledExport.Owner)
+	if err != nil {
+		return runStatusFailed, nil, nil, err
+	}
+	if reason := checkQuotas(quotaStatuses, 0); reason != "" {
+		return runStatusFailed, nil, nil, errors.New(reason)
+	}
+
+	// The search may have become too heavy since the export was scheduled
+	sqlStmtStr, sqlArgs := buildSQLReq(false, userInput)
+	queryPlan, err := queryExplainSQLReq(context.Background(), sqlStmtStr, sqlArgs)
+	if err != nil {
+		return runStatusFailed, nil, nil, err
+	}
+	if isQueryTooExpensive(queryPlan, "export") {
+		return runStatusFailed, nil, nil, errors.New(tooExpensiveMessage(queryPlan, "export"))
+	}
+
+	// Scheduled exports share the export slots with background exports and
+	// wait as long as needed for their turn
+	ticket, err := queryLimiters[limitExport].enqueue(scheduledExport.Owner, "")
+	if err != nil {
+		return runStatusFailed, nil, nil, err
+	}
+	ticket.wait(context.Background(), 0)
+	defer ticket.release()
+
+	// Data must be fresh so do not use the cache
+	compAndContRows, err := queryFullSQLReq(context.Background(), sqlStmtStr, sqlArgs, userInput.Mode, getStatementTimeout("export"))
+	if err != nil {
+		return runStatusFailed, nil, nil, err
+	}
+	foundRowsNb := len(compAndContRows)
+	if foundRowsNb == 0 {
+		return runStatusEmpty, &foundRowsNb, nil, nil
+	}
+
+	// Quota may have been used by other searches while waiting
+	quotaStatuses, err = getQuotaStatuses(context.Background(), scheduledExport.Owner)
+	if err != nil {
+		return runStatusFailed, &foundRowsNb, nil, err
+	}
+	if reason := checkQuotas(quotaStatuses, foundRowsNb); reason != "" {
+		return runStatusFailed, &foundRowsNb, nil, errors.New(reason)
+	}
+
+	// Very large exports wait for the approval of a manager and are then sent by email
+	if needsApproval(foundRowsNb) {
+		_, err = requestExportApproval(context.Background(), scheduledExport.Owner, userInput, foundRowsNb)
+		if err != nil {
+			return runStatusFailed, &foundRowsNb, nil, err
+		}
+		return runStatusPending, &foundRowsNb, nil, nil
+	}
+
+	// Quotas are checked again while recording the export, other searches may have
+	// used them meanwhile
+	exportId, reason, err := reserveExport(context.Background(), scheduledExport.Owner, "scheduled", userInput, compAndContRows)
+	if err != nil {
+		return runStatusFailed, &foundRowsNb, nil, err
+	}
+	if reason != "" {
+		return runStatusFailed, &foundRowsNb, nil, errors.New(reason)
+	}
+
+	maskedRows := protectRows(compAndContRows, userInput, getUserPermissions(scheduledExport.Owner).MaskedFields)
+	err = exportCSV(maskedRows, userInput, func(archivePath string) error {
+		if scheduledExport.Delivery == deliveryFile {
+			path := filepath.Join(getExportsDir(), fmt.Sprintf("scheduled-export-%d-%s.zip",
+				scheduledExport.Id, time.Now().Format("20060102-150405")))
+			filePath = &path
+			return copyFile(archivePath, path)
+		}
+		to := scheduledExport.Email
+		if to == "" {
+			to = getUserEmail()
+		}
+		return sendResultsByEmail(to, archivePath)
+	})
+	if err != nil {
+		cancelExport(exportId)
+		return runStatusFailed, &foundRowsNb, nil, err
+	}
+
+	return runStatusSuccess, &foundRowsNb, filePath, nil
+
+}
+
+// copyFile copies a file, creating the destination directory if needed
+func copyFile(src string, dst string) error {
+
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateScheduledExportEmail(t *testing.T) {
+
+	tests := []struct {
+		email string
+		valid bool
+		want  string
+	}{
+		{"", true, ""},
+		{"alice@example.com", true, "alice@example.com"},
+		{"  alice@example.com ", true, "alice@example.com"},
+		{"alice", false, ""},
+		{"alice@", false, ""},
+		{"@example.com", false, ""},
+		{"Alice <alice@example.com>", false, ""},
+		{"<alice@example.com>", false, ""},
+		{"alice@example.com, bob@example.com", false, ""},
+		{"alice@example.com bob@example.com", false, ""},
+	}
+	for _, test := range tests {
+		scheduledExport := ScheduledExport{Cron: "0 8 * * 1", Delivery: deliveryEmail, Email: test.email}
+		err := validateScheduledExport(&scheduledExport)
+		if test.valid && err != nil {
+			t.Errorf("%q: got %v, want it accepted", test.email, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: should be rejected", test.email)
+		}
+		if test.valid && scheduledExport.Email != test.want {
+			t.Errorf("%q: got email %q, want %q", test.email, scheduledExport.Email, test.want)
+		}
+	}
+
+}
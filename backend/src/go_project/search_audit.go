@@ -0,0 +1,228 @@
+/*
+search_audit.go keeps a structured audit trail of searches for compliance:
+who ran which search (full criteria), which step, how many rows were returned
+or exported, how results were delivered, the status code and the duration.
+It is stored in the local db and can be queried by roles allowed to (see
+policy.go) with filters by user, step and date.
+Searches are audited when the http response is sent. Background and scheduled
+exports are audited again once their results are delivered since the number of
+rows is only known then.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/lib/pq"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Possible deliveries of search results
+const (
+	deliveryJson       = "json"
+	deliveryBackground = "background"
+	deliveryNone       = "none"
+	deliveryApproval   = "approval"
+)
+
+// SearchAudit stores one audited search.
+// RowsNb is null when unknown (estimate, dry-run, background export started...).
+type SearchAudit struct {
+	Id         int             `json:"id"`
+	User       string          `json:"user"`
+	Step       string          `json:"step"`
+	QueryId    string          `json:"queryId"`
+	UserInput  json.RawMessage `json:"userInput"`
+	RowsNb     *int            `json:"rowsNb"`
+	Delivery   string          `json:"delivery"`
+	StatusCode int             `json:"statusCode"`
+	DurationMs int64           `json:"durationMs"`
+	CreatedOn  time.Time       `json:"createdOn"`
+}
+
+// searchAuditWriter wraps the response writer of a search to catch the status code
+// sent back, and stores what is known about the search until it is audited
+type searchAuditWriter struct {
+	http.ResponseWriter
+	user       string
+	userInput  UserInput
+	rowsNb     *int
+	delivery   string
+	statusCode int
+	startedOn  time.Time
+}
+
+// startSearchAudit starts auditing a search. The returned writer must be used
+// for the response and recorded once the response is sent.
+func startSearchAudit(user string, userInput UserInput, w http.ResponseWriter) *searchAuditWriter {
+	return &searchAuditWriter{
+		ResponseWriter: w,
+		user:           user,
+		userInput:      userInput,
+		delivery:       deliveryNone,
+		statusCode:     http.StatusOK,
+		startedOn:      time.Now(),
+	}
+}
+
+func (a *searchAuditWriter) WriteHeader(statusCode int) {
+	a.statusCode = statusCode
+	a.ResponseWriter.WriteHeader(statusCode)
+}
+
+// setResult stores how many rows were found and how they were delivered
+func (a *searchAuditWriter) setResult(rowsNb int, delivery string) {
+	a.rowsNb = &rowsNb
+	a.delivery = delivery
+}
+
+// record writes the audit of the search in the background so the response is not delayed
+func (a *searchAuditWriter) record() {
+	go recordSearchAudit(a.user, a.userInput, a.rowsNb, a.delivery, a.statusCode, time.Since(a.startedOn))
+}
+
+// recordSearchAudit writes the audit of a search in the local db.
+// Search is already over so errors are only logged.
+func recordSearchAudit(user string, userInput UserInput, rowsNb *int, delivery string, statusCode int, duration time.Duration) {
+
+	rawUserInput, err := json.Marshal(userInput)
+	if err != nil {
+		log.Println(CustErr(err, "Could not marshall to JSON.\nStopping here."))
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		log.Println(CustErr(err, "DB connection failed\nStopping here."))
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO search_audit (user_name, step, query_id, user_input, rows_nb, delivery, status_code, duration_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err = db.Exec(sqlStatement, user, userInput.Step, userInput.QueryId, string(rawUserInput), rowsNb, delivery, statusCode, int64(duration/time.Millisecond))
+	if err != nil {
+		log.Println(CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here."))
+	}
+
+}
+
+// ReturnSearchAudit returns the audited searches, most recent first.
+// Optional filters in the query string: user, step, from and to (dates as YYYY-MM-DD,
+// to is included) and limit (500 by default, 5000 max).
+func ReturnSearchAudit(w http.ResponseWriter, r *http.Request) {
+
+	if !getUserPermissions(getRequestUser(r)).CanSeeAudit {
+		forbid("Your role does not allow to see the audit trail.", w)
+		return
+	}
+
+	// Build the WHERE clause from filters
+	var conditions []string
+	var args []interface{}
+	params := r.URL.Query()
+	if user := params.Get("user"); user != "" {
+		args = append(args, user)
+		conditions = append(conditions, "user_name = $"+strconv.Itoa(len(args)))
+	}
+	if step := params.Get("step"); step != "" {
+		args = append(args, step)
+		conditions = append(conditions, "step = $"+strconv.Itoa(len(args)))
+	}
+	if from := params.Get("from"); from != "" {
+		fromDate, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			http.Error(w, "From should be a date like 2006-01-02.", http.StatusBadRequest)
+			return
+		}
+		args = append(args, fromDate)
+		conditions = append(conditions, "created_on >= $"+strconv.Itoa(len(args)))
+	}
+	if to := params.Get("to"); to != "" {
+		toDate, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			http.Error(w, "To should be a date like 2006-01-02.", http.StatusBadRequest)
+			return
+		}
+		args = append(args, toDate.AddDate(0, 0, 1))
+		conditions = append(conditions, "created_on < $"+strconv.Itoa(len(args)))
+	}
+	limit := 500
+	if rawLimit := params.Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > 5000 {
+			http.Error(w, "Limit should be an integer between 1 and 5000.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sqlStatement := `SELECT id, user_name, step, query_id, user_input, rows_nb, delivery, status_code, duration_ms, created_on
+		FROM search_audit`
+	if len(conditions) > 0 {
+		sqlStatement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sqlStatement += " ORDER BY created_on DESC LIMIT " + strconv.Itoa(limit)
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(r.Context(), sqlStatement, args...)
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	searchAudits := []SearchAudit{}
+	for rows.Next() {
+		var searchAudit SearchAudit
+		var rawUserInput []byte
+		err = rows.Scan(
+			&searchAudit.Id,
+			&searchAudit.User,
+			&searchAudit.Step,
+			&searchAudit.QueryId,
+			&rawUserInput,
+			&searchAudit.RowsNb,
+			&searchAudit.Delivery,
+			&searchAudit.StatusCode,
+			&searchAudit.DurationMs,
+			&searchAudit.CreatedOn,
+		)
+		if err != nil {
+			err = CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		searchAudit.UserInput = json.RawMessage(rawUserInput)
+		searchAudits = append(searchAudits, searchAudit)
+	}
+
+	returnedJson, err := json.Marshal(searchAudits)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
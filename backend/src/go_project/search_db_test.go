@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// Number of companies seeded in the search test db, each with 10 contacts
+const searchDBCompaniesNb = 2000
+
+// searchDBSchema creates the remote db tables read by the searches, with only the columns
+// used by buildSQLReq
+const searchDBSchema = `
+CREATE TABLE postal_address (id serial PRIMARY KEY, street_number text, route text, postal_code text, locality text, administrative_area_level_2 text, administrative_area_level_1 text, country text);
+CREATE TABLE company (id serial PRIMARY KEY, name text, domain text, website text, telephone text, faxnumber text, size text, founded text, created_on timestamp, updated_on timestamp, postal_address_id integer);
+CREATE TABLE companyemail (id serial PRIMARY KEY, company_id integer, email text);
+CREATE TABLE companysocialprofile (id serial PRIMARY KEY, company_id integer, url text, type text, industry text);
+CREATE TABLE job_level (id serial PRIMARY KEY, name text);
+CREATE TABLE job_function (id serial PRIMARY KEY, name text);
+CREATE TABLE prospectemail (id serial PRIMARY KEY, email text, status text, created_on timestamp);
+CREATE TABLE prospectsocialprofile (id serial PRIMARY KEY, url text, industry text);
+CREATE TABLE prospect (id serial PRIMARY KEY, company_id integer, postal_address_id integer, job_level_id integer, email_id integer, social_profile_id integer, gender text, first_name text, last_name text, job_title text, telephone text, created_on timestamp, updated_on timestamp);
+CREATE TABLE prospect_job_function_mapping (prospect_id integer, job_function_id integer);
+CREATE TABLE savelistprospectcustomersgroup (prospect_id integer, group_id integer);
+`
+
+// searchDBData seeds companies with 10 contacts each, several emails, social profiles,
+// job functions and remote groups so the joins multiply rows like in production.
+// Some emails are NULL or empty like in the remote db. %[1]d is the number of companies.
+const searchDBData = `
+INSERT INTO postal_address (street_number, route, postal_code, locality, administrative_area_level_2, administrative_area_level_1, country)
+SELECT i::text, 'Route ' || i, lpad((i %% 95000)::text, 5, '0'), 'City ' || (i %% 50), 'Area2', 'Area1', (ARRAY['France', 'Spain', 'Italy', 'United States'])[1 + i %% 4]
+FROM generate_series(1, 11 * %[1]d) AS i;
+INSERT INTO company (name, domain, website, telephone, faxnumber, size, founded, created_on, updated_on, postal_address_id)
+SELECT 'Company ' || i, 'company' || i || '.com', 'https://company' || i || '.com', CASE WHEN i %% 3 = 0 THEN '' ELSE '0102030405' END, '', (ARRAY['1-10', '11-50', '51-200'])[1 + i %% 3], '2000', now(), now(), i
+FROM generate_series(1, %[1]d) AS i;
+INSERT INTO companyemail (company_id, email)
+SELECT c, CASE WHEN c %% 4 = 0 THEN NULL ELSE 'contact' || n || '@company' || c || '.com' END
+FROM generate_series(1, %[1]d) AS c, generate_series(1, 2) AS n;
+INSERT INTO companysocialprofile (company_id, url, type, industry)
+SELECT c, 'https://linkedin.com/company/' || c || '-' || n, (ARRAY['Privately Held', 'Public Company'])[1 + c %% 2], (ARRAY['Software', 'Retail', 'Banking'])[1 + (c + n) %% 3]
+FROM generate_series(1, %[1]d) AS c, generate_series(1, 2) AS n;
+INSERT INTO job_level (name) VALUES ('C-Level'), ('Director'), ('Manager'), ('Staff');
+INSERT INTO job_function (name) VALUES ('Sales'), ('Marketing'), ('IT'), ('Finance'), ('HR');
+INSERT INTO prospectemail (email, status, created_on)
+SELECT CASE WHEN i %% 5 = 0 THEN '' WHEN i %% 7 = 0 THEN NULL ELSE 'person' || i || '@example' || (i %% 3) || '.com' END, 'valid', now()
+FROM generate_series(1, 10 * %[1]d) AS i;
+INSERT INTO prospectsocialprofile (url, industry)
+SELECT 'https://linkedin.com/in/person' || i, (ARRAY['Software', 'Insurance'])[1 + i %% 2]
+FROM generate_series(1, 10 * %[1]d) AS i;
+INSERT INTO prospect (company_id, postal_address_id, job_level_id, email_id, social_profile_id, gender, first_name, last_name, job_title, telephone, created_on, updated_on)
+SELECT 1 + (i - 1) / 10, %[1]d + i, 1 + i %% 4, i, i, 'M', 'First' || i, 'Last' || i, (ARRAY['Sales Engineer', 'Marketing Manager', 'CEO', 'Developer'])[1 + i %% 4], CASE WHEN i %% 2 = 0 THEN '0600000000' ELSE '' END, now(), now() - make_interval(days => i %% 60)
+FROM generate_series(1, 10 * %[1]d) AS i;
+INSERT INTO prospect_job_function_mapping (prospect_id, job_function_id)
+SELECT p, 1 + (p + n) %% 5 FROM generate_series(1, 10 * %[1]d) AS p, generate_series(1, 2) AS n;
+INSERT INTO savelistprospectcustomersgroup (prospect_id, group_id)
+SELECT p, 1 + (p + n) %% 100 FROM generate_series(1, 10 * %[1]d) AS p, generate_series(1, 2) AS n;
+CREATE INDEX ON companyemail (company_id);
+CREATE INDEX ON companysocialprofile (company_id);
+CREATE INDEX ON prospect (company_id);
+CREATE INDEX ON prospect_job_function_mapping (prospect_id);
+CREATE INDEX ON savelistprospectcustomersgroup (prospect_id);
+ANALYZE;
+`
+
+// requireSearchDB returns a db seeded with fake companies and contacts, for tests and
+// benchmarks of the searches. They are skipped unless TEST_SEARCH_DB is the connection
+// string of a throwaway database, e.g. "host=127.0.0.1 dbname=search_test sslmode=disable".
+// NEVER use the remote db: the tables are created and filled the first time.
+func requireSearchDB(tb testing.TB) *sql.DB {
+
+	tb.Helper()
+	dbInfo := os.Getenv("TEST_SEARCH_DB")
+	if dbInfo == "" {
+		tb.Skip("Set TEST_SEARCH_DB to the connection string of a throwaway database to run tests needing seeded search tables.")
+	}
+
+	db, err := sql.Open("postgres", dbInfo)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	var seeded bool
+	err = db.QueryRow("SELECT to_regclass('savelistprospectcustomersgroup') IS NOT NULL").Scan(&seeded)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if seeded {
+		return db
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(searchDBSchema); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err = tx.Exec(fmt.Sprintf(searchDBData, searchDBCompaniesNb)); err != nil {
+		tb.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+
+	return db
+
+}
@@ -0,0 +1,71 @@
+/*
+search_modes.go converts results of the companies-only and contacts-only
+search modes into their own lighter JSON and CSV formats.
+In these modes buildSQLReq only selects the company columns, or the contact
+columns plus a few company columns, so the other fields of CompAndContRow
+are always empty and should not be sent back.
+*/
+
+package main
+
+// ContWithCompRow stores one contact returned in modeContacts together with
+// the company it belongs to.
+type ContWithCompRow struct {
+	CompId     string         `json:"compId"`
+	CompName   JsonNullString `json:"compName"`
+	CompDomain JsonNullString `json:"compDomain"`
+	ContRow
+}
+
+// toCompRows keeps the company part of rows returned in modeCompanies
+func toCompRows(compAndContRows []CompAndContRow) []CompRow {
+	compRows := make([]CompRow, 0, len(compAndContRows))
+	for _, row := range compAndContRows {
+		compRows = append(compRows, row.CompRow)
+	}
+	return compRows
+}
+
+// toContWithCompRows keeps the contact part of rows returned in modeContacts
+func toContWithCompRows(compAndContRows []CompAndContRow) []ContWithCompRow {
+	contRows := make([]ContWithCompRow, 0, len(compAndContRows))
+	for _, row := range compAndContRows {
+		contRows = append(contRows, ContWithCompRow{
+			CompId:     row.CompId,
+			CompName:   row.CompName,
+			CompDomain: row.CompDomain,
+			ContRow:    row.ContRow,
+		})
+	}
+	return contRows
+}
+
+// shapeResults returns what should be marshalled to JSON depending on the mode
+// and shape requested by user
+func shapeResults(compAndContRows []CompAndContRow, userInput UserInput) interface{} {
+	switch {
+	case userInput.Mode == modeCompanies:
+		return toCompRows(compAndContRows)
+	case userInput.Mode == modeContacts:
+		return toContWithCompRows(compAndContRows)
+	case userInput.Shape == shapeCompanies:
+		return groupRowsByCompany(compAndContRows)
+	}
+	return compAndContRows
+}
+
+// createCompaniesOnlyCSV puts companies returned in modeCompanies into a CSV file
+func createCompaniesOnlyCSV(csvPath string, compAndContRows []CompAndContRow) error {
+	return writeCSV(csvPath, companyCSVHeader, len(compAndContRows), func(i int) []string {
+		return compAndContRows[i].CompRow.csvRecord()
+	})
+}
+
+// createContactsOnlyCSV puts contacts returned in modeContacts into a CSV file
+func createContactsOnlyCSV(csvPath string, compAndContRows []CompAndContRow) error {
+	csvFirstRow := append([]string{"Company Id", "Company Name", "Company Domain"}, contactCSVHeader...)
+	return writeCSV(csvPath, csvFirstRow, len(compAndContRows), func(i int) []string {
+		row := compAndContRows[i]
+		return append([]string{row.CompId, row.CompName.String, row.CompDomain.String}, row.ContRow.csvRecord()...)
+	})
+}
@@ -0,0 +1,411 @@
+/*
+subject_access.go answers GDPR requests of people asking what we hold about
+them, instead of hand-writing SQL on every table.
+A person is found by email, or by first name, last name and company domain.
+Every matching record is gathered as is (all columns) from:
+- the remote db: prospect, prospectemail, postal_address, prospectsocialprofile,
+prospect_job_function_mapping, savelistprospectcustomersgroup and companyemail
+- the local db: email_checked_by_john, the export history and the suppression list
+The report is returned in JSON, or in a .zip archive with the JSON report and
+one CSV per table to send to the person.
+The remote db is read only for us so records cannot be erased there. Erasure
+requests are handled by adding the person to the suppression list (see
+suppressions.go), so it never appears in results anymore.
+Only roles allowed to (see canHandleSubjectRequests in policy.go) can do it.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Possible formats of a subject access report
+const (
+	reportFormatJson = "json"
+	reportFormatZip  = "zip"
+)
+
+// SubjectRequest stores who a GDPR request is about and what to do.
+// Either Email, or FirstName, LastName and Domain are needed.
+// Format is optional and defaults to json.
+// If Suppress is set, the person is added to the suppression list.
+type SubjectRequest struct {
+	Email     string `json:"email"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Domain    string `json:"domain"`
+	Format    string `json:"format"`
+	Suppress  bool   `json:"suppress"`
+}
+
+// SubjectRecords stores the records of a table about the person.
+// Columns keep the order of the table for CSV.
+type SubjectRecords struct {
+	Database string                   `json:"database"`
+	Table    string                   `json:"table"`
+	Columns  []string                 `json:"columns"`
+	Rows     []map[string]interface{} `json:"rows"`
+}
+
+// SubjectAccessReport stores everything we hold about a person
+type SubjectAccessReport struct {
+	Request      SubjectRequest       `json:"request"`
+	CreatedBy    string               `json:"createdBy"`
+	CreatedOn    time.Time            `json:"createdOn"`
+	ContactIds   []int64              `json:"contactIds"`
+	Records      []SubjectRecords     `json:"records"`
+	Suppressions SuppressionImportRes `json:"suppressions"`
+}
+
+// validateSubjectRequest checks that a person can be identified and cleans the request
+func validateSubjectRequest(subjectRequestPtr *SubjectRequest) error {
+
+	subjectRequestPtr.Email = strings.ToLower(strings.TrimSpace(subjectRequestPtr.Email))
+	subjectRequestPtr.FirstName = strings.TrimSpace(subjectRequestPtr.FirstName)
+	subjectRequestPtr.LastName = strings.TrimSpace(subjectRequestPtr.LastName)
+	subjectRequestPtr.Domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(subjectRequestPtr.Domain)), "www.")
+
+	isByName := subjectRequestPtr.FirstName != "" && subjectRequestPtr.LastName != "" && subjectRequestPtr.Domain != ""
+	if subjectRequestPtr.Email == "" && !isByName {
+		return errors.New("Email, or first name, last name and domain are needed.")
+	}
+	if subjectRequestPtr.Email != "" && strings.Count(subjectRequestPtr.Email, "@") != 1 {
+		return errors.New("Email is not valid: " + subjectRequestPtr.Email)
+	}
+	if subjectRequestPtr.Format == "" {
+		subjectRequestPtr.Format = reportFormatJson
+	}
+	if subjectRequestPtr.Format != reportFormatJson && subjectRequestPtr.Format != reportFormatZip {
+		return errors.New("Format should be either json or zip.")
+	}
+
+	return nil
+
+}
+
+// queryRecords runs a query and returns every row with all its columns, whatever the table
+func queryRecords(ctx context.Context, db *sql.DB, database string, table string, sqlStatement string, args ...interface{}) (SubjectRecords, error) {
+
+	records := SubjectRecords{Database: database, Table: table, Rows: []map[string]interface{}{}}
+
+	rows, err := db.QueryContext(ctx, sqlStatement, args...)
+	if err != nil {
+		return records, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+	defer rows.Close()
+
+	records.Columns, err = rows.Columns()
+	if err != nil {
+		return records, CustErr(err, "Cannot read columns.\nStopping here.")
+	}
+
+	for rows.Next() {
+		values := make([]interface{}, len(records.Columns))
+		valuePtrs := make([]interface{}, len(records.Columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		err = rows.Scan(valuePtrs...)
+		if err != nil {
+			return records, CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+		}
+		row := map[string]interface{}{}
+		for i, column := range records.Columns {
+			// Text comes as bytes which would be base64 in JSON
+			if value, ok := values[i].([]byte); ok {
+				row[column] = string(value)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		records.Rows = append(records.Rows, row)
+	}
+
+	return records, rows.Err()
+
+}
+
+// findSubjectContactIds returns the ids of the contacts matching the person in the remote db
+func findSubjectContactIds(ctx context.Context, db *sql.DB, subjectRequest SubjectRequest) ([]int64, error) {
+
+	var contactIds []int64
+	sqlStatement := `SELECT DISTINCT cont.id
+		FROM prospect AS cont
+		LEFT JOIN prospectemail AS cont_email ON cont_email.id = cont.email_id
+		LEFT JOIN company AS comp ON comp.id = cont.company_id
+		WHERE ($1 <> '' AND lower(cont_email.email) = $1)
+		OR ($2 <> '' AND lower(cont.first_name) = lower($2) AND lower(cont.last_name) = lower($3)
+			AND (lower(comp.domain) = $4 OR lower(split_part(cont_email.email, '@', 2)) = $4))
+		ORDER BY cont.id`
+	rows, err := db.QueryContext(ctx, sqlStatement, subjectRequest.Email, subjectRequest.FirstName, subjectRequest.LastName, subjectRequest.Domain)
+	if err != nil {
+		return nil, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var contactId int64
+		err = rows.Scan(&contactId)
+		if err != nil {
+			return nil, CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+		}
+		contactIds = append(contactIds, contactId)
+	}
+
+	return contactIds, rows.Err()
+
+}
+
+// buildSubjectAccessReport gathers every record about the person from both databases
+func buildSubjectAccessReport(ctx context.Context, subjectRequest SubjectRequest) (SubjectAccessReport, error) {
+
+	report := SubjectAccessReport{Request: subjectRequest, ContactIds: []int64{}, CreatedOn: time.Now()}
+
+	remoteDB, err := sql.Open("postgres", getRemoteDBInfo(getStatementTimeout("full")))
+	if err != nil {
+		return report, CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer remoteDB.Close()
+
+	contactIds, err := findSubjectContactIds(ctx, remoteDB, subjectRequest)
+	if err != nil {
+		return report, err
+	}
+	if contactIds != nil {
+		report.ContactIds = contactIds
+	}
+	contactIdsArg := pq.Array(report.ContactIds)
+
+	remoteQueries := []struct {
+		table        string
+		sqlStatement string
+		args         []interface{}
+	}{
+		{"prospect", `SELECT * FROM prospect WHERE id = ANY($1) ORDER BY id`, []interface{}{contactIdsArg}},
+		{"prospectemail", `SELECT * FROM prospectemail
+			WHERE id IN (SELECT email_id FROM prospect WHERE id = ANY($1)) OR ($2 <> '' AND lower(email) = $2)
+			ORDER BY id`, []interface{}{contactIdsArg, subjectRequest.Email}},
+		{"postal_address", `SELECT * FROM postal_address
+			WHERE id IN (SELECT postal_address_id FROM prospect WHERE id = ANY($1)) ORDER BY id`, []interface{}{contactIdsArg}},
+		{"prospectsocialprofile", `SELECT * FROM prospectsocialprofile
+			WHERE id IN (SELECT social_profile_id FROM prospect WHERE id = ANY($1)) ORDER BY id`, []interface{}{contactIdsArg}},
+		{"prospect_job_function_mapping", `SELECT * FROM prospect_job_function_mapping
+			WHERE prospect_id = ANY($1)`, []interface{}{contactIdsArg}},
+		{"savelistprospectcustomersgroup", `SELECT * FROM savelistprospectcustomersgroup
+			WHERE prospect_id = ANY($1)`, []interface{}{contactIdsArg}},
+		{"companyemail", `SELECT * FROM companyemail WHERE $1 <> '' AND lower(email) = $1 ORDER BY id`, []interface{}{subjectRequest.Email}},
+	}
+	for _, remoteQuery := range remoteQueries {
+		records, err := queryRecords(ctx, remoteDB, "remote", remoteQuery.table, remoteQuery.sqlStatement, remoteQuery.args...)
+		if err != nil {
+			return report, err
+		}
+		report.Records = append(report.Records, records)
+	}
+
+	localDB, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return report, CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer localDB.Close()
+
+	contactIdStrs := []string{}
+	for _, contactId := range report.ContactIds {
+		contactIdStrs = append(contactIdStrs, strconv.FormatInt(contactId, 10))
+	}
+	localQueries := []struct {
+		table        string
+		sqlStatement string
+		args         []interface{}
+	}{
+		{"email_checked_by_john", `SELECT * FROM email_checked_by_john
+			WHERE ($1 <> '' AND lower(email) = $1) OR contact_id = ANY($2)
+			OR ($3 <> '' AND lower(first_name) = lower($3) AND lower(last_name) = lower($4) AND lower(email_domain) = $5)
+			ORDER BY id`, []interface{}{subjectRequest.Email, contactIdsArg, subjectRequest.FirstName, subjectRequest.LastName, subjectRequest.Domain}},
+		{"export", `SELECT export.id, export.owner, export.step, export.created_on
+			FROM export
+			WHERE export.id IN (SELECT export_id FROM export_item WHERE contact_id = ANY($1))
+			ORDER BY export.created_on`, []interface{}{contactIdsArg}},
+		{"suppression", `SELECT * FROM suppression
+			WHERE (kind = 'email' AND value = $1) OR (kind = 'contact-id' AND value = ANY($2))
+			ORDER BY id`, []interface{}{subjectRequest.Email, pq.Array(contactIdStrs)}},
+	}
+	for _, localQuery := range localQueries {
+		records, err := queryRecords(ctx, localDB, "local", localQuery.table, localQuery.sqlStatement, localQuery.args...)
+		if err != nil {
+			return report, err
+		}
+		report.Records = append(report.Records, records)
+	}
+
+	return report, nil
+
+}
+
+// suppressSubject adds the email and the contacts of the person to the suppression list
+func suppressSubject(ctx context.Context, report SubjectAccessReport) (SuppressionImportRes, error) {
+
+	reason := "GDPR request of " + report.CreatedOn.Format("2006-01-02")
+	var suppressions []Suppression
+	if report.Request.Email != "" {
+		suppressions = append(suppressions, Suppression{Kind: suppressionEmail, Value: report.Request.Email, Reason: reason})
+	}
+	for _, contactId := range report.ContactIds {
+		suppressions = append(suppressions, Suppression{Kind: suppressionContactId, Value: strconv.FormatInt(contactId, 10), Reason: reason})
+	}
+
+	return insertSuppressions(ctx, suppressions, report.CreatedBy)
+
+}
+
+// formatRecordValue writes a value of a record in a CSV cell
+func formatRecordValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return value.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// zipSubjectAccessReport puts the JSON report and one CSV per table in a .zip archive
+func zipSubjectAccessReport(report SubjectAccessReport, reportJson []byte) ([]byte, error) {
+
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+
+	file, err := zipWriter.Create("report.json")
+	if err != nil {
+		return nil, CustErr(err, "Cannot add file to archive.\nStopping here.")
+	}
+	_, err = file.Write(reportJson)
+	if err != nil {
+		return nil, CustErr(err, "Cannot write file in archive.\nStopping here.")
+	}
+
+	for _, records := range report.Records {
+		file, err := zipWriter.Create(records.Database + "-" + records.Table + ".csv")
+		if err != nil {
+			return nil, CustErr(err, "Cannot add file to archive.\nStopping here.")
+		}
+		csvWriter := csv.NewWriter(file)
+		csvWriter.Write(records.Columns)
+		for _, row := range records.Rows {
+			cells := make([]string, len(records.Columns))
+			for i, column := range records.Columns {
+				cells[i] = formatRecordValue(row[column])
+			}
+			csvWriter.Write(cells)
+		}
+		csvWriter.Flush()
+		if err = csvWriter.Error(); err != nil {
+			return nil, CustErr(err, "Cannot write CSV in archive.\nStopping here.")
+		}
+	}
+
+	err = zipWriter.Close()
+	if err != nil {
+		return nil, CustErr(err, "Cannot close archive.\nStopping here.")
+	}
+
+	return archive.Bytes(), nil
+
+}
+
+// CreateSubjectAccessReport returns everything we hold about a person in JSON or in a
+// .zip archive, and adds the person to the suppression list if asked
+func CreateSubjectAccessReport(w http.ResponseWriter, r *http.Request) {
+
+	user := getRequestUser(r)
+	if !getUserPermissions(user).CanHandleSubjectRequests {
+		forbid("Your role does not allow to handle GDPR requests.", w)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = CustErr(err, "Cannot read request body.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var subjectRequest SubjectRequest
+	err = json.Unmarshal(body, &subjectRequest)
+	if err != nil {
+		err = CustErr(err, "Cannot unmarshall json.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = validateSubjectRequest(&subjectRequest)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := buildSubjectAccessReport(r.Context(), subjectRequest)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	report.CreatedBy = user
+
+	if subjectRequest.Suppress {
+		report.Suppressions, err = suppressSubject(r.Context(), report)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The person is not logged, only who handled the request
+	log.Println(fmt.Sprintf("Subject access report created by %s: %d contacts found, %d suppressions added.",
+		user, len(report.ContactIds), report.Suppressions.ImportedNb))
+
+	returnedJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if subjectRequest.Format == reportFormatZip {
+		archive, err := zipSubjectAccessReport(report, returnedJson)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"subject-access-report-"+report.CreatedOn.Format("20060102-150405")+".zip\"")
+		w.Write(archive)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
@@ -0,0 +1,602 @@
+/*
+suppressions.go manages the suppression list (do-not-contact): emails, domains
+and contact ids which must never appear in results, like GDPR opt-outs and
+competitors. Users do not have to remember excluding them anymore.
+The list is stored in the local db and applied by buildSQLReq to every search
+(count, full, export, scheduled and approved exports...):
+- email: contacts with this email are removed
+- domain: companies with this domain or one of its subdomains (www.example.com,
+mail.example.com...) and contacts with an email at any of them are removed
+- contact-id: contacts with this id are removed
+The list is read from the local db once and kept in memory since every search
+needs it, then passed to the remote query as arrays. Every write to the list
+drops the copy in memory, which also expires after a minute in case another
+instance of the app changed the list. The dry-run step never shows them, only
+how many values each array holds.
+Roles allowed to (see canManageSuppressions in policy.go) list, create, update,
+delete and import entries from a CSV file.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Possible kinds of suppression entries
+const (
+	suppressionEmail     = "email"
+	suppressionDomain    = "domain"
+	suppressionContactId = "contact-id"
+)
+
+// Suppression stores an entry of the suppression list
+type Suppression struct {
+	Id        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedOn time.Time `json:"createdOn"`
+}
+
+// suppressionsCacheTTL is how long the suppression list read from the local db is kept in memory
+const suppressionsCacheTTL = time.Minute
+
+// suppressionList is the suppression list kept in memory, valid until expiresAt.
+// The mutex is held while the list is read from the local db so a write cannot
+// be missed by a read which started before it.
+type suppressionList struct {
+	sync.Mutex
+	emails     []string
+	domains    []string
+	contactIds []int64
+	expiresAt  time.Time
+}
+
+var suppressionsCache = &suppressionList{}
+
+// invalidateSuppressions drops the suppression list kept in memory so the next
+// search reads it again from the local db
+func invalidateSuppressions() {
+	suppressionsCache.Lock()
+	defer suppressionsCache.Unlock()
+	suppressionsCache.expiresAt = time.Time{}
+}
+
+// SuppressionImportRes stores the result of a CSV import.
+// Entries already in the list are skipped.
+type SuppressionImportRes struct {
+	ImportedNb int `json:"importedNb"`
+	SkippedNb  int `json:"skippedNb"`
+}
+
+// validateSuppression checks the kind of a suppression entry and normalizes its value:
+// lower case, no spaces, no @ or www. before domains
+func validateSuppression(suppressionPtr *Suppression) error {
+
+	value := strings.ToLower(strings.TrimSpace(suppressionPtr.Value))
+	switch suppressionPtr.Kind {
+	case suppressionEmail:
+		if strings.Count(value, "@") != 1 || strings.HasPrefix(value, "@") || strings.HasSuffix(value, "@") {
+			return errors.New("Email is not valid: " + suppressionPtr.Value)
+		}
+	case suppressionDomain:
+		value = strings.TrimPrefix(strings.TrimPrefix(value, "@"), "www.")
+		if value == "" || strings.ContainsAny(value, "@/ ") || !strings.Contains(value, ".") {
+			return errors.New("Domain is not valid: " + suppressionPtr.Value)
+		}
+	case suppressionContactId:
+		contactId, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || contactId <= 0 {
+			return errors.New("Contact id should be a positive integer: " + suppressionPtr.Value)
+		}
+		value = strconv.FormatInt(contactId, 10)
+	default:
+		return errors.New("Kind should be either email, domain or contact-id: " + suppressionPtr.Kind)
+	}
+	suppressionPtr.Value = value
+
+	return nil
+
+}
+
+// getSuppressionId gets the suppression id from url
+func getSuppressionId(r *http.Request, w http.ResponseWriter) (int, error) {
+	suppressionId, err := strconv.Atoi(mux.Vars(r)["suppressionid"])
+	if err != nil {
+		err = CustErr(err, "Suppression id is not an integer.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Suppression id should be an integer.", http.StatusBadRequest)
+	}
+	return suppressionId, err
+}
+
+// canManageSuppressions checks that the user is allowed to manage the suppression list
+func canManageSuppressions(r *http.Request, w http.ResponseWriter) bool {
+	if !getUserPermissions(getRequestUser(r)).CanManageSuppressions {
+		forbid("Your role does not allow to manage the suppression list.", w)
+		return false
+	}
+	return true
+}
+
+// resolveSuppressions stores the suppression list in the user input, so buildSQLReq
+// can remove suppressed contacts and companies. The list is read from the local db
+// only if the copy in memory expired or was invalidated.
+func resolveSuppressions(ctx context.Context, userInputPtr *UserInput) error {
+
+	suppressionsCache.Lock()
+	defer suppressionsCache.Unlock()
+
+	if time.Now().After(suppressionsCache.expiresAt) {
+		err := loadSuppressions(ctx, suppressionsCache)
+		if err != nil {
+			return err
+		}
+		suppressionsCache.expiresAt = time.Now().Add(suppressionsCacheTTL)
+	}
+
+	// The slices are shared by searches, which never change them
+	userInputPtr.suppressedEmails = suppressionsCache.emails
+	userInputPtr.suppressedDomains = suppressionsCache.domains
+	userInputPtr.suppressedContactIds = suppressionsCache.contactIds
+
+	return nil
+
+}
+
+// loadSuppressions reads the suppression list from the local db
+func loadSuppressions(ctx context.Context, listPtr *suppressionList) error {
+
+	var emails, domains []string
+	var contactIds []int64
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT kind, value FROM suppression ORDER BY kind, value`
+	rows, err := db.QueryContext(ctx, sqlStatement)
+	if err != nil {
+		return CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, value string
+		err = rows.Scan(&kind, &value)
+		if err != nil {
+			return CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+		}
+		switch kind {
+		case suppressionEmail:
+			emails = append(emails, value)
+		case suppressionDomain:
+			domains = append(domains, value)
+		case suppressionContactId:
+			contactId, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				contactIds = append(contactIds, contactId)
+			}
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	listPtr.emails = emails
+	listPtr.domains = domains
+	listPtr.contactIds = contactIds
+	return nil
+
+}
+
+// ReturnSuppressionsList returns the entries of the suppression list, most recent first.
+// Optional filters in the query string: kind, search (part of the value) and limit
+// (500 by default, 5000 max).
+func ReturnSuppressionsList(w http.ResponseWriter, r *http.Request) {
+
+	if !canManageSuppressions(r, w) {
+		return
+	}
+
+	params := r.URL.Query()
+	limit := 500
+	if rawLimit := params.Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > 5000 {
+			http.Error(w, "Limit should be an integer between 1 and 5000.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	suppressions := []Suppression{}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	sqlStatement := `SELECT id, kind, value, reason, created_by, created_on
+		FROM suppression
+		WHERE ($1 = '' OR kind = $1) AND ($2 = '' OR value LIKE '%' || lower($2) || '%')
+		ORDER BY created_on DESC LIMIT $3`
+	rows, err := db.QueryContext(r.Context(), sqlStatement, params.Get("kind"), params.Get("search"), limit)
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var suppression Suppression
+		err = rows.Scan(
+			&suppression.Id,
+			&suppression.Kind,
+			&suppression.Value,
+			&suppression.Reason,
+			&suppression.CreatedBy,
+			&suppression.CreatedOn,
+		)
+		if err != nil {
+			err = CustErr(err, "One row could not be retrieved from DB.\nStopping here.")
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		suppressions = append(suppressions, suppression)
+	}
+
+	returnedJson, err := json.Marshal(suppressions)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// getSuppressionFromBody reads and validates a suppression entry sent in json
+func getSuppressionFromBody(r *http.Request, w http.ResponseWriter) (Suppression, error) {
+
+	var suppression Suppression
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = CustErr(err, "Cannot read request body.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return suppression, err
+	}
+
+	err = json.Unmarshal(body, &suppression)
+	if err != nil {
+		err = CustErr(err, "Cannot unmarshall json.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return suppression, err
+	}
+
+	err = validateSuppression(&suppression)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return suppression, err
+	}
+
+	return suppression, nil
+
+}
+
+// CreateSuppression adds an entry to the suppression list
+func CreateSuppression(w http.ResponseWriter, r *http.Request) {
+
+	if !canManageSuppressions(r, w) {
+		return
+	}
+
+	suppression, err := getSuppressionFromBody(r, w)
+	if err != nil {
+		return
+	}
+	suppression.CreatedBy = getRequestUser(r)
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+	defer invalidateSuppressions()
+
+	sqlStatement := `INSERT INTO suppression (kind, value, reason, created_by) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, value) DO NOTHING
+		RETURNING id, created_on`
+	err = db.QueryRowContext(r.Context(), sqlStatement,
+		suppression.Kind,
+		suppression.Value,
+		suppression.Reason,
+		suppression.CreatedBy,
+	).Scan(
+		&suppression.Id,
+		&suppression.CreatedOn,
+	)
+	if err == sql.ErrNoRows {
+		http.Error(w, "This "+suppression.Kind+" is already in the suppression list.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	returnedJson, err := json.Marshal(suppression)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// UpdateSuppression changes the kind, value or reason of an entry of the suppression list
+func UpdateSuppression(w http.ResponseWriter, r *http.Request) {
+
+	if !canManageSuppressions(r, w) {
+		return
+	}
+
+	suppressionId, err := getSuppressionId(r, w)
+	if err != nil {
+		return
+	}
+	suppression, err := getSuppressionFromBody(r, w)
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+	defer invalidateSuppressions()
+
+	sqlStatement := `UPDATE suppression SET kind = $1, value = $2, reason = $3 WHERE id = $4
+		RETURNING id, created_by, created_on`
+	err = db.QueryRowContext(r.Context(), sqlStatement,
+		suppression.Kind,
+		suppression.Value,
+		suppression.Reason,
+		suppressionId,
+	).Scan(
+		&suppression.Id,
+		&suppression.CreatedBy,
+		&suppression.CreatedOn,
+	)
+	if err == sql.ErrNoRows {
+		log.Println("No suppression found for this id: " + strconv.Itoa(suppressionId) + "\nStopping here.")
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		http.Error(w, "This "+suppression.Kind+" is already in the suppression list.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	returnedJson, err := json.Marshal(suppression)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
+
+// DeleteSuppression removes an entry from the suppression list
+func DeleteSuppression(w http.ResponseWriter, r *http.Request) {
+
+	if !canManageSuppressions(r, w) {
+		return
+	}
+
+	suppressionId, err := getSuppressionId(r, w)
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		err = CustErr(err, "DB connection failed\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+	defer invalidateSuppressions()
+
+	sqlStatement := `DELETE FROM suppression WHERE id = $1`
+	res, err := db.ExecContext(r.Context(), sqlStatement, suppressionId)
+	if err != nil {
+		err = CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if rowsNb, err := res.RowsAffected(); err == nil && rowsNb == 0 {
+		log.Println("No suppression found for this id: " + strconv.Itoa(suppressionId) + "\nStopping here.")
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// parseSuppressionsCSV reads suppression entries from a CSV with the kind, the
+// value and optionally the reason on each line. A header line is skipped.
+// Errors tell which line is wrong so the file can be fixed.
+func parseSuppressionsCSV(csvReader io.Reader) ([]Suppression, error) {
+
+	reader := csv.NewReader(csvReader)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var suppressions []Suppression
+	for lineNb := 1; ; lineNb++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, CustErr(err, "Cannot read CSV.\nStopping here.")
+		}
+		if lineNb == 1 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "kind") {
+			continue
+		}
+		if len(record) < 2 || len(record) > 3 {
+			return nil, errors.New(fmt.Sprintf("Line %d should be kind,value or kind,value,reason.", lineNb))
+		}
+		suppression := Suppression{Kind: strings.TrimSpace(record[0]), Value: record[1]}
+		if len(record) == 3 {
+			suppression.Reason = strings.TrimSpace(record[2])
+		}
+		err = validateSuppression(&suppression)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Line %d: %s", lineNb, err))
+		}
+		suppressions = append(suppressions, suppression)
+	}
+
+	return suppressions, nil
+
+}
+
+// insertSuppressions adds entries to the suppression list in one transaction.
+// Entries already in the list are skipped.
+func insertSuppressions(ctx context.Context, suppressions []Suppression, user string) (SuppressionImportRes, error) {
+
+	var importRes SuppressionImportRes
+
+	db, err := sql.Open("postgres", getLocalDBInfo())
+	if err != nil {
+		return importRes, CustErr(err, "DB connection failed\nStopping here.")
+	}
+	defer db.Close()
+	defer invalidateSuppressions()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return importRes, CustErr(err, "Could not start transaction.\nStopping here.")
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `INSERT INTO suppression (kind, value, reason, created_by) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, value) DO NOTHING`
+	for _, suppression := range suppressions {
+		res, err := tx.ExecContext(ctx, sqlStatement, suppression.Kind, suppression.Value, suppression.Reason, user)
+		if err != nil {
+			return SuppressionImportRes{}, CustErr(err, "Following query failed: "+sqlStatement+"\nStopping here.")
+		}
+		if rowsNb, err := res.RowsAffected(); err == nil && rowsNb == 1 {
+			importRes.ImportedNb++
+		} else {
+			importRes.SkippedNb++
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return SuppressionImportRes{}, CustErr(err, "Could not commit transaction.\nStopping here.")
+	}
+
+	return importRes, nil
+
+}
+
+// ImportSuppressions adds the entries of a CSV sent as request body to the
+// suppression list. Nothing is imported if a line is wrong.
+func ImportSuppressions(w http.ResponseWriter, r *http.Request) {
+
+	if !canManageSuppressions(r, w) {
+		return
+	}
+
+	suppressions, err := parseSuppressionsCSV(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	importRes, err := insertSuppressions(r.Context(), suppressions, getRequestUser(r))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	returnedJson, err := json.Marshal(importRes)
+	if err != nil {
+		err = CustErr(err, "Could not marshall to JSON.\nStopping here.")
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", returnedJson)
+
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSuppressionsCSV(t *testing.T) {
+
+	csv := `Kind,Value,Reason
+email, John.Doe@Example.com ,unsubscribed
+domain,@www.Example.org
+contact-id,0042,"asked by phone, twice"
+`
+	suppressions, err := parseSuppressionsCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Suppression{
+		{Kind: suppressionEmail, Value: "john.doe@example.com", Reason: "unsubscribed"},
+		{Kind: suppressionDomain, Value: "example.org"},
+		{Kind: suppressionContactId, Value: "42", Reason: "asked by phone, twice"},
+	}
+	if !reflect.DeepEqual(suppressions, want) {
+		t.Errorf("got %+v, want %+v", suppressions, want)
+	}
+
+}
+
+func TestParseSuppressionsCSVTellsWhichLineIsWrong(t *testing.T) {
+
+	tests := []struct {
+		csv  string
+		line string
+	}{
+		{"email,john@example.com\nemail\n", "Line 2"},
+		{"email,john@example.com,reason,extra\n", "Line 1"},
+		{"kind,value\nemail,john@example.com\nemail,not-an-email\n", "Line 3"},
+		{"domain,localhost\n", "Line 1"},
+		{"contact-id,-3\n", "Line 1"},
+		{"phone,0102030405\n", "Line 1"},
+	}
+	for _, test := range tests {
+		_, err := parseSuppressionsCSV(strings.NewReader(test.csv))
+		if err == nil || !strings.HasPrefix(err.Error(), test.line) {
+			t.Errorf("%q: got error %v, want it to start with %q", test.csv, err, test.line)
+		}
+	}
+
+}
+
+func TestResolveSuppressionsUsesListInMemory(t *testing.T) {
+
+	savedCache := suppressionsCache
+	t.Cleanup(func() { suppressionsCache = savedCache })
+	suppressionsCache = &suppressionList{
+		emails:     []string{"john@example.com"},
+		domains:    []string{"example.org"},
+		contactIds: []int64{42},
+		expiresAt:  time.Now().Add(time.Minute),
+	}
+
+	// The local db is not read while the list in memory is valid
+	var userInput UserInput
+	err := resolveSuppressions(context.Background(), &userInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(userInput.suppressedEmails, []string{"john@example.com"}) ||
+		!reflect.DeepEqual(userInput.suppressedDomains, []string{"example.org"}) ||
+		!reflect.DeepEqual(userInput.suppressedContactIds, []int64{42}) {
+		t.Errorf("got %v, %v and %v, want the list in memory", userInput.suppressedEmails,
+			userInput.suppressedDomains, userInput.suppressedContactIds)
+	}
+
+	invalidateSuppressions()
+	if time.Now().Before(suppressionsCache.expiresAt) {
+		t.Errorf("list in memory still valid after invalidation")
+	}
+
+}
+
+func TestWritesInvalidateSuppressions(t *testing.T) {
+
+	db := requireLocalDB(t)
+	value := randomName(t, "suppressed-") + ".example"
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM suppression WHERE value = $1`, value)
+		invalidateSuppressions()
+	})
+
+	var userInput UserInput
+	err := resolveSuppressions(context.Background(), &userInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = insertSuppressions(context.Background(), []Suppression{{Kind: suppressionDomain, Value: value}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new entry applies to the next search without waiting for the list in memory to expire
+	err = resolveSuppressions(context.Background(), &userInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, domain := range userInput.suppressedDomains {
+		found = found || domain == value
+	}
+	if !found {
+		t.Errorf("%s not in the suppressed domains %v after its insertion", value, userInput.suppressedDomains)
+	}
+
+}
@@ -8,7 +8,9 @@ if (!process.env.NODE_ENV || process.env.NODE_ENV === 'development') {
   baseURL = 'http://api.example.com:8000/'
 }
 
+// withCredentials sends the session cookie to the API which is on another origin
 export const HTTP = axios.create(
   {
-    baseURL: baseURL
+    baseURL: baseURL,
+    withCredentials: true
   })
@@ -3,6 +3,7 @@
 import Vue from 'vue'
 import App from './App'
 import router from './router'
+import {HTTP} from './http-constants'
 
 import Vuetify from 'vuetify'
 import 'vuetify/dist/vuetify.min.css'
@@ -11,6 +12,14 @@ Vue.use(Vuetify)
 
 Vue.config.productionTip = false
 
+// Go to the login page as soon as the API says the session is over
+HTTP.interceptors.response.use(response => response, error => {
+  if (error.response && error.response.status === 401 && router.currentRoute.name !== 'Login') {
+    router.push({ name: 'Login' })
+  }
+  return Promise.reject(error)
+})
+
 /* eslint-disable no-new */
 new Vue({
   el: '#app',
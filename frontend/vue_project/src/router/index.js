@@ -3,11 +3,17 @@ import Router from 'vue-router'
 
 import GetEmailsCheckedByJohn from '@/components/GetEmailsCheckedByJohn'
 import GetCompaniesAndContacts from '@/components/GetCompaniesAndContacts'
+import Login from '@/components/Login'
 
 Vue.use(Router)
 
 export default new Router({
   routes: [
+    {
+      path: '/login',
+      name: 'Login',
+      component: Login
+    },
     {
       path: '/get-emails-checked-by-john',
       name: 'GetEmailsCheckedByJohn',